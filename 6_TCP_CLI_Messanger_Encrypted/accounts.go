@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Deleting and renaming an account changes the shadow file, the devices
+// file, the chat files and the queue directory of the user. To survive a
+// crash in the middle of such a change, the change is written to the
+// account journal first. Every step of a change can be repeated without
+// harm, so a change found in the journal on startup is simply applied
+// again.
+
+// chatFilePath returns the path of the chat file of the two given users.
+// Chat file names are of the pattern '<user1>:<user2>' in alphabetical
+// username order.
+func chatFilePath(userA string, userB string) string {
+
+	return serverChatDir + min(userA, userB) + ":" + max(userA, userB)
+
+}
+
+// chatPartnersOf returns every user the given user has a chat with.
+//
+// Parameters:
+//	username - the user whose chat partners are returned
+func chatPartnersOf(username string) ([]string, error) {
+
+	if !fileExists(serverChatDir) {
+		return nil, nil
+	}
+
+	entries, err := os.ReadDir(serverChatDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var partners []string
+	for _, entry := range entries {
+
+		// Usernames registered before the username policy existed may
+		// hold a ':', so the name of the user is cut off as a whole
+		if partner, ok := strings.CutPrefix(entry.Name(), username + ":"); ok {
+			partners = append(partners, partner)
+		} else if partner, ok := strings.CutSuffix(entry.Name(), ":" + username); ok {
+			partners = append(partners, partner)
+		}
+
+	}
+	return partners, nil
+
+}
+
+// beginAccountChange writes the given change into the account journal
+// before it is applied.
+//
+// Parameters:
+//	change - the fields of the change, e.g. 'rename <old> <new>' or 'delete <username>'
+func beginAccountChange(change ...string) error {
+
+	return writeFileAtomic(accountJournalPath, []byte(strings.Join(change, " ") + "\n"))
+
+}
+
+// finishAccountChange removes the account journal after a change has been
+// applied completely.
+func finishAccountChange() {
+
+	err := os.Remove(accountJournalPath)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Removing account journal", "err", err)
+	}
+
+}
+
+// recoverAccountChange applies the account change left in the account
+// journal if the server stopped before the change was completed. It has
+// to be called after the shadow and devices files are loaded.
+// Returns true if there was nothing to recover or the recovery succeeded
+// and false otherwise.
+func (s *Server) recoverAccountChange() bool {
+
+	if !fileExists(accountJournalPath) {
+		return true
+	}
+
+	content, err := os.ReadFile(accountJournalPath)
+	if err != nil {
+		slog.Error("Reading account journal", "err", err)
+		return false
+	}
+
+	change := strings.Fields(string(content))
+	slog.Info("Completing interrupted account change", "change", strings.Join(change, " "))
+
+	switch {
+	case len(change) == 2 && change[0] == "delete":
+		err = s.deleteAccountDataLocked(change[1])
+	case len(change) == 3 && change[0] == "rename":
+		err = s.renameAccountDataLocked(change[1], change[2])
+	case len(change) == 0:
+		// The server stopped while the journal was written, nothing was changed yet
+	default:
+		err = errors.New("invalid account journal entry")
+	}
+	if err != nil {
+		slog.Error("Completing interrupted account change", "err", err)
+		return false
+	}
+
+	finishAccountChange()
+	return true
+
+}
+
+// deleteAccountDataLocked removes everything the server stores about the
+// given user: the password hash, the devices, the contacts, every chat of
+// the user along with its timer and the queued messages for the devices of
+// the user. The shadow, devices and contacts files are written afterwards.
+// The function assumes that the s.mu and s.muShadow Mutexes are locked.
+//
+// Parameters:
+//	username - the user whose account is deleted
+func (s *Server) deleteAccountDataLocked(username string) error {
+
+	partners, err := chatPartnersOf(username)
+	if err != nil {
+		return err
+	}
+	for _, partner := range partners {
+		err := os.Remove(chatFilePath(username, partner))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.chatTimers, chatFilePath(username, partner))
+		delete(s.chatIDs, chatID(username, partner))
+		delete(s.chatIndexes, chatFilePath(username, partner))
+	}
+
+	err = os.RemoveAll(serverQueueDir + username)
+	if err != nil {
+		return err
+	}
+	for queuePath := range s.queues {
+		if strings.HasPrefix(queuePath, serverQueueDir + username + "/") {
+			delete(s.queues, queuePath)
+		}
+	}
+
+	delete(s.usrPwdMap, username)
+	delete(s.devices, username)
+
+	s.muContacts.Lock()
+	contactsSaved := s.deleteContactsLocked(username)
+	s.muContacts.Unlock()
+
+	if !contactsSaved || !s.saveUserPasswordHashes() || !s.saveDevices() {
+		return errors.New("saving the account files failed")
+	}
+	return nil
+
+}
+
+// renameAccountDataLocked moves everything the server stores about the
+// given user to the new username: the password hash, the devices, the
+// contacts, every chat of the user along with its records and timer and
+// the queued messages for the devices of the user. The shadow, devices
+// and contacts files are written afterwards.
+// The function assumes that the s.mu and s.muShadow Mutexes are locked.
+//
+// Parameters:
+//	oldName - the current name of the user
+//	newName - the new name of the user
+func (s *Server) renameAccountDataLocked(oldName string, newName string) error {
+
+	partners, err := chatPartnersOf(oldName)
+	if err != nil {
+		return err
+	}
+	for _, partner := range partners {
+
+		newPartner := partner
+		if partner == oldName {
+			newPartner = newName
+		}
+
+		oldPath := chatFilePath(oldName, partner)
+		newPath := chatFilePath(newName, newPartner)
+		err := os.Rename(oldPath, newPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		err = renameChatRecords(newPath, oldName, newName)
+		if err != nil {
+			return err
+		}
+		if timer, ok := s.chatTimers[oldPath]; ok {
+			s.chatTimers[newPath] = timer
+			delete(s.chatTimers, oldPath)
+		}
+		if index, ok := s.chatIndexes[oldPath]; ok {
+			index.rename(oldName, newName)
+			s.chatIndexes[newPath] = index
+			delete(s.chatIndexes, oldPath)
+		}
+		delete(s.chatIDs, chatID(oldName, partner))
+		s.chatIDs[chatID(newName, newPartner)] = [2]string{min(newName, newPartner), max(newName, newPartner)}
+
+	}
+
+	s.renameRateBucketsLocked(oldName, newName)
+
+	oldQueueDir := serverQueueDir + oldName
+	if fileExists(oldQueueDir) && !fileExists(serverQueueDir + newName) {
+		err := os.Rename(oldQueueDir, serverQueueDir + newName)
+		if err != nil {
+			return err
+		}
+		for queuePath, queue := range s.queues {
+			if deviceID, ok := strings.CutPrefix(queuePath, oldQueueDir + "/"); ok {
+				s.queues[serverQueueDir + newName + "/" + deviceID] = queue
+				delete(s.queues, queuePath)
+			}
+		}
+	}
+
+	if pwdHsh, ok := s.usrPwdMap[oldName]; ok {
+		s.usrPwdMap[newName] = pwdHsh
+		delete(s.usrPwdMap, oldName)
+	}
+	if userDevices, ok := s.devices[oldName]; ok {
+		s.devices[newName] = userDevices
+		delete(s.devices, oldName)
+	}
+
+	s.muContacts.Lock()
+	contactsSaved := s.renameContactsLocked(oldName, newName)
+	s.muContacts.Unlock()
+
+	if !contactsSaved || !s.saveUserPasswordHashes() || !s.saveDevices() {
+		return errors.New("saving the account files failed")
+	}
+	return nil
+
+}
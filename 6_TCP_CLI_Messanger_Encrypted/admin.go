@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Admins control the running server with the admin commands. Admin
+// accounts are configured by name with '-admins' and use the commands
+// like every other command. An account has to be registered before the
+// server is started with it as admin, configured names which are not
+// registered are not granted anything, and nobody may register or rename
+// to the name of an admin. The local admin console ('-mode admin')
+// connects to the admin socket of the server ('-admin-socket'), which
+// only the user running the server can open. Every admin action and
+// every refused attempt of one is written to the audit log.
+
+// ADMIN_CONSOLE is the actor of the admin actions taken on the admin
+// socket.
+const ADMIN_CONSOLE = "console"
+
+// AdminHandler runs an admin command.
+// Returns the reply for the admin or an error if the action failed.
+type AdminHandler func(s *Server, actor string, args string) (string, error)
+
+var adminCommands = map[string]AdminHandler {
+	"/kick": 	  adminKick,
+	"/ban": 	  adminBan,
+	"/unban": 	  adminUnban,
+	"/broadcast": adminBroadcast,
+	"/stats": 	  adminStats,
+	"/users": 	  adminUsers,
+}
+
+var adminCommandDescriptions = [...]string {
+	"- '/kick <username>': Logs out every session of the given user and closes their connections.",
+	"- '/ban <username>': Kicks the given user and refuses every further login of the user until '/unban'.",
+	"- '/unban <username>': Allows the given user to log in again.",
+	"- '/broadcast <text>': Sends the given text to every connected client.",
+	"- '/stats': Shows how busy the server is.",
+	"- '/users': Lists every registered user along with their sessions.",
+}
+
+// runAdminCommand runs the given admin command for the given admin and
+// writes it to the audit log. The actor has to be an admin already.
+// Returns the reply for the admin.
+//
+// Parameters:
+//	actor - the admin account or ADMIN_CONSOLE
+//	line - the command as typed by the admin
+func (s *Server) runAdminCommand(actor string, line string) string {
+
+	command, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	args = strings.TrimSpace(args)
+
+	if command == "/help" {
+		return "The following admin commands are available:\n" + strings.Join(adminCommandDescriptions[:], "\n")
+	}
+
+	handler, ok := adminCommands[command]
+	if !ok {
+		return "[Error] '" + command + "' is no admin command. Use '/help' to list the admin commands."
+	}
+
+	reply, err := handler(s, actor, args)
+	if err != nil {
+		s.auditAdminAction(actor, command, args, err.Error())
+		return "[Error] " + err.Error()
+	}
+	s.auditAdminAction(actor, command, args, AUDIT_OK)
+	return reply
+
+}
+
+// dropUnregisteredAdmins revokes the admin rights of the configured admins
+// who are not registered. Anyone could register such a name otherwise and
+// use the admin commands.
+// The function assumes that every other goroutine has not been started
+// yet.
+func (s *Server) dropUnregisteredAdmins() {
+
+	for admin := range s.admins {
+		if _, registered := s.usrPwdMap[admin]; !registered {
+			slog.Warn("Admin is not registered and is not granted the admin commands. Register the account and restart the server", "admin", admin)
+			delete(s.admins, admin)
+		}
+	}
+
+}
+
+// handleAdminCommand runs an admin command sent by a client. Only clients
+// logged in as one of the admins may use the admin commands, refused
+// attempts are written to the audit log as well.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the admin command with its arguments
+func handleAdminCommand(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	command, args, _ := strings.Cut(string(payload), " ")
+
+	s.mu.Lock()
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	s.mu.Unlock()
+
+	if !clientIsLoggedIn || !s.admins[username] {
+		log.Warn("Admin command refused", "command", command)
+		if clientIsLoggedIn {
+			s.auditAdminAction(username, command, strings.TrimSpace(args), AUDIT_DENIED)
+		}
+		msg    := "[Error] '" + command + "' can only be used by admins."
+		errMsg := "[Error] Writing 'not an admin' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+
+	msg    := s.runAdminCommand(username, string(payload))
+	errMsg := "[Error] Writing reply of '" + command + "' to " + conn.RemoteAddr().String()
+	s.sendMessageToClient(conn, msg, errMsg)
+
+}
+
+// kickUserLocked logs out every session of the given user and closes
+// their connections after telling them why.
+// The function assumes that the s.mu Mutex is locked.
+// Returns the number of closed sessions.
+//
+// Parameters:
+//	username - the user to kick
+//	reason - the message sent to every session before it is closed
+func (s *Server) kickUserLocked(username string, reason string) int {
+
+	kicked := 0
+	for conn := range s.clientConnsRev[username] {
+
+		errMsg := "[Error] Writing 'kicked' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, reason, errMsg)
+
+		s.removeSessionLocked(conn, LOGOUT_KICKED)
+		s.closeConnectionLocked(conn)
+		kicked++
+
+	}
+	return kicked
+
+}
+
+// adminKick logs the given user out of every session and closes their
+// connections.
+func adminKick(s *Server, actor string, args string) (string, error) {
+
+	fields := strings.Fields(args)
+	if len(fields) != 1 {
+		return "", errors.New("please use '/kick <username>'")
+	}
+
+	s.muShadow.Lock()
+	username := s.resolveUsernameLocked(fields[0])
+	s.muShadow.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kicked := s.kickUserLocked(username, "You have been kicked by an admin. Closing this connection...")
+	if kicked == 0 {
+		return "", fmt.Errorf("'%s' is not logged in", username)
+	}
+	return fmt.Sprintf("Kicked '%s' from %d session(s).", username, kicked), nil
+
+}
+
+// adminBan kicks the given user and refuses their logins until they are
+// unbanned. The ban is persisted.
+func adminBan(s *Server, actor string, args string) (string, error) {
+
+	fields := strings.Fields(args)
+	if len(fields) != 1 {
+		return "", errors.New("please use '/ban <username>'")
+	}
+
+	s.muShadow.Lock()
+	username := s.resolveUsernameLocked(fields[0])
+	_, exists := s.usrPwdMap[username]
+	s.muShadow.Unlock()
+
+	if !exists {
+		return "", fmt.Errorf("'%s' is no registered user", username)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.banned[username] {
+		return "", fmt.Errorf("'%s' is banned already", username)
+	}
+	s.banned[username] = true
+	if err := s.saveBansLocked(); err != nil {
+		delete(s.banned, username)
+		return "", fmt.Errorf("saving the ban failed: %w", err)
+	}
+
+	kicked := s.kickUserLocked(username, "You have been banned by an admin. Closing this connection...")
+	return fmt.Sprintf("Banned '%s' and closed %d session(s).", username, kicked), nil
+
+}
+
+// adminUnban allows a banned user to log in again.
+func adminUnban(s *Server, actor string, args string) (string, error) {
+
+	fields := strings.Fields(args)
+	if len(fields) != 1 {
+		return "", errors.New("please use '/unban <username>'")
+	}
+
+	s.muShadow.Lock()
+	username := s.resolveUsernameLocked(fields[0])
+	s.muShadow.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.banned[username] {
+		return "", fmt.Errorf("'%s' is not banned", username)
+	}
+	delete(s.banned, username)
+	if err := s.saveBansLocked(); err != nil {
+		s.banned[username] = true
+		return "", fmt.Errorf("saving the ban failed: %w", err)
+	}
+	return "Unbanned '" + username + "'.", nil
+
+}
+
+// adminBroadcast sends the given text to every connected client.
+func adminBroadcast(s *Server, actor string, args string) (string, error) {
+
+	if args == "" {
+		return "", errors.New("please use '/broadcast <text>'")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.clientConns {
+		errMsg := "[Error] Writing broadcast to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, "[Broadcast] " + args, errMsg)
+	}
+	return fmt.Sprintf("Sent the broadcast to %d connection(s).", len(s.clientConns)), nil
+
+}
+
+// adminStats reports the uptime, the load and the counters of the server.
+func adminStats(s *Server, actor string, args string) (string, error) {
+
+	chats := 0
+	if entries, err := os.ReadDir(serverChatDir); err == nil {
+		chats = len(entries)
+	}
+
+	s.mu.Lock()
+	connections  := len(s.clientConns)
+	onlineUsers  := len(s.clientConnsRev)
+	sessions 	 := 0
+	for _, userSessions := range s.clientConnsRev {
+		sessions += len(userSessions)
+	}
+	chatRequests := len(s.chatRequests)
+	banned 		 := len(s.banned)
+	s.mu.Unlock()
+
+	s.muShadow.Lock()
+	users 	:= len(s.usrPwdMap)
+	devices := 0
+	for _, userDevices := range s.devices {
+		devices += len(userDevices)
+	}
+	s.muShadow.Unlock()
+
+	lines := []string{
+		"Uptime: " + time.Since(s.startedAt).Round(time.Second).String(),
+		fmt.Sprintf("Connections: %d open, %d accepted since the start", connections, s.stats.connections.Load()),
+		fmt.Sprintf("Users online: %d with %d session(s)", onlineUsers, sessions),
+		fmt.Sprintf("Registered users: %d with %d device(s), %d banned", users, devices, banned),
+		fmt.Sprintf("Chats: %d, pending chat requests: %d", chats, chatRequests),
+		fmt.Sprintf("Packets received: %d, chat messages routed: %d", s.stats.packets.Load(), s.stats.chatMessages.Load()),
+	}
+	return strings.Join(lines, "\n"), nil
+
+}
+
+// adminUsers lists every registered user with their number of sessions
+// and whether they are admins or banned.
+func adminUsers(s *Server, actor string, args string) (string, error) {
+
+	s.muShadow.Lock()
+	usernames := slices.Sorted(maps.Keys(s.usrPwdMap))
+	s.muShadow.Unlock()
+
+	if len(usernames) == 0 {
+		return "There are no registered users.", nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lines []string
+	for _, username := range usernames {
+
+		line := "- " + username
+		if sessions := len(s.clientConnsRev[username]); sessions > 0 {
+			line += fmt.Sprintf(" (online, %d session(s))", sessions)
+		}
+		if s.admins[username] {
+			line += " (admin)"
+		}
+		if s.banned[username] {
+			line += " (banned)"
+		}
+		lines = append(lines, line)
+
+	}
+	return "Registered users:\n" + strings.Join(lines, "\n"), nil
+
+}
+
+// loadBans reads the banned users from the bans file into the server.
+// Returns true on successfull loading and false otherwise
+func (s *Server) loadBans() bool {
+
+	if !fileExists(bansPath) {
+		return true
+	}
+
+	content, err := os.ReadFile(bansPath)
+	if err != nil {
+		slog.Error("Reading bans file", "err", err)
+		return false
+	}
+
+	for _, username := range strings.Fields(string(content)) {
+		s.banned[username] = true
+	}
+
+	slog.Info("Successfully loaded bans file", "banned", len(s.banned))
+	return true
+
+}
+
+// saveBansLocked writes the banned users into the bans file, one per
+// line.
+// The function assumes that the s.mu Mutex is locked.
+func (s *Server) saveBansLocked() error {
+
+	var content strings.Builder
+	for _, username := range slices.Sorted(maps.Keys(s.banned)) {
+		content.WriteString(username + "\n")
+	}
+	return writeFileAtomic(bansPath, []byte(content.String()))
+
+}
+
+// serveAdminSocket accepts admin consoles on the admin socket until the
+// server shuts down. Every admin console may send admin commands as
+// "COMMAND" packets and receives the replies as "MESSAGE" packets.
+//
+// Parameters:
+// 	ctx - Context for cancellation of function
+// 	mainWG - Waitgroup for syncing
+func (s *Server) serveAdminSocket(ctx context.Context, mainWG *sync.WaitGroup) {
+
+	defer mainWG.Done()
+
+	var wg sync.WaitGroup
+
+	ln, err := listenAdminSocket(s.adminSocket)
+	if err != nil {
+		slog.Error("Listening on admin socket", "err", err)
+		return
+	}
+	defer os.Remove(s.adminSocket)
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	slog.Info("Admin console can connect", "socket", s.adminSocket)
+	for {
+
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Accepting admin console", "err", err)
+			}
+			break
+		}
+
+		wg.Add(1)
+		go s.handleAdminConsole(ctx, &wg, conn)
+
+	}
+
+	slog.Info("Shutting down: Accepting admin consoles")
+	wg.Wait()
+
+}
+
+// listenAdminSocket listens on a unix socket at the given path which only
+// the user running the server can open. The socket is created in a new
+// directory only that user can enter and is moved to the path once its
+// permissions are restricted, so there is no moment in which others could
+// connect to it.
+//
+// Parameters:
+//	path - the path of the admin socket
+func listenAdminSocket(path string) (net.Listener, error) {
+
+	// A socket file left behind by a crashed server would block the listener
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("removing old admin socket: %w", err)
+	}
+
+	privateDir, err := os.MkdirTemp(filepath.Dir(path), ".admin-socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(privateDir)
+	if err := os.Chmod(privateDir, 0700); err != nil {
+		return nil, err
+	}
+
+	privatePath := filepath.Join(privateDir, "admin.sock")
+	ln, err := net.Listen("unix", privatePath)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed from its final path by serveAdminSocket
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	if err := os.Chmod(privatePath, 0600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("restricting access to admin socket: %w", err)
+	}
+	if err := os.Rename(privatePath, path); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+
+}
+
+// handleAdminConsole runs the admin commands sent by an admin console
+// until the console disconnects or the server shuts down. The commands
+// are passed to processMessageChannelInput, so they run one after the
+// other with the commands of the clients and never write to a client
+// connection at the same time as another handler.
+//
+// Parameters:
+// 	ctx - Context for cancellation of function
+// 	wg - Waitgroup for syncing
+// 	conn - the connection of the admin console
+func (s *Server) handleAdminConsole(ctx context.Context, wg *sync.WaitGroup, conn net.Conn) {
+
+	defer wg.Done()
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	slog.Info("Admin console connected")
+	for {
+
+		packet, err := readPacket(conn)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				slog.Error("Reading from admin console", "err", err)
+			}
+			slog.Info("Admin console disconnected")
+			return
+		}
+		if packet.MsgType != "COMMAND" {
+			continue
+		}
+
+		replyCh := make(chan string, 1)
+		s.stats.dispatchQueue.Add(1)
+		select {
+		case s.msgChannel <- Message{msgType: "ADMIN", payload: []byte(packet.Payload), reply: replyCh}:
+		case <-ctx.Done():
+			s.stats.dispatchQueue.Add(-1)
+			return
+		}
+
+		var reply string
+		select {
+		case reply = <-replyCh:
+		case <-ctx.Done():
+			return
+		}
+		if err := writePacket(conn, Packet{MsgType: "MESSAGE", Payload: reply}); err != nil {
+			slog.Error("Writing to admin console", "err", err)
+			return
+		}
+
+	}
+
+}
+
+// runAdminConsole connects to the admin socket of a server running on
+// this machine and sends every line read from stdin as an admin command.
+//
+// Parameters:
+//	socketPath - the admin socket of the server
+func runAdminConsole(socketPath string) {
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		fmt.Println("[Error] Connecting to the admin socket:", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	fmt.Println("Connected to the admin socket. Use '/help' to list the admin commands.")
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "/quit" {
+			return
+		}
+
+		if err := writePacket(conn, Packet{MsgType: "COMMAND", Payload: line}); err != nil {
+			fmt.Println("[Error] Sending admin command:", err)
+			return
+		}
+		reply, err := readPacket(conn)
+		if err != nil {
+			fmt.Println("[Error] Reading reply:", err)
+			return
+		}
+		fmt.Println(reply.Payload)
+
+	}
+
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The audit log records every registration, login, failed login, logout,
+// lockout and admin action as one json object per line. It is only ever
+// appended to. Every entry carries the hash of the entry before it and its
+// own HMAC over all of its other fields, so changing, inserting or
+// removing an entry breaks the chain from there on, which
+// '-mode verify-audit' detects. The key of the HMAC is kept in a file
+// outside the data directory ('-audit-key'), so whoever can only write to
+// the data directory can not compute the hashes of forged entries.
+// Removing entries from the end can only be detected by comparing the hash
+// of the last entry, which the server logs on startup and shutdown, with a
+// copy kept elsewhere.
+
+// AuditEntry is a security relevant event in the audit log.
+type AuditEntry struct {
+	Seq 	int64 	  `json:"seq"` 				 // Position in the audit log, starting at 1
+	Time 	time.Time `json:"time"`
+	Event 	string 	  `json:"event"` 			 // One of the AUDIT_ events
+	Actor 	string 	  `json:"actor"` 			 // The user, admin account or ADMIN_CONSOLE
+	Remote 	string 	  `json:"remote,omitempty"` // The address of the client
+	Command string 	  `json:"command,omitempty"` // The admin command of AUDIT_ADMIN
+	Args 	string 	  `json:"args,omitempty"`
+	Result 	string 	  `json:"result"` 			 // AUDIT_OK, AUDIT_DENIED or why the event failed
+	Prev 	string 	  `json:"prev"` 			 // Hash of the entry before, auditGenesisHash for the first one
+	Hash 	string 	  `json:"hash,omitempty"` 	 // HMAC of the entry without this field
+}
+
+// Events in the audit log.
+const (
+	AUDIT_REGISTER = "register"
+	AUDIT_LOGIN    = "login"
+	AUDIT_LOGOUT   = "logout"
+	AUDIT_LOCKOUT  = "lockout"
+	AUDIT_ADMIN    = "admin"
+)
+
+// Reasons of AUDIT_LOGOUT events.
+const (
+	LOGOUT_REQUESTED 		= "logout" 			// The client used '/logout'
+	LOGOUT_DISCONNECTED 	= "disconnected" 	// The connection was closed, e.g. by '/quit'
+	LOGOUT_TAKEN_OVER 		= "taken over" 		// Another login of the user took the session over
+	LOGOUT_KICKED 			= "kicked" 			// An admin kicked or banned the user
+	LOGOUT_UNLINKED 		= "device unlinked"
+	LOGOUT_ACCOUNT_DELETED 	= "account deleted"
+)
+
+// Results of events.
+const (
+	AUDIT_OK 	 = "ok"
+	AUDIT_DENIED = "denied"
+)
+
+// auditGenesisHash is the hash the first entry of the audit log chains to.
+var auditGenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// auditKeySize is the number of random bytes of the key of the audit log.
+const auditKeySize = 32
+
+// defaultAuditKeyPath returns where the key of the audit log is kept if
+// '-audit-key' is not given, in the config directory of the user running
+// the server.
+func defaultAuditKeyPath() (string, error) {
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "messanger", "audit.key"), nil
+
+}
+
+// loadOrCreateAuditKey reads the hex encoded key of the audit log from the
+// given file. If the file does not exist yet, a new key is generated and
+// written to it. The key must not be kept in the server data directory.
+//
+// Parameters:
+//	path - the key file
+//	create - whether a missing key file is created
+func loadOrCreateAuditKey(path string, create bool) ([]byte, error) {
+
+	if path == "" {
+		return nil, errors.New("no key file of the audit log given, use '-audit-key'")
+	}
+
+	absKey, errK := filepath.Abs(path)
+	absData, errD := filepath.Abs(serverDataDir)
+	if errK != nil || errD != nil {
+		return nil, errors.Join(errK, errD)
+	}
+	if rel, err := filepath.Rel(absData, absKey); err == nil && rel != ".." && !strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+		return nil, fmt.Errorf("the key file of the audit log '%s' has to be kept outside of the data directory", path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+		if err != nil || len(key) != auditKeySize {
+			return nil, fmt.Errorf("invalid key file of the audit log '%s'", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) || !create {
+		return nil, err
+	}
+
+	key := make([]byte, auditKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	keyFile, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer keyFile.Close()
+	if _, err := keyFile.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		return nil, err
+	}
+	slog.Info("Created key of the audit log", "file", path)
+	return key, keyFile.Sync()
+
+}
+
+// hashAuditEntry returns the HMAC of the given entry, which covers every
+// field but the hash itself.
+//
+// Parameters:
+//	key - the key of the audit log
+//	entry - the entry to hash
+func hashAuditEntry(key []byte, entry AuditEntry) (string, error) {
+
+	entry.Hash = ""
+	jsonData, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(jsonData)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+
+}
+
+// loadAuditLog verifies the audit log and continues its chain after its
+// last entry. A broken chain is logged, but does not stop the server.
+// Returns false if the audit log can not be read.
+func (s *Server) loadAuditLog() bool {
+
+	s.muAudit.Lock()
+	defer s.muAudit.Unlock()
+
+	s.auditHead = auditGenesisHash
+	s.auditSeq  = 0
+
+	key, err := loadOrCreateAuditKey(s.auditKeyPath, true)
+	if err != nil {
+		slog.Error("Loading key of the audit log", "err", err)
+		return false
+	}
+	s.auditKey = key
+
+	if !fileExists(auditLogPath) {
+		return true
+	}
+
+	count, err := verifyAuditLog(auditLogPath, s.auditKey)
+	if err != nil {
+		slog.Error("Audit log has been tampered with", "err", err)
+	}
+
+	content, err := os.ReadFile(auditLogPath)
+	if err != nil {
+		slog.Error("Reading audit log", "err", err)
+		return false
+	}
+
+	// After an unreadable last entry the chain starts over, which the verifier reports
+	last, err := lastAuditEntry(content)
+	if err != nil {
+		slog.Error("Reading last entry of audit log", "err", err)
+	} else if last != nil {
+		s.auditHead = last.Hash
+		s.auditSeq  = last.Seq
+	}
+
+	slog.Info("Loaded audit log", "entries", count, "head", s.auditHead)
+	return true
+
+}
+
+// audit appends the given event to the audit log and chains it to the
+// entry before. Sequence number, time, previous hash and hash are filled
+// in.
+//
+// Parameters:
+//	entry - the event to append
+func (s *Server) audit(entry AuditEntry) {
+
+	if entry.Command != "" {
+		slog.Info("Audit event", "event", entry.Event, "actor", entry.Actor, "command", entry.Command, "result", entry.Result)
+	} else {
+		slog.Info("Audit event", "event", entry.Event, "actor", entry.Actor, "result", entry.Result)
+	}
+
+	s.muAudit.Lock()
+	defer s.muAudit.Unlock()
+
+	entry.Seq  = s.auditSeq + 1
+	entry.Time = time.Now().UTC()
+	entry.Prev = s.auditHead
+
+	hash, err := hashAuditEntry(s.auditKey, entry)
+	if err != nil {
+		slog.Error("Hashing audit entry", "err", err)
+		return
+	}
+	entry.Hash = hash
+
+	jsonData, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Marshalling audit entry", "err", err)
+		return
+	}
+
+	auditFile, err := os.OpenFile(auditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Opening audit log", "err", err)
+		return
+	}
+	defer auditFile.Close()
+
+	if _, err := auditFile.Write(append(jsonData, '\n')); err != nil {
+		slog.Error("Writing audit log", "err", err)
+		return
+	}
+	if err := auditFile.Sync(); err != nil {
+		slog.Error("Flushing audit log", "err", err)
+		return
+	}
+
+	s.auditSeq  = entry.Seq
+	s.auditHead = entry.Hash
+
+}
+
+// auditAdminAction appends an admin action to the audit log.
+//
+// Parameters:
+//	actor - the admin account or ADMIN_CONSOLE
+//	command - the admin command
+//	args - the arguments of the command
+//	result - AUDIT_OK, AUDIT_DENIED or the error of the action
+func (s *Server) auditAdminAction(actor string, command string, args string, result string) {
+
+	s.audit(AuditEntry{
+		Event: 	 AUDIT_ADMIN,
+		Actor: 	 actor,
+		Command: command,
+		Args: 	 args,
+		Result:  result,
+	})
+
+}
+
+// verifyAuditLog checks that every entry of the audit log at the given
+// path is unchanged and chained to the entry before it.
+// Returns the number of entries and an error naming the first broken
+// entry, if any.
+//
+// Parameters:
+//	path - the audit log
+//	key - the key of the audit log
+func verifyAuditLog(path string, key []byte) (int, error) {
+
+	auditFile, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer auditFile.Close()
+
+	prev  := auditGenesisHash
+	count := 0
+
+	scanner := bufio.NewScanner(auditFile)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+
+		line := scanner.Bytes()
+
+		var entry AuditEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return count, fmt.Errorf("line %d can not be read: %w", lineNum, err)
+		}
+
+		// Fields which are unknown or formatted differently are not covered by the hash
+		canonical, err := json.Marshal(entry)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if !bytes.Equal(canonical, line) {
+			return count, fmt.Errorf("line %d has been altered", lineNum)
+		}
+
+		if entry.Seq != int64(lineNum) {
+			return count, fmt.Errorf("line %d has sequence number %d, entries were removed or inserted", lineNum, entry.Seq)
+		}
+		if entry.Prev != prev {
+			return count, fmt.Errorf("line %d does not chain to the entry before it", lineNum)
+		}
+		hash, err := hashAuditEntry(key, entry)
+		if err != nil {
+			return count, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		if !hmac.Equal([]byte(hash), []byte(entry.Hash)) {
+			return count, fmt.Errorf("line %d has been altered, its hash does not match", lineNum)
+		}
+
+		prev = entry.Hash
+		count++
+
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	return count, nil
+
+}
+
+// lastAuditEntry returns the last entry of the given audit log, nil if it
+// is empty.
+//
+// Parameters:
+//	content - the content of the audit log
+func lastAuditEntry(content []byte) (*AuditEntry, error) {
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if lines[len(lines) - 1] == "" {
+		return nil, nil
+	}
+
+	var entry AuditEntry
+	if err := json.Unmarshal([]byte(lines[len(lines) - 1]), &entry); err != nil {
+		return nil, err
+	}
+	if entry.Hash == "" {
+		return nil, errors.New("the last entry has no hash")
+	}
+	return &entry, nil
+
+}
+
+// runAuditVerifier verifies the audit log of the server data directory
+// with the key in the given file and prints the result.
+// Returns false if the audit log is broken or can not be read.
+//
+// Parameters:
+//	keyPath - the key file of the audit log
+func runAuditVerifier(keyPath string) bool {
+
+	key, err := loadOrCreateAuditKey(keyPath, false)
+	if err != nil {
+		fmt.Printf("[Error] Reading the key of the audit log: %v\n", err)
+		return false
+	}
+
+	count, err := verifyAuditLog(auditLogPath, key)
+	if err != nil {
+		fmt.Printf("[Error] Audit log '%s' is broken after %d intact entries: %v\n", auditLogPath, count, err)
+		return false
+	}
+
+	head := auditGenesisHash
+	if content, err := os.ReadFile(auditLogPath); err == nil {
+		if last, err := lastAuditEntry(content); err == nil && last != nil {
+			head = last.Hash
+		}
+	}
+	fmt.Printf("Audit log '%s' is intact: %d entries, last hash %s\n", auditLogPath, count, head)
+	return true
+
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chat files hold a record of every chat message, of every edit and
+// deletion of a message and of every change of the disappearing message
+// timer of the chat, one json encoded ChatRecord per line. The server can
+// not read chat messages, so a record only holds the metadata of a
+// message. A deleted message is marked by a tombstone record referring to
+// it. Messages sent while a timer is set expire and are purged from the
+// chat files and the queues by the sweeper along with their edits and
+// tombstones.
+
+// Kinds of chat records.
+const (
+	CHAT_RECORD_MESSAGE = "message"
+	CHAT_RECORD_EDIT 	= "edit"
+	CHAT_RECORD_DELETE 	= "delete" // The tombstone of a deleted message
+	CHAT_RECORD_TIMER 	= "timer"
+)
+
+// ChatRecord is an entry of a chat file.
+type ChatRecord struct {
+	Kind 	string 		  `json:"kind"`
+	ID 		string 		  `json:"id,omitempty"`  // The ID of the message
+	Ref 	string 		  `json:"ref,omitempty"` // The message which is edited, deleted or replied to
+	From 	string 		  `json:"from"`
+	Time 	time.Time 	  `json:"time"`
+	Expires time.Time 	  `json:"expires,omitzero"` // When the message disappears, zero if it does not
+	Timer 	time.Duration `json:"timer,omitempty"`  // The new timer of the chat
+}
+
+// readChatRecords returns every record of the given chat file.
+//
+// Parameters:
+//	chatPath - the chat file to read
+func readChatRecords(chatPath string) ([]ChatRecord, error) {
+
+	file, err := os.Open(chatPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []ChatRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+
+		if scanner.Text() == "" {
+			continue
+		}
+
+		var record ChatRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			slog.Warn("Invalid record in chat file", "file", chatPath, "err", err)
+			continue
+		}
+		records = append(records, record)
+
+	}
+	return records, scanner.Err()
+
+}
+
+// IndexedRecord is what a ChatIndex holds about a record of a chat file.
+type IndexedRecord struct {
+	kind 	string
+	from 	string
+	expires time.Time
+	deleted bool // Whether a tombstone refers to the message
+}
+
+// ChatIndex holds the IDs of the records of a chat file along with the
+// sender and expiry of every record, so chat messages are checked without
+// reading the chat file. It is built once from the chat file and updated
+// along with it.
+type ChatIndex struct {
+	records 	map[string]*IndexedRecord // Maps from the ID of a record to the record, the first record wins if an ID was reused
+	nextExpiry 	time.Time 				  // The earliest expiry of a record, zero if no record expires
+}
+
+// newChatIndex returns the index of the given records of a chat file.
+//
+// Parameters:
+//	records - the records of a chat file
+func newChatIndex(records []ChatRecord) *ChatIndex {
+
+	index := &ChatIndex{records: make(map[string]*IndexedRecord)}
+	for _, record := range records {
+		index.add(record)
+	}
+	return index
+
+}
+
+// add adds a record which was appended to the chat file to the index.
+//
+// Parameters:
+//	record - the appended record
+func (ci *ChatIndex) add(record ChatRecord) {
+
+	if !record.Expires.IsZero() && (ci.nextExpiry.IsZero() || record.Expires.Before(ci.nextExpiry)) {
+		ci.nextExpiry = record.Expires
+	}
+	if record.Kind == CHAT_RECORD_DELETE {
+		if target, ok := ci.records[record.Ref]; ok {
+			target.deleted = true
+		}
+	}
+	if _, taken := ci.records[record.ID]; taken || record.ID == "" {
+		return
+	}
+	ci.records[record.ID] = &IndexedRecord{kind: record.Kind, from: record.From, expires: record.Expires}
+
+}
+
+// taken reports whether any record of the chat already uses the given
+// message ID. The IDs are chosen by the clients, so a reused ID would let
+// an edit or deletion refer to the message of another user.
+//
+// Parameters:
+//	id - the ID of the new message
+func (ci *ChatIndex) taken(id string) bool {
+
+	_, taken := ci.records[id]
+	return taken && id != ""
+
+}
+
+// message returns the message with the given ID if it has not been
+// deleted.
+//
+// Parameters:
+//	id - the ID of the message
+func (ci *ChatIndex) message(id string) (IndexedRecord, bool) {
+
+	record, ok := ci.records[id]
+	if !ok || record.kind != CHAT_RECORD_MESSAGE || record.deleted {
+		return IndexedRecord{}, false
+	}
+	return *record, true
+
+}
+
+// rename replaces the old name of a user with the new name, as it is
+// replaced in the chat file.
+//
+// Parameters:
+//	oldName - the name the user had
+//	newName - the name the user has now
+func (ci *ChatIndex) rename(oldName string, newName string) {
+
+	for _, record := range ci.records {
+		if record.from == oldName {
+			record.from = newName
+		}
+	}
+
+}
+
+// chatIndexLocked returns the index of the given chat file. The index is
+// built from the chat file if there is none yet.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	chatPath - the chat file
+func (s *Server) chatIndexLocked(chatPath string) (*ChatIndex, error) {
+
+	if index, ok := s.chatIndexes[chatPath]; ok {
+		return index, nil
+	}
+
+	records, err := readChatRecords(chatPath)
+	if err != nil {
+		return nil, err
+	}
+	index := newChatIndex(records)
+	s.chatIndexes[chatPath] = index
+	return index, nil
+
+}
+
+// appendChatRecord appends the given record to the given chat file.
+//
+// Parameters:
+//	chatPath - the chat file to append to
+//	record - the record to append
+func appendChatRecord(chatPath string, record ChatRecord) error {
+
+	jsonData, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	chatFile, err := os.OpenFile(chatPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer chatFile.Close()
+
+	_, err = chatFile.Write(append(jsonData, '\n'))
+	return err
+
+}
+
+// writeChatRecords replaces the content of the given chat file with the
+// given records.
+//
+// Parameters:
+//	chatPath - the chat file to write
+//	records - the records the chat file holds afterwards
+func writeChatRecords(chatPath string, records []ChatRecord) error {
+
+	var content []byte
+	for _, record := range records {
+		jsonData, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, jsonData...), '\n')
+	}
+	return writeFileAtomic(chatPath, content)
+
+}
+
+// renameChatRecords replaces the old name of a user with the new name in
+// every record of the given chat file.
+//
+// Parameters:
+//	chatPath - the chat file of the renamed user
+//	oldName - the name the user had
+//	newName - the name the user has now
+func renameChatRecords(chatPath string, oldName string, newName string) error {
+
+	records, err := readChatRecords(chatPath)
+	if err != nil {
+		return err
+	}
+
+	renamed := false
+	for i := range records {
+		if records[i].From == oldName {
+			records[i].From = newName
+			renamed = true
+		}
+	}
+
+	if !renamed {
+		return nil
+	}
+	return writeChatRecords(chatPath, records)
+
+}
+
+// loadChatIDs fills s.chatIDs from the chat directory and s.chatIndexes
+// from the chat files, so chat messages are routed and checked without
+// reading the chat directory or the chat files. Both are kept up to date
+// whenever a chat is created, renamed or deleted. Usernames registered before the username policy existed may
+// hold a ':', so a chat file name is split at the first ':' where both
+// parts are registered users.
+// Returns true if the chat directory could be read and false otherwise.
+func (s *Server) loadChatIDs() bool {
+
+	if !fileExists(serverChatDir) {
+		return true
+	}
+
+	entries, err := os.ReadDir(serverChatDir)
+	if err != nil {
+		slog.Error("Reading chat directory", "err", err)
+		return false
+	}
+
+	for _, entry := range entries {
+
+		name := entry.Name()
+		userA, userB, isChat := strings.Cut(name, ":")
+		if !isChat {
+			slog.Warn("Invalid chat file name", "file", serverChatDir + name)
+			continue
+		}
+		for i := len(userA); i < len(name); i++ {
+			if name[i] != ':' {
+				continue
+			}
+			_, registeredA := s.usrPwdMap[name[:i]]
+			_, registeredB := s.usrPwdMap[name[i+1:]]
+			if registeredA && registeredB {
+				userA, userB = name[:i], name[i+1:]
+				break
+			}
+		}
+		s.chatIDs[chatID(userA, userB)] = [2]string{userA, userB}
+
+		if _, err := s.chatIndexLocked(serverChatDir + name); err != nil {
+			slog.Error("Reading chat file", "file", serverChatDir + name, "err", err)
+			return false
+		}
+
+	}
+
+	slog.Info("Successfully loaded chat IDs")
+	return true
+
+}
+
+// chatPartnerLocked returns the other member of the chat with the given
+// ID, if the given user is a member of it.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	id - the ID of the chat
+//	username - the user who has to be a member of the chat
+func (s *Server) chatPartnerLocked(id string, username string) (string, bool) {
+
+	members, ok := s.chatIDs[id]
+	if !ok {
+		return "", false
+	}
+
+	switch username {
+	case members[0]:
+		return members[1], true
+	case members[1]:
+		return members[0], true
+	}
+	return "", false
+
+}
+
+// sendChatErrorLocked tells the sender of a chat message why it was not
+// routed.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	conn - the connection of the sender
+//	chatErr - why the message was not routed
+func (s *Server) sendChatErrorLocked(conn net.Conn, chatErr ChatError) {
+
+	log := s.connLogLocked(conn)
+
+	jsonData, err := json.Marshal(chatErr)
+	if err != nil {
+		log.Error("Marshalling chat error", "err", err)
+		return
+	}
+	if err := writePacket(conn, Packet{MsgType: "ERROR", Payload: string(jsonData)}); err != nil {
+		log.Error("Writing chat error", "err", err)
+	}
+
+}
+
+// loadChatTimers reads the latest timer of every chat file which ever had
+// a timer into the server.
+// Returns true on successfull loading and false otherwise
+func (s *Server) loadChatTimers() bool {
+
+	if !fileExists(serverChatDir) {
+		return true
+	}
+
+	entries, err := os.ReadDir(serverChatDir)
+	if err != nil {
+		slog.Error("Reading chat directory", "err", err)
+		return false
+	}
+
+	for _, entry := range entries {
+
+		chatPath := serverChatDir + entry.Name()
+		records, err := readChatRecords(chatPath)
+		if err != nil {
+			slog.Error("Reading chat file", "file", chatPath, "err", err)
+			return false
+		}
+
+		for _, record := range records {
+			if record.Kind == CHAT_RECORD_TIMER {
+				s.chatTimers[chatPath] = record.Timer
+			}
+		}
+
+	}
+
+	slog.Info("Successfully loaded chat timers")
+	return true
+
+}
+
+// sweepExpiredMessages purges expired messages and removes the rate limit
+// buckets which are full again every expirySweepInterval until the server
+// shuts down.
+//
+// Parameters:
+// 	ctx - Context for cancellation of function
+// 	wg - Waitgroup for syncing
+func (s *Server) sweepExpiredMessages(ctx context.Context, wg *sync.WaitGroup) {
+
+	defer wg.Done()
+
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Shutting down: Sweeping expired messages")
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.purgeExpiredLocked(now)
+			s.pruneRateBucketsLocked(now)
+			s.mu.Unlock()
+		}
+
+	}
+
+}
+
+// purgeExpiredLocked removes the records of expired messages from the
+// chat files and the expired messages from the queues. Only the files
+// holding a message which is due are read and written, the others are
+// skipped by the earliest expiry kept in their index or queue state.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	now - the current time
+func (s *Server) purgeExpiredLocked(now time.Time) {
+
+	for chatPath, index := range s.chatIndexes {
+
+		if index.nextExpiry.IsZero() || index.nextExpiry.After(now) {
+			continue
+		}
+
+		records, err := readChatRecords(chatPath)
+		if err != nil {
+			slog.Error("Reading chat file", "file", chatPath, "err", err)
+			continue
+		}
+
+		kept := records[:0]
+		for _, record := range records {
+			if record.Expires.IsZero() || record.Expires.After(now) {
+				kept = append(kept, record)
+			}
+		}
+
+		if len(kept) < len(records) {
+			err = writeChatRecords(chatPath, kept)
+			if err != nil {
+				slog.Error("Purging expired messages from chat file", "file", chatPath, "err", err)
+				continue
+			}
+			slog.Info("Purged expired messages from chat file", "file", chatPath, "count", len(records) - len(kept))
+		}
+		s.chatIndexes[chatPath] = newChatIndex(kept)
+
+	}
+
+	for queuePath, queue := range s.queues {
+
+		if queue.nextExpiry.IsZero() || queue.nextExpiry.After(now) {
+			continue
+		}
+
+		left, err := purgeExpiredQueue(queuePath, now)
+		if err != nil {
+			slog.Error("Purging expired messages from queue", "file", queuePath, "err", err)
+			continue
+		}
+		if left.packets == 0 {
+			delete(s.queues, queuePath)
+		} else {
+			s.queues[queuePath] = left
+		}
+
+	}
+
+}
+
+// purgeExpiredQueue removes every expired chat message from the given
+// queue file. The queue file is removed if nothing is left in it.
+// Returns the state of what is left in the queue.
+//
+// Parameters:
+//	queuePath - the queue file of a device
+//	now - the current time
+func purgeExpiredQueue(queuePath string, now time.Time) (*QueueState, error) {
+
+	content, err := os.ReadFile(queuePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []string
+	left   := &QueueState{}
+	purged := 0
+	for _, line := range strings.Split(string(content), "\n") {
+
+		if line == "" {
+			continue
+		}
+
+		var packet Packet
+		if err := json.Unmarshal([]byte(line), &packet); err == nil && packetExpired(packet, now) {
+			purged++
+			continue
+		}
+		kept = append(kept, line)
+		left.add(packet)
+
+	}
+
+	if purged == 0 {
+		return left, nil
+	}
+	slog.Info("Purged expired messages from queue", "file", queuePath, "count", purged)
+
+	if len(kept) == 0 {
+		return left, os.Remove(queuePath)
+	}
+	return left, writeFileAtomic(queuePath, []byte(strings.Join(kept, "\n") + "\n"))
+
+}
+
+// packetExpired returns true if the given packet is a chat message which
+// has disappeared at the given time.
+//
+// Parameters:
+//	packet - a packet sent or queued for a device
+//	now - the current time
+func packetExpired(packet Packet, now time.Time) bool {
+
+	expires := packetExpiry(packet)
+	return !expires.IsZero() && !expires.After(now)
+
+}
+
+// packetExpiry returns when the given packet disappears, zero if it is no
+// chat message or does not disappear.
+//
+// Parameters:
+//	packet - a packet sent or queued for a device
+func packetExpiry(packet Packet) time.Time {
+
+	if packet.MsgType != "CHAT" {
+		return time.Time{}
+	}
+
+	var delivery ChatDelivery
+	if err := json.Unmarshal([]byte(packet.Payload), &delivery); err != nil {
+		return time.Time{}
+	}
+	return delivery.Expires
+
+}
@@ -1,16 +1,21 @@
 package main
 
 import (
-	"bufio"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"net"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 type CommandPreprocesser func(c *Client, payload string) (string, error)
@@ -24,19 +29,78 @@ var commandRequirementFunctions = map[string]CommandPreprocesser {
 	"/newChat": 	preprocessNewChat,
 	"/accept": 		preprocessAccept,
 	"/decline": 	preprocessDecline,
+	"/chat": 		preprocessChat,
+	"/exit": 		preprocessExit,
+	"/devices": 	preprocessDevices,
+	"/linkDevice": 	preprocessLinkDevice,
+	"/unlinkDevice":preprocessUnlinkDevice,
+	"/verify": 		preprocessVerify,
+	"/send": 		preprocessSend,
+	"/passwd": 		preprocessPasswd,
+	"/deleteAccount":preprocessDeleteAccount,
+	"/rename": 		preprocessRename,
+	"/contacts": 	preprocessContacts,
+	"/addContact": 	preprocessAddContact,
+	"/removeContact":preprocessRemoveContact,
+	"/online": 		preprocessOnline,
+	"/presence": 	preprocessPresence,
+	"/block": 		preprocessBlock,
+	"/unblock": 	preprocessUnblock,
+	"/search": 		preprocessSearch,
+	"/timer": 		preprocessTimer,
+	"/edit": 		preprocessEdit,
+	"/delete": 		preprocessDelete,
+	"/reply": 		preprocessReply,
+	"/kick": 		preprocessKick,
+	"/ban": 		preprocessBan,
+	"/unban": 		preprocessUnban,
+	"/broadcast": 	preprocessBroadcast,
+	"/stats": 		preprocessStats,
+	"/users": 		preprocessUsers,
 }
 
 type Client struct {
 	serverAddr string
 	quitCh 	   chan bool
+	conn 	   net.Conn
+	connMu 	   sync.Mutex 					// Serializes writing packets to conn
+	mu 		   sync.Mutex
+	username   string 						// The user this client logs in as
+	device 	   *Device 						// The identity of this device for username
+	activeChat string 						// The user whose chat is open in chat mode
+	deviceKeys map[string]map[string]string // Maps from username to the public keys of the users devices by device ID
+	ratchets   *RatchetStore 				// The ratchet sessions of this device with all other devices
+	verified   map[string][]string 			// Maps from verified contact to the device keys which were verified
+	verifying  string 						// The contact whose safety number is shown once the device keys arrive
+	inputCh    chan string 					// Lines typed by the user
+	pwdPolicy  PasswordPolicy 				// The password policy of the server
+	sent 	   map[string]*SentMessage 		// Maps from message ID to the sent messages which have not been read yet
+	unread 	   map[string][]string 			// Maps from username to the IDs of the messages received from the user which have not been read yet
+	typingSentAt time.Time 					// When the last "typing" signal was sent, zero if the user is not typing
+	view 	   ClientView 					// Shows the output and reads the input of the user
+	history    *History 					// The chat history of the user, nil until the login is confirmed
+	pendingPwd string 						// The password of the last login or password change until the server confirms it
+	timers 	   map[string]time.Duration 	// Maps from chat partner to the disappearing message timer of the chat
+	messages   map[string]*ChatMessage 		// Maps from message ID to the chat messages which can be edited, deleted or replied to
+	tlsConfig  *tls.Config 					// Connects to the server with TLS if set
 }
 
-func NewClient(serverAddr string) *Client {
+func NewClient(serverAddr string, headless bool) *Client {
 	
-	return &Client{
+	c := &Client{
 		serverAddr: serverAddr,
 		quitCh:     make(chan bool),
+		deviceKeys: make(map[string]map[string]string),
+		verified: 	make(map[string][]string),
+		inputCh: 	make(chan string),
+		pwdPolicy:  PasswordPolicy{MinLength: defaultMinPasswordLength, MinClasses: defaultMinPasswordClasses},
+		sent: 		make(map[string]*SentMessage),
+		unread: 	make(map[string][]string),
+		timers: 	make(map[string]time.Duration),
+		messages: 	make(map[string]*ChatMessage),
 	}
+	c.view = newClientView(c, headless)
+	return c
 
 }
 
@@ -46,10 +110,18 @@ func NewClient(serverAddr string) *Client {
 // from stdin is sent to the server.
 func (c *Client) connectToServer() {
 
-	fmt.Println("[Log] Dialing server...")
-	conn, err := net.Dial("tcp", c.serverAddr)
+	defer c.view.Close()
+
+	c.view.Println("[Log] Dialing server...")
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.Dial("tcp", c.serverAddr, c.tlsConfig)
+	} else {
+		conn, err = net.Dial("tcp", c.serverAddr)
+	}
 	if err != nil {
-		fmt.Println("[Error] Dialing server at", c.serverAddr, ":", err)
+		c.view.Println("[Error] Dialing server at", c.serverAddr, ":", err)
 		return
 	}
 	defer func() {
@@ -60,20 +132,17 @@ func (c *Client) connectToServer() {
 		conn.Close()
 	}()
 
-	fmt.Println("[Log] Connection established.")
+	c.view.Println("[Log] Connection established.")
 
+	c.conn = conn
 	go c.listenToServer(conn)
 
-	inputCh := make(chan string)
-	errCh   := make(chan error)
+	errCh := make(chan error)
 
+	// Password prompts of the command preprocessors read from inputCh as well
 	go func() {
 
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			inputCh <- scanner.Text()
-		}
-		if err := scanner.Err(); err != nil {
+		if err := c.view.ReadInput(c.inputCh); err != nil {
 			errCh <- err
 		}
 
@@ -83,9 +152,9 @@ func (c *Client) connectToServer() {
 
 		select {
 		case <-c.quitCh:
-			fmt.Println("[Log] Stopping client due to server disconnection.")
+			c.view.Println("[Log] Stopping client due to server disconnection.")
 			return
-		case input := <- inputCh:
+		case input := <- c.inputCh:
 			
 			var packet = Packet{
 				MsgType: "MESSAGE",
@@ -96,47 +165,47 @@ func (c *Client) connectToServer() {
 				command := strings.Fields(input)[0]
 				preproFunc, ok := commandRequirementFunctions[command]
 				if !ok {
-					fmt.Printf("[Error] Command is not valid: %s\n", command)
+					c.view.Printf("[Error] Command is not valid: %s\n", command)
 					continue
 				}
 
 				preprocessedCommand, err := preproFunc(c, input)
 				if err != nil {
-					fmt.Println("[Error] Wrong use of command:", err)
+					c.view.Println("[Error] Wrong use of command:", err)
+					continue
+				}
+
+				// Commands which are handled locally send nothing
+				if preprocessedCommand == "" {
 					continue
 				}
 
 				input = preprocessedCommand
 				packet.MsgType = "COMMAND"
 
-			}
+			} else {
 
-			packet.Payload = input
+				envelope, err := c.encryptChatMessage(input, "")
+				if err != nil {
+					c.view.Println("[Error] Message not sent:", err)
+					continue
+				}
+				input = envelope
 
-			jsonData, errJ := json.Marshal(packet)
-			if errJ != nil {
-				fmt.Println("[Error] Marshalling data failed:", errJ)
-				return
 			}
 
-			length := uint32(len(jsonData))
-
-			errLen := binary.Write(conn, binary.BigEndian, length)
-			if errLen != nil {
-				fmt.Println("[Error] Sending message length failed:", errLen)
-				return
-			}
+			packet.Payload = input
 
-			_, err := conn.Write(jsonData)
+			err := c.sendPacket(packet)
 			if err != nil {
-				fmt.Println("[Error] Writing to server:", err)
+				c.view.Println("[Error] Writing to server:", err)
 				return
 			}
 		case err := <- errCh:
 			if err != io.EOF {
-				fmt.Println("[Error] Reading input from stdin:", err)
+				c.view.Println("[Error] Reading input from stdin:", err)
 			} else {
-				fmt.Println("[Error] Input ended (EOF)")
+				c.view.Println("[Error] Input ended (EOF)")
 			}
 			return
 		}
@@ -145,13 +214,28 @@ func (c *Client) connectToServer() {
 
 }
 
+// sendPacket writes the given packet to the server. Packets may be sent
+// from several goroutines, e.g. while a file is transferred, so writing
+// is serialized.
+//
+// Parameters:
+//	packet - the packet to send
+func (c *Client) sendPacket(packet Packet) error {
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	return writePacket(c.conn, packet)
+
+}
+
 func (c *Client) listenToServer(conn net.Conn) {
 
 	for {
 
 		select {
 		case <- c.quitCh:
-			fmt.Printf("[Log] No longer listening to server.")
+			c.view.Printf("[Log] No longer listening to server.")
 			return
 		default:
 
@@ -159,11 +243,11 @@ func (c *Client) listenToServer(conn net.Conn) {
 			errLen := binary.Read(conn, binary.BigEndian, &length)
 			if errLen != nil {
 				if errLen == io.EOF || errLen == io.ErrUnexpectedEOF {
-					fmt.Println("[Log] Server closed connection.")
+					c.view.Println("[Log] Server closed connection.")
 					close(c.quitCh)
 					return
 				}
-				fmt.Println("[Error] Reading length from server:", errLen)
+				c.view.Println("[Error] Reading length from server:", errLen)
 				close(c.quitCh)
 				return
 			}
@@ -172,26 +256,609 @@ func (c *Client) listenToServer(conn net.Conn) {
 			_, err := io.ReadFull(conn, data)
 			if err != nil {
 				if err == io.EOF {
-					fmt.Println("[Log] Server closed connection.")
+					c.view.Println("[Log] Server closed connection.")
 					close(c.quitCh)
 					return
 				}
-				fmt.Println("[Error] Reading from server:", err)
+				c.view.Println("[Error] Reading from server:", err)
 				return
 			}
 
 			var packet Packet
 			errUm := json.Unmarshal(data, &packet)
 			if errUm != nil {
-				fmt.Println("[Error] Unmarshalling server data failed:", errUm)
+				c.view.Println("[Error] Unmarshalling server data failed:", errUm)
 				return
 			}
 
-			fmt.Printf("Received data from server.\nType: %s\nPayload:%s\n", packet.MsgType, string(packet.Payload))
+			switch packet.MsgType {
+			case "DEVICES":
+				c.storeDeviceList(packet.Payload)
+			case "CHAT":
+				c.printChatMessage(packet.Payload)
+			case "FILE":
+				c.receiveFileChunk(packet.Payload)
+			case "RENAMED":
+				c.applyRename(packet.Payload)
+			case "POLICY":
+				c.storePasswordPolicy(packet.Payload)
+			case "PRESENCE":
+				c.printPresence(packet.Payload)
+			case "RECEIPT":
+				c.printReceipt(packet.Payload)
+			case "SIGNAL":
+				c.showSignal(packet.Payload)
+			case "AUTH":
+				c.confirmPassword(packet.Payload)
+			case "TIMER":
+				c.applyChatTimer(packet.Payload)
+			case "ERROR":
+				c.printChatError(packet.Payload)
+			default:
+				c.view.ServerMessage(packet.MsgType, packet.Payload)
+			}
+		}
+
+	}
+
+}
+
+// encryptChatMessage encrypts the given text for the user whose chat is
+// currently open. The message is given a new ID and remembered until it
+// has been read, so its receipts can be shown. It is added to the chat
+// history as well and disappears once the timer of the chat has run out.
+// Returns the json encoded ChatEnvelope to send to the server.
+//
+// Parameters:
+//	text - the chat message to encrypt
+//	ref - the ID of the message this one replies to, empty if it is no reply
+func (c *Client) encryptChatMessage(text string, ref string) (string, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.activeChat == "" {
+		return "", errors.New("you are not in chat mode. Use '/chat <username>' to enter it.")
+	}
+
+	id, err := newMessageID()
+	if err != nil {
+		return "", err
+	}
+
+	envelope, err := c.encryptForChatLocked(ChatEnvelope{ID: id, To: c.activeChat, Ref: ref}, []byte(text))
+	if err != nil {
+		return "", err
+	}
+
+	c.sent[id] = &SentMessage{partner: c.activeChat, text: text, state: MESSAGE_SENT}
+	c.rememberMessageLocked(id, c.activeChat, c.username, text)
+
+	// The server sets the same expiry for the copies of the message
+	now := time.Now()
+	var expires time.Time
+	if timer := c.timers[c.activeChat]; timer > 0 {
+		expires = now.Add(timer)
+	}
+	c.recordHistoryLocked(HistoryEntry{ID: id, Chat: c.activeChat, From: c.username, Time: now, Text: text, Expires: expires})
+	c.scheduleDisappearLocked(id, expires)
+
+	// The message itself tells the partner that the user stopped typing
+	c.typingSentAt = time.Time{}
+
+	return envelope, nil
+
+}
+
+// encryptForChatLocked encrypts the given plaintext for every device of
+// the recipient of the envelope and for every other device of the user
+// this client is logged in as. Each message is encrypted with a fresh key
+// of the ratchet session with the respective device.
+// Returns the json encoded ChatEnvelope to send to the server.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	envelope - the envelope to fill with the ciphertexts, its recipient is the user to encrypt the plaintext for
+//	plaintext - the content to encrypt
+func (c *Client) encryptForChatLocked(envelope ChatEnvelope, plaintext []byte) (string, error) {
+
+	partner := envelope.To
+	if _, ok := c.deviceKeys[partner]; !ok {
+		return "", errors.New("the devices of " + partner + " are not known yet. Please try again in a moment.")
+	}
+	envelope.Chat 		 = chatID(c.username, partner)
+	envelope.Ciphertexts = make(map[string]string)
+
+	for _, user := range []string{partner, c.username} {
+		for deviceID, key := range c.deviceKeys[user] {
+
+			if deviceID == c.device.id {
+				continue
+			}
+
+			// Every device pair has its own ratchet session
+			ciphertext, err := c.ratchets.encrypt(c.device, user + "/" + deviceID, key, plaintext)
+			if err != nil {
+				return "", err
+			}
+			envelope.Ciphertexts[deviceID] = ciphertext
+
+		}
+	}
+
+	jsonData, err := json.Marshal(envelope)
+	if err != nil {
+		return "", err
+	}
+	return string(jsonData), nil
+
+}
+
+// storeDeviceList remembers the public keys of the devices sent by the
+// server in a "DEVICES" packet.
+//
+// Parameters:
+//	payload - the json encoded DeviceList
+func (c *Client) storeDeviceList(payload string) {
+
+	var deviceList DeviceList
+	err := json.Unmarshal([]byte(payload), &deviceList)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling device list failed:", err)
+		return
+	}
+
+	keys := make(map[string]string)
+	for _, device := range deviceList.Devices {
+		keys[device.ID] = device.Key
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deviceKeys[deviceList.Username] = keys
+
+	// Adopt the name the server knows the user by, e.g. 'alice' for '/chat Alice'
+	if c.activeChat != deviceList.Username && canonicalUsername(c.activeChat) == canonicalUsername(deviceList.Username) {
+		c.activeChat = deviceList.Username
+		c.view.SetStatus(c.username, c.activeChat)
+	}
+	if c.verifying != deviceList.Username && canonicalUsername(c.verifying) == canonicalUsername(deviceList.Username) {
+		c.verifying = deviceList.Username
+	}
+
+	c.view.Printf("Devices of %s:\n", deviceList.Username)
+	for _, device := range deviceList.Devices {
+		c.view.Printf("- %s\n", device.ID)
+	}
+
+	c.warnIfKeysChangedLocked(deviceList.Username, slices.Collect(maps.Values(keys)))
+
+	// The own device list is requested last when verifying a contact
+	if c.verifying != "" && deviceList.Username == c.username {
+		c.printSafetyNumberLocked(c.verifying)
+		c.verifying = ""
+	}
+
+}
+
+// printChatMessage decrypts a chat message sent by the server in a "CHAT"
+// packet and prints it. The message is remembered as unread until the
+// chat with its sender is opened and is added to the chat history. If the
+// chat has a timer, the message disappears once it has run out. Edits and
+// deletions change the message they refer to instead.
+//
+// Parameters:
+//	payload - the json encoded ChatDelivery
+func (c *Client) printChatMessage(payload string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delivery, plaintext, err := c.openDeliveryLocked(payload)
+	if err != nil {
+		c.view.Println("[Error] Reading chat message failed:", err)
+		return
+	}
+
+	// The message was decrypted anyway to keep the ratchet session in step
+	if !delivery.Expires.IsZero() && !delivery.Expires.After(time.Now()) {
+		return
+	}
+
+	partner := c.chatPartnerOf(delivery)
+	text 	:= string(plaintext)
+
+	switch delivery.Action {
+	case CHAT_ACTION_EDIT:
+		c.applyEditLocked(partner, delivery.Ref, delivery.From, text)
+		return
+	case CHAT_ACTION_DELETE:
+		c.applyDeleteLocked(partner, delivery.Ref, delivery.From)
+		return
+	}
+
+	c.view.ChatLine(partner, "%s", chatMessageLine(delivery.ID, delivery.From, text) + c.replySuffixLocked(delivery.Ref))
+	c.markReceivedLocked(delivery)
+	c.rememberMessageLocked(delivery.ID, partner, delivery.From, text)
+	c.recordHistoryLocked(HistoryEntry{ID: delivery.ID, Chat: partner, From: delivery.From, Time: time.Now(), Text: text, Expires: delivery.Expires})
+	c.scheduleDisappearLocked(delivery.ID, delivery.Expires)
+
+}
+
+// openDeliveryLocked decrypts the ciphertext of a ChatDelivery sent by the
+// server using the ratchet session with the sending device. A warning is
+// printed if the sender is a verified contact whose key has changed.
+// Returns the delivery along with the decrypted plaintext.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	payload - the json encoded ChatDelivery
+func (c *Client) openDeliveryLocked(payload string) (ChatDelivery, []byte, error) {
+
+	var delivery ChatDelivery
+	err := json.Unmarshal([]byte(payload), &delivery)
+	if err != nil {
+		return delivery, nil, err
+	}
+
+	if c.device == nil {
+		return delivery, nil, errors.New("received a message without being logged in")
+	}
+
+	if delivery.From != c.username {
+		c.warnIfKeysChangedLocked(delivery.From, []string{delivery.FromKey})
+	}
+
+	peer := delivery.From + "/" + delivery.FromDevice
+	plaintext, err := c.ratchets.decrypt(c.device, peer, delivery.FromKey, delivery.Ciphertext)
+	if err != nil {
+		return delivery, nil, fmt.Errorf("decrypting message from %s: %w", delivery.From, err)
+	}
+
+	return delivery, plaintext, nil
+
+}
+
+// chatPartnerOf returns the user the chat of the given delivery is with.
+// Messages sent from another device of the own user belong to the chat
+// with their recipient.
+func (c *Client) chatPartnerOf(delivery ChatDelivery) string {
+
+	if delivery.From == c.username {
+		return delivery.To
+	}
+	return delivery.From
+
+}
+
+// useDevice loads the identity of this device, its ratchet sessions and
+// the verified contacts for the given user and remembers them together
+// with the user for encrypting and decrypting chat messages.
+//
+// Parameters:
+//	username - the user to load the device identity for
+func (c *Client) useDevice(username string) (*Device, error) {
+
+	device, err := loadOrCreateDevice(username)
+	if err != nil {
+		return nil, errors.New("loading the identity of this device failed: " + err.Error())
+	}
+
+	ratchets, err := loadRatchetStore(username)
+	if err != nil {
+		return nil, errors.New("loading the ratchet sessions failed: " + err.Error())
+	}
+
+	verified, err := loadVerifiedContacts(username)
+	if err != nil {
+		return nil, errors.New("loading the verified contacts failed: " + err.Error())
+	}
+
+	c.mu.Lock()
+	c.username   = username
+	c.device 	 = device
+	c.ratchets 	 = ratchets
+	c.activeChat = ""
+	c.verified 	 = verified
+	c.sent 		 = make(map[string]*SentMessage)
+	c.unread 	 = make(map[string][]string)
+	c.history 	 = nil
+	c.timers 	 = make(map[string]time.Duration)
+	c.messages 	 = make(map[string]*ChatMessage)
+	c.view.SetStatus(c.username, c.activeChat)
+	c.mu.Unlock()
+
+	return device, nil
+
+}
+
+// storePasswordPolicy remembers the password policy the server sent in a
+// "POLICY" packet after the connection was established.
+//
+// Parameters:
+//	payload - the json encoded PasswordPolicy
+func (c *Client) storePasswordPolicy(payload string) {
+
+	var policy PasswordPolicy
+	err := json.Unmarshal([]byte(payload), &policy)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling password policy failed:", err)
+		return
+	}
+
+	c.mu.Lock()
+	c.pwdPolicy = policy
+	c.mu.Unlock()
+
+}
+
+// printPresence tells the user that one of their contacts logged in or
+// out, as announced by the server in a "PRESENCE" packet.
+//
+// Parameters:
+//	payload - the json encoded Presence
+func (c *Client) printPresence(payload string) {
+
+	var presence Presence
+	err := json.Unmarshal([]byte(payload), &presence)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling presence failed:", err)
+		return
+	}
+
+	if presence.Online {
+		c.view.Printf("%s is now online.\n", presence.Username)
+	} else {
+		c.view.Printf("%s is now offline.\n", presence.Username)
+	}
+
+}
+
+// applyRename handles a "RENAMED" packet sent by the server after a user
+// changed their name. If the user this client is logged in as was
+// renamed, the data directory of the user is moved to the new name.
+// Sessions, device keys and the verification state of the user move to
+// the new name as well.
+//
+// Parameters:
+//	payload - the json encoded AccountRename
+func (c *Client) applyRename(payload string) {
+
+	var rename AccountRename
+	err := json.Unmarshal([]byte(payload), &rename)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling rename notification failed:", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ratchets == nil {
+		return
+	}
+
+	// Old accounts may be stored under their canonical name on this machine
+	if rename.Old == c.username || canonicalUsername(rename.Old) == c.username {
+
+		// Another client of the same user on this machine may have moved the directory already
+		oldDir := clientDataDir + c.username
+		newDir := clientDataDir + rename.New
+		if fileExists(oldDir) && !fileExists(newDir) {
+			err := os.Rename(oldDir, newDir)
+			if err != nil {
+				c.view.Println("[Error] Moving data directory to the new username:", err)
+			}
+		}
+
+		c.username 		= rename.New
+		c.ratchets.path = newDir + "/sessions"
+		if c.history != nil {
+			c.history.dir = newDir + "/"
+		}
+		c.view.Printf("You are now called %s.\n", rename.New)
+
+	} else {
+		c.view.Printf("%s is now called %s.\n", rename.Old, rename.New)
+	}
+
+	err = c.ratchets.renameUser(rename.Old, rename.New)
+	if err != nil {
+		c.view.Println("[Error] Saving renamed sessions:", err)
+	}
+
+	if keys, ok := c.deviceKeys[rename.Old]; ok {
+		c.deviceKeys[rename.New] = keys
+		delete(c.deviceKeys, rename.Old)
+	}
+
+	if keys, ok := c.verified[rename.Old]; ok {
+		c.verified[rename.New] = keys
+		delete(c.verified, rename.Old)
+		err := saveVerifiedContacts(c.username, c.verified)
+		if err != nil {
+			c.view.Println("[Error] Saving renamed verified contacts:", err)
+		}
+	}
+
+	if c.activeChat == rename.Old {
+		c.activeChat = rename.New
+	}
+	c.view.SetStatus(c.username, c.activeChat)
+
+	if ids, ok := c.unread[rename.Old]; ok {
+		c.unread[rename.New] = ids
+		delete(c.unread, rename.Old)
+	}
+	if timer, ok := c.timers[rename.Old]; ok {
+		c.timers[rename.New] = timer
+		delete(c.timers, rename.Old)
+	}
+	for _, message := range c.sent {
+		if message.partner == rename.Old {
+			message.partner = rename.New
+		}
+	}
+	for _, message := range c.messages {
+		if message.partner == rename.Old {
+			message.partner = rename.New
+		}
+		if message.from == rename.Old {
+			message.from = rename.New
+		}
+	}
+
+	if c.history != nil {
+		err := c.history.renameUser(rename.Old, rename.New)
+		if err != nil {
+			c.view.Println("[Error] Saving renamed chat history:", err)
+		}
+	}
+
+}
+
+// localUsername returns the name the data of the given user is stored
+// under on this machine. Accounts registered before the username policy
+// existed are stored under their exact name, every other account under
+// its canonical name.
+//
+// Parameters:
+//	username - the username as typed by the user
+func localUsername(username string) string {
+
+	if fileExists(clientDataDir + username) {
+		return username
+	}
+	return canonicalUsername(username)
+
+}
+
+// hashPassword returns the hex encoded SHA-256 hash of the given password
+// the way it is sent to the server.
+func hashPassword(pwd string) string {
+
+	hash := sha256.Sum256([]byte(pwd))
+	return hex.EncodeToString(hash[:])
+
+}
+
+// loadVerifiedContacts reads the contacts the given user has verified
+// from the clients data directory. Every line of the file is of the
+// pattern '<username>:<key>,<key>,...' holding the device keys which
+// were verified for that contact.
+//
+// Parameters:
+//	username - the user whose verified contacts are loaded
+func loadVerifiedContacts(username string) (map[string][]string, error) {
+
+	verified     := make(map[string][]string)
+	verifiedPath := clientDataDir + username + "/verified"
+	if !fileExists(verifiedPath) {
+		return verified, nil
+	}
+
+	content, err := os.ReadFile(verifiedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		entry := strings.Split(line, ":")
+		if len(entry) != 2 {
+			fmt.Printf("[Warning] Invalid entry in verified contacts: %s\n", line)
+			continue
 		}
+		verified[entry[0]] = strings.Split(entry[1], ",")
+
+	}
+
+	return verified, nil
+
+}
+
+// saveVerifiedContacts writes the verified contacts of the given user
+// into the clients data directory.
+//
+// Parameters:
+//	username - the user whose verified contacts are saved
+//	verified - maps from contact to the verified keys of the contact
+func saveVerifiedContacts(username string, verified map[string][]string) error {
+
+	var builder strings.Builder
+	for contact, keys := range verified {
+		builder.WriteString(contact + ":" + strings.Join(keys, ",") + "\n")
+	}
+
+	verifiedPath := clientDataDir + username + "/verified"
+	tempPath 	 := verifiedPath + ".tmp"
+	err := os.WriteFile(tempPath, []byte(builder.String()), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, verifiedPath)
+
+}
+
+// warnIfKeysChangedLocked compares the given device keys of a contact with
+// the keys which were verified for that contact. If the contact is verified
+// and any of the keys is not one of the verified ones, a loud warning is
+// printed. The keys may be any part of the devices of the contact, e.g. the
+// key of the one device a message came from, so missing keys are no
+// reason for a warning.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	contact - the contact the keys belong to
+//	keys - the device keys of the contact as sent by the server
+func (c *Client) warnIfKeysChangedLocked(contact string, keys []string) {
+
+	verifiedKeys, isVerified := c.verified[contact]
+	if !isVerified {
+		return
+	}
+
+	changed := slices.ContainsFunc(keys, func(key string) bool {
+		return !slices.Contains(verifiedKeys, key)
+	})
+	if !changed {
+		return
+	}
+
+	c.view.Println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+	c.view.Printf("[Warning] THE KEYS OF YOUR VERIFIED CONTACT %s HAVE CHANGED!\n", contact)
+	c.view.Println("Either a device was added, or someone is trying to intercept")
+	c.view.Printf("your messages. Compare your safety number again using '/verify %s'.\n", contact)
+	c.view.Println("!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!")
+
+}
 
+// printSafetyNumberLocked prints the safety number of the user this client
+// is logged in as and the given contact, based on the device keys which
+// were last received from the server.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	contact - the contact to print the safety number with
+func (c *Client) printSafetyNumberLocked(contact string) {
+
+	ownKeys     := slices.Collect(maps.Values(c.deviceKeys[c.username]))
+	contactKeys := slices.Collect(maps.Values(c.deviceKeys[contact]))
+	if len(contactKeys) == 0 {
+		c.view.Printf("[Error] No devices of %s are known. The safety number can not be shown.\n", contact)
+		return
 	}
 
+	c.view.Printf("Safety number of you and %s:\n", contact)
+	c.view.Println(safetyNumber(c.username, ownKeys, contact, contactKeys))
+	c.view.Printf("Compare it with the one shown to %s. If both are equal, use '/verify %s confirm' to mark %s as verified.\n", contact, contact, contact)
+
 }
 
 // -----------------------------
@@ -209,25 +876,35 @@ func preprocessQuit(c *Client, payload string) (string, error) {
 
 func preprocessRegister(c *Client, payload string) (string, error) {
 
-	// TODO: Add character check. Only alphabetic characters for username permitted.
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) == 3 {
+		return "", errors.New("passwords are not accepted in the command line, so they do not end up in the scrollback of your terminal. Please use '/register <username>' and enter the password when asked for it.")
+	}
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/register' command was given the wrong number of arguments. Please provide a username according to the following pattern: '/register <username>'. You will be asked for a password afterwards.")
+	}
+	command := slicedPld[0]
 
-	if len(strings.Fields(payload)) != 3 {
-		return "", errors.New("'/register' command was given the wrong number of arguments. Please provide username and password according to the following pattern: '/register <username> <password>'.")
+	// The server enforces the username policy as well, checking it here saves a round trip
+	username, err := normalizeUsername(slicedPld[1])
+	if err != nil {
+		return "", err
+	}
+	if username != slicedPld[1] {
+		c.view.Printf("Registering as '%s'.\n", username)
 	}
 
-	slicedPld := strings.Fields(payload)
-	command   := slicedPld[0]
-	username  := slicedPld[1]
-	pwd   	  := []byte(slicedPld[2])
+	pwd, err := c.readNewPassword(username)
+	if err != nil {
+		return "", err
+	}
 
-	hash := sha256.New()
-	_, err := hash.Write(pwd)
+	device, err := c.useDevice(username)
 	if err != nil {
 		return "", err
 	}
-	pwdHsh := hash.Sum(nil)
 
-	res := command + " " + username + " " + string(pwdHsh)
+	res := command + " " + username + " " + hashPassword(pwd) + " " + device.id + " " + device.publicKey()
 
 	return res, nil
 
@@ -244,23 +921,32 @@ func preprocessHelp(c *Client, payload string) (string, error) {
 
 func preprocessLogin(c *Client, payload string) (string, error) {
 
-	if len(strings.Fields(string(payload))) != 3 {
-		return "", errors.New("'/login' command was given the wrong number of arguments. Please provide username and password according to the following pattern: '/login <username> <password>'.")
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) == 3 {
+		return "", errors.New("passwords are not accepted in the command line, so they do not end up in the scrollback of your terminal. Please use '/login <username>' and enter the password when asked for it.")
+	}
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/login' command was given the wrong number of arguments. Please provide a username according to the following pattern: '/login <username>'. You will be asked for the password afterwards.")
 	}
+	command  := slicedPld[0]
+	username := localUsername(slicedPld[1])
 
-	slicedPld := strings.Fields(payload)
-	command   := slicedPld[0]
-	username  := slicedPld[1]
-	pwd   	  := []byte(slicedPld[2])
+	pwd, err := c.readPassword("Password: ")
+	if err != nil {
+		return "", err
+	}
 
-	hash := sha256.New()
-	_, err := hash.Write(pwd)
+	device, err := c.useDevice(username)
 	if err != nil {
 		return "", err
 	}
-	pwdHsh := hash.Sum(nil)
 
-	res := command + " " + username + " " + string(pwdHsh)
+	// The chat history is opened with the password once the server accepts it
+	c.mu.Lock()
+	c.pendingPwd = pwd
+	c.mu.Unlock()
+
+	res := command + " " + username + " " + hashPassword(pwd) + " " + device.id + " " + device.publicKey()
 
 	return res, nil
 
@@ -271,6 +957,12 @@ func preprocessLogout(c *Client, payload string) (string, error) {
 	if len(strings.Fields(string(payload))) != 1 {
 		return "", errors.New("'/logout' command was given the wrong number of arguments. Plese just use '/logout' without any further arguments in order to log out of the user account you're currently logged in as.")
 	}
+
+	// The chat history stays locked until the next login
+	c.mu.Lock()
+	c.history = nil
+	c.mu.Unlock()
+
 	return "/logout", nil
 
 }
@@ -309,3 +1001,475 @@ func preprocessDecline(c *Client, payload string) (string, error) {
 	return "/decline", nil
 
 }
+
+func preprocessChat(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 2 {
+		return "", errors.New("'/chat' command was given the wrong number of arguments. Plese use '/chat <username>' in order to enter chat mode with <username>.")
+	}
+
+	partner := strings.Fields(payload)[1]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.device == nil {
+		return "", errors.New("you need to log in before entering chat mode.")
+	}
+	c.activeChat = partner
+	c.view.SetStatus(c.username, c.activeChat)
+
+	c.view.Printf("Entered chat mode with %s. Use '/exit' to leave it.\n", partner)
+	c.sendReadReceiptsLocked(partner)
+
+	// The device keys of both chat participants are needed to encrypt messages
+	return "/devices " + partner + " " + c.username, nil
+
+}
+
+func preprocessExit(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 1 {
+		return "", errors.New("'/exit' command was given the wrong number of arguments. Plese just use '/exit' without any further arguments in order to leave chat mode.")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.activeChat == "" {
+		return "", errors.New("you are not in chat mode.")
+	}
+
+	c.view.Printf("Left chat mode with %s.\n", c.activeChat)
+	c.activeChat = ""
+	c.view.SetStatus(c.username, c.activeChat)
+
+	return "", nil
+
+}
+
+func preprocessDevices(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) > 2 {
+		return "", errors.New("'/devices' command was given the wrong number of arguments. Plese use '/devices [username]' in order to list the devices of <username> or your own ones.")
+	}
+
+	if len(slicedPld) == 2 {
+		return "/devices " + slicedPld[1], nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.username == "" {
+		return "", errors.New("you need to log in before listing your own devices.")
+	}
+	return "/devices " + c.username, nil
+
+}
+
+func preprocessLinkDevice(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 2 {
+		return "", errors.New("'/linkDevice' command was given the wrong number of arguments. Plese use '/linkDevice <code>' with the code shown on the device you want to link.")
+	}
+	return "/linkDevice " + strings.Fields(payload)[1], nil
+
+}
+
+func preprocessUnlinkDevice(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 2 {
+		return "", errors.New("'/unlinkDevice' command was given the wrong number of arguments. Plese use '/unlinkDevice <deviceID>' in order to remove one of your devices.")
+	}
+	return "/unlinkDevice " + strings.Fields(payload)[1], nil
+
+}
+
+func preprocessVerify(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 && (len(slicedPld) != 3 || slicedPld[2] != "confirm") {
+		return "", errors.New("'/verify' command was given the wrong number of arguments. Plese use '/verify <username>' to show your safety number with <username> and '/verify <username> confirm' to mark <username> as verified afterwards.")
+	}
+	contact := slicedPld[1]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.device == nil {
+		return "", errors.New("you need to log in before verifying contacts.")
+	}
+	if contact == c.username {
+		return "", errors.New("you can not verify yourself.")
+	}
+
+	// Show the safety number once the current device keys are received
+	if len(slicedPld) == 2 {
+		c.verifying = contact
+		return "/devices " + contact + " " + c.username, nil
+	}
+
+	keys, ok := c.deviceKeys[contact]
+	if !ok {
+		return "", errors.New("the devices of " + contact + " are not known yet. Use '/verify " + contact + "' and compare the safety number first.")
+	}
+
+	c.verified[contact] = slices.Collect(maps.Values(keys))
+	err := saveVerifiedContacts(c.username, c.verified)
+	if err != nil {
+		return "", errors.New("saving the verified contacts failed: " + err.Error())
+	}
+
+	c.view.Printf("%s is now verified. You will be warned if the keys of %s change.\n", contact, contact)
+	return "", nil
+
+}
+
+func preprocessSend(c *Client, payload string) (string, error) {
+
+	path := strings.TrimSpace(strings.TrimPrefix(payload, "/send"))
+	if path == "" {
+		return "", errors.New("'/send' command was given the wrong number of arguments. Plese use '/send <path>' in chat mode in order to send the file at <path> to your chat partner.")
+	}
+
+	c.mu.Lock()
+	partner := c.activeChat
+	c.mu.Unlock()
+
+	if partner == "" {
+		return "", errors.New("you are not in chat mode. Use '/chat <username>' to enter it before sending a file.")
+	}
+	if !fileExists(path) {
+		return "", errors.New("there is no file at '" + path + "'.")
+	}
+
+	// The file is sent in the background, so chatting can go on meanwhile
+	go c.sendFile(path, partner)
+
+	return "", nil
+
+}
+
+func preprocessPasswd(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 1 {
+		return "", errors.New("'/passwd' command was given the wrong number of arguments. Plese just use '/passwd' without any further arguments in order to change your password. You will be asked for your current and your new password afterwards.")
+	}
+
+	c.mu.Lock()
+	username := c.username
+	c.mu.Unlock()
+
+	oldPwd, err := c.readPassword("Current password: ")
+	if err != nil {
+		return "", err
+	}
+
+	newPwd, err := c.readNewPassword(username)
+	if err != nil {
+		return "", err
+	}
+
+	// The chat history is protected with the new password once the server changed it
+	c.mu.Lock()
+	c.pendingPwd = newPwd
+	c.mu.Unlock()
+
+	return "/passwd " + hashPassword(oldPwd) + " " + hashPassword(newPwd), nil
+
+}
+
+func preprocessDeleteAccount(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 1 {
+		return "", errors.New("'/deleteAccount' command was given the wrong number of arguments. Plese just use '/deleteAccount' without any further arguments in order to delete your account. You will be asked for your password afterwards.")
+	}
+
+	pwd, err := c.readPassword("Password: ")
+	if err != nil {
+		return "", err
+	}
+
+	return "/deleteAccount " + hashPassword(pwd), nil
+
+}
+
+func preprocessRename(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/rename' command was given the wrong number of arguments. Plese use '/rename <newUsername>' in order to change your username. You will be asked for your password afterwards.")
+	}
+
+	newName, err := normalizeUsername(slicedPld[1])
+	if err != nil {
+		return "", err
+	}
+
+	pwd, err := c.readPassword("Password: ")
+	if err != nil {
+		return "", err
+	}
+
+	return "/rename " + newName + " " + hashPassword(pwd), nil
+
+}
+
+func preprocessContacts(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 1 {
+		return "", errors.New("'/contacts' command was given the wrong number of arguments. Plese just use '/contacts' without any further arguments in order to list your contacts.")
+	}
+	return "/contacts", nil
+
+}
+
+func preprocessAddContact(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/addContact' command was given the wrong number of arguments. Plese use '/addContact <username>' in order to add <username> to your contacts.")
+	}
+	return "/addContact " + slicedPld[1], nil
+
+}
+
+func preprocessRemoveContact(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/removeContact' command was given the wrong number of arguments. Plese use '/removeContact <username>' in order to remove <username> from your contacts.")
+	}
+	return "/removeContact " + slicedPld[1], nil
+
+}
+
+func preprocessOnline(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 1 {
+		return "", errors.New("'/online' command was given the wrong number of arguments. Plese just use '/online' without any further arguments in order to list the users who are online.")
+	}
+	return "/online", nil
+
+}
+
+func preprocessPresence(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 || (slicedPld[1] != "hide" && slicedPld[1] != "show") {
+		return "", errors.New("'/presence' command was given the wrong arguments. Plese use '/presence hide' in order to appear offline or '/presence show' in order to show that you are online.")
+	}
+	return "/presence " + slicedPld[1], nil
+
+}
+
+func preprocessBlock(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/block' command was given the wrong number of arguments. Plese use '/block <username>' in order to drop every chat request and message of <username>.")
+	}
+	return "/block " + slicedPld[1], nil
+
+}
+
+func preprocessUnblock(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/unblock' command was given the wrong number of arguments. Plese use '/unblock <username>' in order to receive chat requests and messages of <username> again.")
+	}
+	return "/unblock " + slicedPld[1], nil
+
+}
+
+func preprocessSearch(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) < 2 {
+		return "", errors.New("'/search' command was given the wrong number of arguments. Plese use '/search <terms>' in order to search the messages of all of your chats for <terms>.")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.history == nil {
+		return "", errors.New("the chat history is only available after logging in.")
+	}
+
+	results := c.history.search(slicedPld[1:])
+	if len(results) == 0 {
+		c.view.Println("No messages found.")
+		return "", nil
+	}
+
+	for _, entry := range results {
+		c.view.Printf("[%s] %s %s: %s\n", entry.Chat, entry.Time.Local().Format("2006-01-02 15:04"), entry.From, entry.Text)
+	}
+	c.view.Println("Use '/chat <username>' to continue one of these chats.")
+
+	return "", nil
+
+}
+
+func preprocessTimer(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/timer' command was given the wrong number of arguments. Plese use '/timer <duration>' in chat mode in order to let new messages disappear after <duration>, e.g. '/timer 1h', or '/timer off' to keep them again.")
+	}
+
+	// The server checks the limits of the timer
+	if slicedPld[1] != "off" {
+		if _, err := time.ParseDuration(slicedPld[1]); err != nil {
+			return "", errors.New("'" + slicedPld[1] + "' is no valid duration. Please use e.g. '30s', '10m' or '12h'.")
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.activeChat == "" {
+		return "", errors.New("you are not in chat mode. Use '/chat <username>' to enter it.")
+	}
+	return "/timer " + c.activeChat + " " + slicedPld[1], nil
+
+}
+
+func preprocessEdit(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) < 3 {
+		return "", errors.New("'/edit' command was given the wrong number of arguments. Plese use '/edit <id> <text>' in chat mode in order to replace the text of your message <id> with <text>.")
+	}
+	text := strings.Join(slicedPld[2:], " ")
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, message, err := c.findMessageLocked(slicedPld[1])
+	if err != nil {
+		return "", err
+	}
+	if message.from != c.username {
+		return "", errors.New("you can only edit your own messages.")
+	}
+
+	if err := c.sendChatActionLocked(CHAT_ACTION_EDIT, id, text); err != nil {
+		return "", err
+	}
+	c.applyEditLocked(message.partner, id, c.username, text)
+
+	return "", nil
+
+}
+
+func preprocessDelete(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/delete' command was given the wrong number of arguments. Plese use '/delete <id>' in chat mode in order to delete your message <id> for everyone in the chat.")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, message, err := c.findMessageLocked(slicedPld[1])
+	if err != nil {
+		return "", err
+	}
+	if message.from != c.username {
+		return "", errors.New("you can only delete your own messages.")
+	}
+
+	if err := c.sendChatActionLocked(CHAT_ACTION_DELETE, id, ""); err != nil {
+		return "", err
+	}
+	c.applyDeleteLocked(message.partner, id, c.username)
+
+	return "", nil
+
+}
+
+func preprocessReply(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) < 3 {
+		return "", errors.New("'/reply' command was given the wrong number of arguments. Plese use '/reply <id> <text>' in chat mode in order to answer message <id> with <text>.")
+	}
+	text := strings.Join(slicedPld[2:], " ")
+
+	c.mu.Lock()
+	id, _, err := c.findMessageLocked(slicedPld[1])
+	c.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	envelope, err := c.encryptChatMessage(text, id)
+	if err != nil {
+		return "", err
+	}
+	return "", c.sendPacket(Packet{MsgType: "MESSAGE", Payload: envelope})
+
+}
+
+func preprocessKick(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/kick' command was given the wrong number of arguments. Plese use '/kick <username>' in order to log <username> out of every session.")
+	}
+	return "/kick " + slicedPld[1], nil
+
+}
+
+func preprocessBan(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/ban' command was given the wrong number of arguments. Plese use '/ban <username>' in order to kick <username> and refuse their logins.")
+	}
+	return "/ban " + slicedPld[1], nil
+
+}
+
+func preprocessUnban(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) != 2 {
+		return "", errors.New("'/unban' command was given the wrong number of arguments. Plese use '/unban <username>' in order to allow <username> to log in again.")
+	}
+	return "/unban " + slicedPld[1], nil
+
+}
+
+func preprocessBroadcast(c *Client, payload string) (string, error) {
+
+	slicedPld := strings.Fields(payload)
+	if len(slicedPld) < 2 {
+		return "", errors.New("'/broadcast' command was given the wrong number of arguments. Plese use '/broadcast <text>' in order to send <text> to every connected client.")
+	}
+	return "/broadcast " + strings.Join(slicedPld[1:], " "), nil
+
+}
+
+func preprocessStats(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 1 {
+		return "", errors.New("'/stats' command was given the wrong number of arguments. Plese just use '/stats' without any further arguments in order to show how busy the server is.")
+	}
+	return "/stats", nil
+
+}
+
+func preprocessUsers(c *Client, payload string) (string, error) {
+
+	if len(strings.Fields(payload)) != 1 {
+		return "", errors.New("'/users' command was given the wrong number of arguments. Plese just use '/users' without any further arguments in order to list every registered user.")
+	}
+	return "/users", nil
+
+}
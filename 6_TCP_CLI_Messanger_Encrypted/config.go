@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+)
+
+// The application is configured by an optional json config file and by
+// command line flags, which override the values of the config file. If
+// neither gives the mode to run in, the interactive setup asks for it.
+//
+// Example config file of a server:
+//
+//	{
+//		"mode": "server",
+//		"listen": ":9000",
+//		"dataDir": "/var/lib/messanger",
+//		"tlsCert": "/etc/messanger/cert.pem",
+//		"tlsKey": "/etc/messanger/key.pem",
+//		"sessionPolicy": "multi",
+//		"passwordPolicy": "10 3",
+//		"chatRequestLimit": "3/20s",
+//		"messageLimit": "20/500ms",
+//		"packetLimit": "100/10ms",
+//		"logLevel": "info",
+//		"logFormat": "json",
+//		"admins": "alice,bob",
+//		"adminSocket": "/run/messanger/admin.sock",
+//		"auditKey": "/etc/messanger/audit.key",
+//		"metricsListen": "127.0.0.1:9100",
+//		"websocketListen": ":8080"
+//	}
+
+// Modes the application can run in.
+const (
+	MODE_SERVER = "server"
+	MODE_CLIENT = "client"
+	MODE_ADMIN 	= "admin" // The admin console of a server running on this machine
+	MODE_VERIFY_AUDIT = "verify-audit" // Checks the audit log of the data directory for tampering
+)
+
+// Config holds the settings of the server or the client. Empty values
+// stand for the defaults.
+type Config struct {
+	Mode 			 string `json:"mode"` 			  // MODE_SERVER or MODE_CLIENT, empty to ask interactively
+	Listen 			 string `json:"listen"` 		  // Server: the address to listen on, e.g. ':9000'
+	Server 			 string `json:"server"` 		  // Client: the address of the server, e.g. 'localhost:9000'
+	DataDir 		 string `json:"dataDir"` 		  // The directory of the server or client data
+	TLSCert 		 string `json:"tlsCert"` 		  // Server: the certificate file, enables TLS together with TLSKey
+	TLSKey 			 string `json:"tlsKey"` 		  // Server: the private key file of the certificate
+	TLS 			 bool 	`json:"tls"` 			  // Client: connect with TLS
+	TLSCA 			 string `json:"tlsCA"` 			  // Client: the certificate of the CA the server certificate is checked against, enables TLS
+	SessionPolicy 	 string `json:"sessionPolicy"` 	  // Server: 'reject', 'takeover' or 'multi'
+	PasswordPolicy 	 string `json:"passwordPolicy"`   // Server: '<minLength> <minClasses>'
+	ChatRequestLimit string `json:"chatRequestLimit"` // Server: '<burst>/<interval>'
+	MessageLimit 	 string `json:"messageLimit"` 	  // Server: '<burst>/<interval>'
+	PacketLimit 	 string `json:"packetLimit"` 	  // Server: '<burst>/<interval>'
+	LogLevel 		 string `json:"logLevel"` 		  // Server: 'debug', 'info', 'warn' or 'error'
+	LogFormat 		 string `json:"logFormat"` 		  // Server: 'text' or 'json'
+	Headless 		 bool 	`json:"headless"` 		  // Client: print line by line even if running in a terminal
+	Admins 			 string `json:"admins"` 		  // Server: the registered users who may use the admin commands, separated by commas
+	AdminSocket 	 string `json:"adminSocket"` 	  // Server and admin console: the unix socket of the admin console
+	AuditKey 		 string `json:"auditKey"` 		  // Server and audit verifier: the key file of the audit log, outside of the data directory
+	MetricsListen 	 string `json:"metricsListen"`  // Server: the address the Prometheus metrics are served on
+	MetricsPublic 	 bool 	`json:"metricsPublic"`  // Server: allow serving the metrics on an address which is not a loopback address
+	WebSocketListen  string `json:"websocketListen"` // Server: the address the browser client and WebSocket connections are served on
+}
+
+// loadConfig reads the config file given with '-config', if any, and
+// applies the command line flags on top of it.
+// Returns flag.ErrHelp if the usage was asked for.
+//
+// Parameters:
+//	args - the command line arguments without the program name
+func loadConfig(args []string) (Config, error) {
+
+	var cfg Config
+	var configPath string
+	flags := newConfigFlagSet(&cfg, &configPath)
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument '%s'", flags.Arg(0))
+	}
+
+	if configPath != "" {
+
+		cfg = Config{}
+		if err := readConfigFile(configPath, &cfg); err != nil {
+			return Config{}, err
+		}
+
+		// Parsing again with the values of the file as defaults lets the
+		// flags which were given override them
+		if err := newConfigFlagSet(&cfg, &configPath).Parse(args); err != nil {
+			return Config{}, err
+		}
+
+	}
+
+	switch strings.ToLower(cfg.Mode) {
+	case "s", MODE_SERVER:
+		cfg.Mode = MODE_SERVER
+	case "c", MODE_CLIENT:
+		cfg.Mode = MODE_CLIENT
+	case MODE_ADMIN, MODE_VERIFY_AUDIT:
+		cfg.Mode = strings.ToLower(cfg.Mode)
+	case "":
+	default:
+		return Config{}, fmt.Errorf("unknown mode '%s', expected '%s', '%s', '%s' or '%s'", cfg.Mode, MODE_SERVER, MODE_CLIENT, MODE_ADMIN, MODE_VERIFY_AUDIT)
+	}
+
+	return cfg, nil
+
+}
+
+// newConfigFlagSet returns the command line flags, which write into the
+// given config and use its current values as defaults.
+//
+// Parameters:
+//	cfg - the config the flags are written to
+//	configPath - where the path of the config file is written to
+func newConfigFlagSet(cfg *Config, configPath *string) *flag.FlagSet {
+
+	flags := flag.NewFlagSet("messanger", flag.ContinueOnError)
+	flags.StringVar(configPath, "config", *configPath, "read the settings from this json `file`, flags override its values")
+	flags.StringVar(&cfg.Mode, "mode", cfg.Mode, "run as 'server', 'client' or as 'admin' console, or 'verify-audit' the audit log, asks interactively if not given")
+	flags.StringVar(&cfg.Listen, "listen", cfg.Listen, "server: the `address` to listen on, e.g. ':9000'")
+	flags.StringVar(&cfg.Server, "server", cfg.Server, "client: the `address` of the server, e.g. 'localhost:9000'")
+	flags.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "the `directory` of the server or client data (default './serverdata' or './clientdata')")
+	flags.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "server: the certificate `file`, enables TLS together with -tls-key")
+	flags.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "server: the private key `file` of the certificate")
+	flags.BoolVar(&cfg.TLS, "tls", cfg.TLS, "client: connect to the server with TLS")
+	flags.StringVar(&cfg.TLSCA, "tls-ca", cfg.TLSCA, "client: check the server certificate against the CA certificate in this `file`, implies -tls")
+	flags.StringVar(&cfg.SessionPolicy, "session-policy", cfg.SessionPolicy, "server: 'reject', 'takeover' or 'multi' (default 'takeover')")
+	flags.StringVar(&cfg.PasswordPolicy, "password-policy", cfg.PasswordPolicy, "server: the minimum strength of new passwords as '<minLength> <minClasses>', checked by the clients only")
+	flags.StringVar(&cfg.ChatRequestLimit, "chat-request-limit", cfg.ChatRequestLimit, "server: the chat requests a user may send as '<burst>/<interval>'")
+	flags.StringVar(&cfg.MessageLimit, "message-limit", cfg.MessageLimit, "server: the messages a user may send as '<burst>/<interval>'")
+	flags.StringVar(&cfg.PacketLimit, "packet-limit", cfg.PacketLimit, "server: the packets of any type a connection may send as '<burst>/<interval>', further packets are read more slowly")
+	flags.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "server: 'debug', 'info', 'warn' or 'error' (default 'info')")
+	flags.StringVar(&cfg.LogFormat, "log-format", cfg.LogFormat, "server: write the log as 'text' or as 'json' lines (default 'text')")
+	flags.BoolVar(&cfg.Headless, "headless", cfg.Headless, "client: print the output line by line instead of the full-screen interface")
+	flags.StringVar(&cfg.Admins, "admins", cfg.Admins, "server: the registered `users` who may use the admin commands, separated by commas")
+	flags.StringVar(&cfg.AdminSocket, "admin-socket", cfg.AdminSocket, "server and admin console: the unix socket `file` of the admin console")
+	flags.StringVar(&cfg.AuditKey, "audit-key", cfg.AuditKey, "server and audit verifier: the `file` holding the key of the audit log, created by the server if missing (default '<user config dir>/messanger/audit.key')")
+	flags.StringVar(&cfg.MetricsListen, "metrics-listen", cfg.MetricsListen, "server: the loopback `address` to serve Prometheus metrics on at '/metrics', e.g. 127.0.0.1:9100")
+	flags.BoolVar(&cfg.MetricsPublic, "metrics-public", cfg.MetricsPublic, "server: allow '-metrics-listen' to be an address which is reachable from other hosts, the metrics are not authenticated")
+	flags.StringVar(&cfg.WebSocketListen, "ws-listen", cfg.WebSocketListen, "server: the `address` to serve the browser client and WebSocket connections on, e.g. :8080")
+	return flags
+
+}
+
+// readConfigFile decodes the given json config file into cfg. Unknown
+// settings are rejected, so typos do not go unnoticed.
+//
+// Parameters:
+//	path - the config file
+//	cfg - the config the settings are written to
+func readConfigFile(path string, cfg *Config) error {
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("parsing config file '%s': %w", path, err)
+	}
+	return nil
+
+}
+
+// newServerFromConfig returns a server with the settings of the config.
+// The server data directory and the default logger are changed as well.
+// Returns an error if a setting is invalid.
+//
+// Parameters:
+//	cfg - the config of the server
+func newServerFromConfig(cfg Config) (*Server, error) {
+
+	if cfg.Listen == "" {
+		return nil, errors.New("no address to listen on given, use '-listen'")
+	}
+	if _, _, err := net.SplitHostPort(cfg.Listen); err != nil {
+		return nil, fmt.Errorf("invalid listen address '%s': %w", cfg.Listen, err)
+	}
+
+	server := NewServer(cfg.Listen)
+
+	var err error
+	if cfg.SessionPolicy != "" {
+		if server.sessionPolicy, err = parseSessionPolicy(cfg.SessionPolicy); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PasswordPolicy != "" {
+		if server.passwordPolicy, err = parsePasswordPolicy(cfg.PasswordPolicy); err != nil {
+			return nil, fmt.Errorf("invalid password policy: %w", err)
+		}
+	}
+	if cfg.ChatRequestLimit != "" {
+		if server.chatRequestLimit, err = parseRateLimit(cfg.ChatRequestLimit); err != nil {
+			return nil, fmt.Errorf("invalid chat request limit: %w", err)
+		}
+	}
+	if cfg.MessageLimit != "" {
+		if server.messageLimit, err = parseRateLimit(cfg.MessageLimit); err != nil {
+			return nil, fmt.Errorf("invalid message limit: %w", err)
+		}
+	}
+	if cfg.PacketLimit != "" {
+		if server.packetLimit, err = parseRateLimit(cfg.PacketLimit); err != nil {
+			return nil, fmt.Errorf("invalid packet limit: %w", err)
+		}
+	}
+
+	logLevel := slog.LevelInfo
+	if cfg.LogLevel != "" {
+		if logLevel, err = parseLogLevel(cfg.LogLevel); err != nil {
+			return nil, err
+		}
+	}
+	logger, err := newLogger(os.Stdout, logLevel, cfg.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+
+	for _, name := range strings.Split(cfg.Admins, ",") {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		admin, err := normalizeUsername(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin '%s': %w", name, err)
+		}
+		server.admins[admin] = true
+	}
+	server.adminSocket 	 = cfg.AdminSocket
+	server.metricsAddr 	 = cfg.MetricsListen
+	server.metricsPublic = cfg.MetricsPublic
+	server.wsAddr 	   	 = cfg.WebSocketListen
+
+	if server.metricsAddr != "" {
+		if err := checkMetricsAddr(server.metricsAddr, server.metricsPublic); err != nil {
+			return nil, err
+		}
+	}
+
+	if server.auditKeyPath, err = auditKeyPathOf(cfg); err != nil {
+		return nil, err
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return nil, errors.New("TLS needs both a certificate and a key, use '-tls-cert' and '-tls-key'")
+	}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %w", err)
+		}
+		server.tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+
+	if cfg.DataDir != "" {
+		setServerDataDir(cfg.DataDir)
+	}
+
+	return server, nil
+
+}
+
+// auditKeyPathOf returns the key file of the audit log given by the config
+// or the default one.
+//
+// Parameters:
+//	cfg - the config of the server or audit verifier
+func auditKeyPathOf(cfg Config) (string, error) {
+
+	if cfg.AuditKey != "" {
+		return cfg.AuditKey, nil
+	}
+	path, err := defaultAuditKeyPath()
+	if err != nil {
+		return "", fmt.Errorf("no key file of the audit log given and no default one found, use '-audit-key': %w", err)
+	}
+	return path, nil
+
+}
+
+// newClientFromConfig returns a client with the settings of the config.
+// The client data directory is changed as well.
+// Returns an error if a setting is invalid.
+//
+// Parameters:
+//	cfg - the config of the client
+func newClientFromConfig(cfg Config) (*Client, error) {
+
+	if cfg.Server == "" {
+		return nil, errors.New("no server address given, use '-server'")
+	}
+	host, _, err := net.SplitHostPort(cfg.Server)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server address '%s': %w", cfg.Server, err)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS || cfg.TLSCA != "" {
+
+		tlsConfig = &tls.Config{
+			ServerName: host,
+			MinVersion: tls.VersionTLS12,
+		}
+
+		if cfg.TLSCA != "" {
+			caCert, err := os.ReadFile(cfg.TLSCA)
+			if err != nil {
+				return nil, fmt.Errorf("reading CA certificate: %w", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+				return nil, fmt.Errorf("no certificate found in '%s'", cfg.TLSCA)
+			}
+		}
+
+	}
+
+	if cfg.DataDir != "" {
+		setClientDataDir(cfg.DataDir)
+	}
+
+	client := NewClient(cfg.Server, cfg.Headless)
+	client.tlsConfig = tlsConfig
+	return client, nil
+
+}
@@ -1,8 +1,90 @@
 package main
 
+import (
+	"path/filepath"
+	"time"
+)
+
+// The data of the server and of the clients is kept below the data
+// directories, which can be changed with the '-data-dir' flag or in the
+// config file before the server or client is started.
+var (
+	serverDataDir      = "./serverdata/"
+	serverChatDir      = serverDataDir + "chats/"
+	serverQueueDir     = serverDataDir + "queues/"
+	shadowPath         = serverDataDir + "shadow"
+	devicesPath        = serverDataDir + "devices"
+	accountJournalPath = serverDataDir + "accountJournal" // Holds an account change which has not been completed yet
+	usernameReportPath = serverDataDir + "usernameReport" // Lists registered usernames which do not meet the username policy
+	contactsPath       = serverDataDir + "contacts"
+	bansPath           = serverDataDir + "bans"
+	auditLogPath       = serverDataDir + "audit" // Every admin action, one json encoded AuditEntry per line
+)
+
+var (
+	clientDataDir = "./clientdata/"
+)
+
+// setServerDataDir moves every path of the server data below the given
+// directory.
+//
+// Parameters:
+//	dir - the directory to keep the server data in
+func setServerDataDir(dir string) {
+
+	serverDataDir      = filepath.ToSlash(filepath.Clean(dir)) + "/"
+	serverChatDir      = serverDataDir + "chats/"
+	serverQueueDir     = serverDataDir + "queues/"
+	shadowPath         = serverDataDir + "shadow"
+	devicesPath        = serverDataDir + "devices"
+	accountJournalPath = serverDataDir + "accountJournal"
+	usernameReportPath = serverDataDir + "usernameReport"
+	contactsPath       = serverDataDir + "contacts"
+	bansPath           = serverDataDir + "bans"
+	auditLogPath       = serverDataDir + "audit"
+
+}
+
+// setClientDataDir moves the data of every user of the client below the
+// given directory.
+//
+// Parameters:
+//	dir - the directory to keep the client data in
+func setClientDataDir(dir string) {
+
+	clientDataDir = filepath.ToSlash(filepath.Clean(dir)) + "/"
+
+}
+
+// defaultSessionPolicy is used if no other session policy is chosen
+// during the server setup.
+const defaultSessionPolicy = SESSION_TAKEOVER
+
+// A connection is closed after maxLoginAttempts failed logins in a row.
+const maxLoginAttempts = 3
+
+// The default password policy is used if no other one is chosen during
+// the server setup.
+const (
+	defaultMinPasswordLength  = 8
+	defaultMinPasswordClasses = 2
+)
+
+// The default rate limits allow a few chat requests in a row and one more
+// every 20 seconds, bursts of 20 chat messages and two more per second,
+// and bursts of 100 packets of any type and 100 more per second, which
+// lets files be sent with about 3 MiB per second.
+var (
+	defaultChatRequestLimit = RateLimit{Burst: 3, Interval: 20 * time.Second}
+	defaultMessageLimit 	= RateLimit{Burst: 20, Interval: 500 * time.Millisecond}
+	defaultPacketLimit 		= RateLimit{Burst: 100, Interval: 10 * time.Millisecond}
+)
+
+// Timers of disappearing messages have to be between minChatTimer and
+// maxChatTimer. Expired messages are purged from the chat files and the
+// queues every expirySweepInterval.
 const (
-	serverDataDir  = "./serverdata/"
-	serverChatDir  = serverDataDir + "chats/"
-	shadowPath     = serverDataDir + "shadow"
-	tempShadowPath = serverDataDir + "tempShadow"
+	minChatTimer 		= 5 * time.Second
+	maxChatTimer 		= 4 * 7 * 24 * time.Hour
+	expirySweepInterval = 10 * time.Second
 )
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"slices"
+)
+
+// ContactsFile is the content of the contacts file in the servers data
+// directory.
+type ContactsFile struct {
+	Contacts map[string][]string `json:"contacts"` // Maps from username to the contacts of the user
+	Hidden 	 []string 			 `json:"hidden"`   // Users who hide their presence
+	Blocked  map[string][]string `json:"blocked"`  // Maps from username to the users blocked by the user
+}
+
+// loadContacts reads the contacts file and loads the contact lists, the
+// users who hide their presence and the blocked users into the server.
+// If there is no contacts file yet, the server starts without contacts.
+// Returns true on successfull loading and false otherwise
+func (s *Server) loadContacts() bool {
+
+	if !fileExists(contactsPath) {
+		slog.Info("No contacts file yet")
+		return true
+	}
+
+	content, err := os.ReadFile(contactsPath)
+	if err != nil {
+		slog.Error("Reading contacts file", "err", err)
+		return false
+	}
+
+	var contactsFile ContactsFile
+	err = json.Unmarshal(content, &contactsFile)
+	if err != nil {
+		slog.Error("Unmarshalling contacts file", "err", err)
+		return false
+	}
+
+	for username, contacts := range contactsFile.Contacts {
+		s.contacts[username] = contacts
+	}
+	for _, username := range contactsFile.Hidden {
+		s.hiddenPresence[username] = true
+	}
+	for username, blocked := range contactsFile.Blocked {
+		s.blocked[username] = blocked
+	}
+
+	slog.Info("Successfully loaded contacts file")
+	return true
+
+}
+
+// saveContactsLocked writes the contact lists, the users who hide their
+// presence and the blocked users into the contacts file.
+// The function assumes that the s.muContacts Mutex is locked.
+// Returns true on success and false otherwise.
+func (s *Server) saveContactsLocked() bool {
+
+	contactsFile := ContactsFile{
+		Contacts: s.contacts,
+		Hidden:   []string{},
+		Blocked:  s.blocked,
+	}
+	for username := range s.hiddenPresence {
+		contactsFile.Hidden = append(contactsFile.Hidden, username)
+	}
+	slices.Sort(contactsFile.Hidden)
+
+	jsonData, err := json.Marshal(contactsFile)
+	if err != nil {
+		slog.Error("Marshalling contacts file", "err", err)
+		return false
+	}
+
+	err = writeFileAtomic(contactsPath, jsonData)
+	if err != nil {
+		slog.Error("Writing contacts file", "err", err)
+		return false
+	}
+	return true
+
+}
+
+// deleteContactsLocked removes the contact list, the blocked users and the
+// hidden presence of the given user and the user from the contact and
+// block lists of everyone else. The contacts file is written afterwards.
+// The function assumes that the s.muContacts Mutex is locked.
+//
+// Parameters:
+//	username - the user whose account is deleted
+func (s *Server) deleteContactsLocked(username string) bool {
+
+	delete(s.contacts, username)
+	delete(s.hiddenPresence, username)
+	delete(s.blocked, username)
+	for _, lists := range []map[string][]string{s.contacts, s.blocked} {
+		for owner, users := range lists {
+			lists[owner] = slices.DeleteFunc(users, func(user string) bool {
+				return user == username
+			})
+		}
+	}
+	return s.saveContactsLocked()
+
+}
+
+// renameContactsLocked moves the contact list, the blocked users and the
+// hidden presence of the given user to the new name and replaces the user
+// in the contact and block lists of everyone else. The contacts file is
+// written afterwards.
+// The function assumes that the s.muContacts Mutex is locked.
+//
+// Parameters:
+//	oldName - the current name of the user
+//	newName - the new name of the user
+func (s *Server) renameContactsLocked(oldName string, newName string) bool {
+
+	if s.hiddenPresence[oldName] {
+		s.hiddenPresence[newName] = true
+		delete(s.hiddenPresence, oldName)
+	}
+	for _, lists := range []map[string][]string{s.contacts, s.blocked} {
+		if users, ok := lists[oldName]; ok {
+			lists[newName] = users
+			delete(lists, oldName)
+		}
+		for _, users := range lists {
+			for i, user := range users {
+				if user == oldName {
+					users[i] = newName
+				}
+			}
+		}
+	}
+	return s.saveContactsLocked()
+
+}
+
+// isBlockedLocked reports whether the given user blocked the sender.
+// The function assumes that the s.muContacts Mutex is locked.
+//
+// Parameters:
+//	username - the user who may have blocked the sender
+//	sender - the user who sends a chat request or message
+func (s *Server) isBlockedLocked(username string, sender string) bool {
+
+	return slices.Contains(s.blocked[username], sender)
+
+}
+
+// isVisiblyOnlineLocked reports whether other users may see that the given
+// user is online. Users who hide their presence always appear offline.
+// The function assumes that the s.mu and s.muContacts Mutexes are locked.
+//
+// Parameters:
+//	username - the user whose presence is checked
+func (s *Server) isVisiblyOnlineLocked(username string) bool {
+
+	_, isOnline := s.clientConnsRev[username]
+	return isOnline && !s.hiddenPresence[username]
+
+}
+
+// pushPresenceLocked sends a "PRESENCE" packet to every online user who
+// has the given user in their contact list. Nothing is sent if the user
+// hides their presence.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	username - the user whose presence changed
+//	online - whether the user is online now
+func (s *Server) pushPresenceLocked(username string, online bool) {
+
+	s.muContacts.Lock()
+	defer s.muContacts.Unlock()
+
+	if s.hiddenPresence[username] {
+		return
+	}
+
+	jsonData, err := json.Marshal(Presence{Username: username, Online: online})
+	if err != nil {
+		slog.Error("Marshalling presence", "err", err)
+		return
+	}
+	packet := Packet{MsgType: "PRESENCE", Payload: string(jsonData)}
+
+	for watcher, contacts := range s.contacts {
+
+		if watcher == username || !slices.Contains(contacts, username) {
+			continue
+		}
+
+		for conn := range s.clientConnsRev[watcher] {
+			err := writePacket(conn, packet)
+			if err != nil {
+				s.connLogLocked(conn).Error("Writing presence", "contact", username, "err", err)
+			}
+		}
+
+	}
+
+}
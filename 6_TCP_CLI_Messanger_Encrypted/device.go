@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// safetyNumberIterations is the number of hash rounds used to derive a
+// safety number. They make it expensive to search for a key which
+// results in the same safety number as another one.
+const safetyNumberIterations = 5200
+
+// deviceIDBytes is the number of random bytes a device ID is made of.
+// Device IDs are these bytes in lower case hex.
+const deviceIDBytes = 8
+
+// Device is the identity of one device a user is logged in from.
+// Every device has its own X25519 key pair. The private key never
+// leaves the device, the public key is registered at the server so
+// other users can encrypt messages to this device.
+type Device struct {
+	id  string
+	key *ecdh.PrivateKey
+}
+
+// loadOrCreateDevice reads the device identity of the given user from
+// the clients data directory. If there is no identity for that user on
+// this machine yet, a new one is generated and stored.
+//
+// Parameters:
+//	username - the user to load the device identity for
+func loadOrCreateDevice(username string) (*Device, error) {
+
+	userDir    := clientDataDir + username + "/"
+	devicePath := userDir + "device"
+
+	if fileExists(devicePath) {
+
+		content, err := os.ReadFile(devicePath)
+		if err != nil {
+			return nil, err
+		}
+
+		lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+		if len(lines) != 2 {
+			return nil, errors.New("invalid device file " + devicePath)
+		}
+
+		rawKey, err := base64.StdEncoding.DecodeString(lines[1])
+		if err != nil {
+			return nil, err
+		}
+		key, err := ecdh.X25519().NewPrivateKey(rawKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Device{id: lines[0], key: key}, nil
+
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	rawID := make([]byte, deviceIDBytes)
+	if _, err := rand.Read(rawID); err != nil {
+		return nil, err
+	}
+	device := &Device{id: hex.EncodeToString(rawID), key: key}
+
+	if err := os.MkdirAll(userDir, 0700); err != nil {
+		return nil, err
+	}
+	content := device.id + "\n" + base64.StdEncoding.EncodeToString(key.Bytes()) + "\n"
+	if err := os.WriteFile(devicePath, []byte(content), 0600); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+
+}
+
+// validDeviceID reports whether the given device ID has the format of
+// the IDs generated by loadOrCreateDevice. Device IDs sent by clients are
+// used in file names of the server, so nothing else may be accepted.
+//
+// Parameters:
+//	id - the device ID to check
+func validDeviceID(id string) bool {
+
+	if len(id) != 2 * deviceIDBytes {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+
+}
+
+// publicKey returns the base64 encoded public key of the device the way
+// it is registered at the server.
+func (d *Device) publicKey() string {
+
+	return base64.StdEncoding.EncodeToString(d.key.PublicKey().Bytes())
+
+}
+
+// parsePublicKey decodes a base64 encoded X25519 public key as it is
+// sent by the server.
+func parsePublicKey(encoded string) (*ecdh.PublicKey, error) {
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(raw)
+
+}
+
+// sharedSecret derives the secret shared between this device and the
+// device with the given public key. Both sides derive the same secret
+// through an X25519 key exchange. It is the root of every ratchet
+// session between the two devices.
+//
+// Parameters:
+//	peerKey - the base64 encoded public key of the other device
+func (d *Device) sharedSecret(peerKey string) ([]byte, error) {
+
+	pubKey, err := parsePublicKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := d.key.ECDH(pubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return hkdf.Key(sha256.New, secret, nil, "messanger device key", 32)
+
+}
+
+// safetyNumber derives the safety number of two users from the identity
+// keys of all of their devices. Both users compute the same number no
+// matter who computes it, so comparing it over another channel proves
+// that the server did not substitute any of the keys.
+// The number consists of 12 blocks of 5 digits.
+//
+// Parameters:
+//	userA, keysA - the first user and the public keys of their devices
+//	userB, keysB - the second user and the public keys of their devices
+func safetyNumber(userA string, keysA []string, userB string, keysB []string) string {
+
+	digitsA := fingerprintDigits(userA, keysA)
+	digitsB := fingerprintDigits(userB, keysB)
+
+	first, second := digitsA, digitsB
+	if slices.Compare(digitsB, digitsA) < 0 {
+		first, second = digitsB, digitsA
+	}
+	blocks := append(first, second...)
+
+	var builder strings.Builder
+	for i, block := range blocks {
+		if i > 0 && i % 4 == 0 {
+			builder.WriteString("\n")
+		} else if i > 0 {
+			builder.WriteString(" ")
+		}
+		builder.WriteString(block)
+	}
+	return builder.String()
+
+}
+
+// fingerprintDigits derives the half of a safety number which belongs to
+// one user. The keys are sorted first, so the order in which the server
+// sent them does not matter.
+// Returns 6 blocks of 5 digits.
+//
+// Parameters:
+//	username - the user the keys belong to
+//	keys - the base64 encoded public keys of all devices of the user
+func fingerprintDigits(username string, keys []string) []string {
+
+	sortedKeys := slices.Sorted(slices.Values(keys))
+	keyMaterial := []byte(strings.Join(sortedKeys, ","))
+
+	hash := sha512.New()
+	hash.Write([]byte("messanger safety number:" + username + ":"))
+	hash.Write(keyMaterial)
+	digest := hash.Sum(nil)
+
+	for i := 0; i < safetyNumberIterations; i++ {
+		hash.Reset()
+		hash.Write(digest)
+		hash.Write(keyMaterial)
+		digest = hash.Sum(nil)
+	}
+
+	// Every block is made from 5 bytes of the digest
+	blocks := make([]string, 6)
+	for i := range blocks {
+		var value uint64
+		for _, b := range digest[i*5 : i*5+5] {
+			value = value << 8 | uint64(b)
+		}
+		blocks[i] = fmt.Sprintf("%05d", value % 100000)
+	}
+	return blocks
+
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The chat history of a user is kept on the client only, as the server
+// never sees the plaintext of a message. It is stored in the history file
+// of the user, one encrypted entry per line, and is searched with
+// '/search'. The entries are encrypted with a random history key, which
+// itself is stored encrypted with a key derived from the password of the
+// user. Changing the password only encrypts the history key again.
+
+// historyKeyIterations is the number of PBKDF2 iterations used to derive
+// the key protecting the history key from the password.
+const historyKeyIterations = 600000
+
+// maxSearchResults is the number of the most recent matches shown by
+// '/search'.
+const maxSearchResults = 20
+
+// HistoryKeyFile is the content of the history key file of a user.
+type HistoryKeyFile struct {
+	Salt 		string `json:"salt"`
+	Iterations 	int    `json:"iterations"`
+	Key 		string `json:"key"` // The history key encrypted with the key derived from the password
+}
+
+// HistoryEntry is a chat message kept in the history of a user.
+type HistoryEntry struct {
+	ID 		string 	  `json:"id,omitempty"`
+	Chat 	string 	  `json:"chat"` // The chat partner
+	From 	string 	  `json:"from"`
+	Time 	time.Time `json:"time"`
+	Text 	string 	  `json:"text"`
+	Expires time.Time `json:"expires,omitzero"` // When the message disappears, zero if it does not
+}
+
+// History is the decrypted chat history of a user along with an index
+// from every word to the entries containing it.
+type History struct {
+	dir 	string
+	key 	[]byte
+	entries []HistoryEntry
+	words 	map[string][]int // Maps from lower case word to the indices of the entries containing it
+}
+
+// openHistory decrypts the history of the given user with the given
+// password. If the user has no history on this device yet, a new history
+// key is created and protected with the password.
+//
+// Parameters:
+//	username - the user whose history is opened
+//	password - the password of the user
+func openHistory(username string, password string) (*History, error) {
+
+	history := &History{
+		dir: 	clientDataDir + username + "/",
+		words: 	make(map[string][]int),
+	}
+
+	if !fileExists(history.dir + "historyKey") {
+		history.key = make([]byte, 32)
+		if _, err := rand.Read(history.key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(history.dir, 0700); err != nil {
+			return nil, err
+		}
+		return history, history.protectKey(password)
+	}
+
+	content, err := os.ReadFile(history.dir + "historyKey")
+	if err != nil {
+		return nil, err
+	}
+	var keyFile HistoryKeyFile
+	if err := json.Unmarshal(content, &keyFile); err != nil {
+		return nil, err
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(keyFile.Salt)
+	if err != nil {
+		return nil, err
+	}
+	wrappingKey, err := pbkdf2.Key(sha256.New, password, salt, keyFile.Iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	history.key, err = openWithKey(wrappingKey, keyFile.Key)
+	if err != nil {
+		return nil, errors.New("the history key could not be decrypted with this password")
+	}
+
+	if err := history.load(); err != nil {
+		return nil, err
+	}
+
+	// Messages may have disappeared while the user was logged out
+	return history, history.purgeExpired(time.Now())
+
+}
+
+// protectKey encrypts the history key with a key derived from the given
+// password and writes it to the history key file.
+//
+// Parameters:
+//	password - the password of the user
+func (h *History) protectKey(password string) error {
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	wrappingKey, err := pbkdf2.Key(sha256.New, password, salt, historyKeyIterations, 32)
+	if err != nil {
+		return err
+	}
+	wrappedKey, err := sealWithKey(wrappingKey, h.key)
+	if err != nil {
+		return err
+	}
+
+	jsonData, err := json.Marshal(HistoryKeyFile{
+		Salt: 		base64.StdEncoding.EncodeToString(salt),
+		Iterations: historyKeyIterations,
+		Key: 		wrappedKey,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(h.dir + "historyKey", jsonData)
+
+}
+
+// load decrypts every entry of the history file and indexes it.
+func (h *History) load() error {
+
+	if !fileExists(h.dir + "history") {
+		return nil
+	}
+
+	file, err := os.Open(h.dir + "history")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024 * 1024)
+	for scanner.Scan() {
+
+		plaintext, err := openWithKey(h.key, scanner.Text())
+		if err != nil {
+			return err
+		}
+
+		var entry HistoryEntry
+		if err := json.Unmarshal(plaintext, &entry); err != nil {
+			return err
+		}
+		h.index(entry)
+
+	}
+	return scanner.Err()
+
+}
+
+// add appends the given entry to the history file and indexes it.
+//
+// Parameters:
+//	entry - the chat message to keep
+func (h *History) add(entry HistoryEntry) error {
+
+	line, err := h.seal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(h.dir + "history", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		return err
+	}
+
+	h.index(entry)
+	return nil
+
+}
+
+// seal encrypts the given entry with the history key.
+// Returns the line to store in the history file.
+func (h *History) seal(entry HistoryEntry) (string, error) {
+
+	jsonData, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	return sealWithKey(h.key, jsonData)
+
+}
+
+// index adds the given entry to the entries and every word of its text to
+// the word index.
+func (h *History) index(entry HistoryEntry) {
+
+	h.entries = append(h.entries, entry)
+	position := len(h.entries) - 1
+
+	for _, word := range historyWords(entry.Text) {
+		positions := h.words[word]
+		if len(positions) == 0 || positions[len(positions) - 1] != position {
+			h.words[word] = append(positions, position)
+		}
+	}
+
+}
+
+// search returns the most recent entries which contain every one of the
+// given terms at the start of a word, e.g. 'meet' finds 'meeting'.
+// Returns at most maxSearchResults entries, oldest first.
+//
+// Parameters:
+//	terms - the terms to search for
+func (h *History) search(terms []string) []HistoryEntry {
+
+	now := time.Now()
+
+	var matches []int
+	for i, term := range historyWords(strings.Join(terms, " ")) {
+
+		var termMatches []int
+		for word, positions := range h.words {
+			if strings.HasPrefix(word, term) {
+				termMatches = append(termMatches, positions...)
+			}
+		}
+		slices.Sort(termMatches)
+		termMatches = slices.Compact(termMatches)
+
+		if i == 0 {
+			matches = termMatches
+			continue
+		}
+		matches = slices.DeleteFunc(matches, func(position int) bool {
+			_, found := slices.BinarySearch(termMatches, position)
+			return !found
+		})
+
+	}
+
+	// Messages which disappeared are only purged from the history now and then
+	matches = slices.DeleteFunc(matches, func(position int) bool {
+		expires := h.entries[position].Expires
+		return !expires.IsZero() && !expires.After(now)
+	})
+
+	matches = matches[max(len(matches) - maxSearchResults, 0):]
+	results := make([]HistoryEntry, len(matches))
+	for i, position := range matches {
+		results[i] = h.entries[position]
+	}
+	return results
+
+}
+
+// confirmPassword handles an "AUTH" packet the server sends once it
+// accepted a login or changed the password. The chat history is opened
+// with the password of the login or protected with the new password.
+//
+// Parameters:
+//	kind - what was confirmed, "login" or "passwd"
+func (c *Client) confirmPassword(kind string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pwd := c.pendingPwd
+	c.pendingPwd = ""
+	if pwd == "" {
+		return
+	}
+
+	switch kind {
+	case "login":
+		history, err := openHistory(c.username, pwd)
+		if err != nil {
+			c.view.Println("[Warning] Opening the chat history failed, messages are not added to it and '/search' is not available:", err)
+			return
+		}
+		c.history = history
+
+		// Messages of earlier sessions can be edited, deleted and replied to as well
+		for _, entry := range history.entries {
+			if entry.Expires.IsZero() {
+				c.rememberMessageLocked(entry.ID, entry.Chat, entry.From, entry.Text)
+			}
+		}
+	case "passwd":
+		if c.history == nil {
+			return
+		}
+		err := c.history.protectKey(pwd)
+		if err != nil {
+			c.view.Println("[Error] Protecting the chat history with the new password failed, it still opens with the old one:", err)
+		}
+	}
+
+}
+
+// recordHistoryLocked adds the given chat message to the chat history if
+// it is open.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	entry - the chat message to keep
+func (c *Client) recordHistoryLocked(entry HistoryEntry) {
+
+	if c.history == nil {
+		return
+	}
+
+	err := c.history.add(entry)
+	if err != nil {
+		c.view.Println("[Error] Adding message to the chat history failed:", err)
+	}
+
+}
+
+// renameUser replaces the old name of a user with the new name in every
+// entry and writes the whole history file again.
+//
+// Parameters:
+//	oldName - the name the user had
+//	newName - the name the user has now
+func (h *History) renameUser(oldName string, newName string) error {
+
+	for i := range h.entries {
+		entry := &h.entries[i]
+		if entry.Chat == oldName {
+			entry.Chat = newName
+		}
+		if entry.From == oldName {
+			entry.From = newName
+		}
+	}
+	return h.save()
+
+}
+
+// purgeExpired removes every message which has disappeared at the given
+// time from the history.
+//
+// Parameters:
+//	now - the current time
+func (h *History) purgeExpired(now time.Time) error {
+
+	kept := slices.DeleteFunc(slices.Clone(h.entries), func(entry HistoryEntry) bool {
+		return !entry.Expires.IsZero() && !entry.Expires.After(now)
+	})
+	if len(kept) == len(h.entries) {
+		return nil
+	}
+	return h.replaceEntries(kept)
+
+}
+
+// find returns the first message with the given ID.
+//
+// Parameters:
+//	id - the ID of the message
+func (h *History) find(id string) (HistoryEntry, bool) {
+
+	index := slices.IndexFunc(h.entries, func(entry HistoryEntry) bool {
+		return entry.ID == id && id != ""
+	})
+	if index == -1 {
+		return HistoryEntry{}, false
+	}
+	return h.entries[index], true
+
+}
+
+// edit replaces the text of the messages with the given ID which were
+// sent by the given user. Messages of other users are never changed, even
+// if their ID is the same.
+//
+// Parameters:
+//	id - the ID of the edited message
+//	from - the sender of the message
+//	text - the new text of the message
+func (h *History) edit(id string, from string, text string) error {
+
+	entries := slices.Clone(h.entries)
+	edited  := false
+	for i := range entries {
+		if entries[i].ID == id && entries[i].From == from && id != "" {
+			entries[i].Text = text
+			edited = true
+		}
+	}
+	if !edited {
+		return nil
+	}
+	return h.replaceEntries(entries)
+
+}
+
+// remove removes the messages with the given ID which were sent by the
+// given user.
+//
+// Parameters:
+//	id - the ID of the deleted message
+//	from - the sender of the message
+func (h *History) remove(id string, from string) error {
+
+	kept := slices.DeleteFunc(slices.Clone(h.entries), func(entry HistoryEntry) bool {
+		return entry.ID == id && entry.From == from && id != ""
+	})
+	if len(kept) == len(h.entries) {
+		return nil
+	}
+	return h.replaceEntries(kept)
+
+}
+
+// replaceEntries indexes the given entries in place of the current ones
+// and writes the whole history file.
+func (h *History) replaceEntries(entries []HistoryEntry) error {
+
+	h.entries = nil
+	h.words   = make(map[string][]int)
+	for _, entry := range entries {
+		h.index(entry)
+	}
+	return h.save()
+
+}
+
+// save encrypts every entry again and writes the whole history file.
+func (h *History) save() error {
+
+	var content strings.Builder
+	for _, entry := range h.entries {
+		line, err := h.seal(entry)
+		if err != nil {
+			return err
+		}
+		content.WriteString(line + "\n")
+	}
+	return writeFileAtomic(h.dir + "history", []byte(content.String()))
+
+}
+
+// historyWords splits the given text into lower case words.
+func historyWords(text string) []string {
+
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+}
+
+// sealWithKey encrypts the plaintext with AES-GCM and a random nonce.
+// Returns the base64 encoded nonce followed by the ciphertext.
+func sealWithKey(key []byte, plaintext []byte) (string, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)), nil
+
+}
+
+// openWithKey decrypts a ciphertext created by sealWithKey.
+func openWithKey(key []byte, ciphertext string) ([]byte, error) {
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+
+}
+
+// newGCM returns AES-GCM with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+
+}
@@ -0,0 +1,1073 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The integration tests run a server on an ephemeral port with a
+// temporary data directory and drive real clients through a test view,
+// which feeds them input lines and collects every line they show.
+
+// expectTimeout is how long a test waits for a line of a client. It is
+// generous as deriving the key of the chat history is slow with -race.
+const expectTimeout = 15 * time.Second
+
+// startTestServer starts a server on an ephemeral port of the loopback
+// interface with a temporary data directory and quiet logging. The
+// server is shut down by the returned function or when the test ends.
+// Returns the server, its address and the function shutting it down.
+//
+// Parameters:
+//	tb - the test or benchmark
+//	configure - changes the server before it starts, may be nil
+func startTestServer(tb testing.TB, configure func(s *Server)) (*Server, string, func()) {
+
+	tb.Helper()
+
+	setServerDataDir(tb.TempDir())
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	server := NewServer("127.0.0.1:0")
+	server.auditKeyPath = filepath.Join(tb.TempDir(), "audit.key")
+	if configure != nil {
+		configure(server)
+	}
+
+	ln, err := net.Listen("tcp", server.listenAddr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(ctx, ln)
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cancel()
+			if err := <-done; err != nil {
+				tb.Error("serving:", err)
+			}
+			slog.SetDefault(defaultLogger)
+		})
+	}
+	tb.Cleanup(stop)
+	return server, ln.Addr().String(), stop
+
+}
+
+// testView is a ClientView which reads the input of the client from a
+// channel and sends every line the client shows into another one.
+// Responses of the server are shown as their plain payload.
+type testView struct {
+	input  chan string
+	output chan string
+	done   chan struct{} // Closed when the test ends
+}
+
+func (v *testView) ReadInput(inputCh chan<- string) error {
+
+	for {
+		select {
+		case line := <-v.input:
+			select {
+			case inputCh <- line:
+			case <-v.done:
+				return nil
+			}
+		case <-v.done:
+			return nil
+		}
+	}
+
+}
+
+func (v *testView) show(line string) {
+
+	select {
+	case v.output <- strings.TrimSuffix(line, "\n"):
+	case <-v.done:
+	}
+
+}
+
+func (v *testView) Printf(format string, args ...any) {
+
+	v.show(fmt.Sprintf(format, args...))
+
+}
+
+func (v *testView) Println(args ...any) {
+
+	v.show(fmt.Sprintln(args...))
+
+}
+
+func (v *testView) ServerMessage(msgType string, payload string) {
+
+	v.show(payload)
+
+}
+
+func (v *testView) ChatLine(partner string, format string, args ...any) {
+
+	v.show("[" + partner + "] " + fmt.Sprintf(format, args...))
+
+}
+
+func (v *testView) Signal(partner string, kind string) {}
+
+func (v *testView) ReplaceMessage(partner string, id string, from string, text string, replacement string) {
+
+	v.show("[" + partner + "] " + replacement)
+
+}
+
+func (v *testView) SetStatus(username string, activeChat string) {}
+
+func (v *testView) BeginSecret(prompt string) func() {
+
+	v.show(prompt)
+	return func() {}
+
+}
+
+func (v *testView) Close() {}
+
+// testClient is a client connected to the test server.
+type testClient struct {
+	t 	   *testing.T
+	name   string 		 // Tells the clients apart in failures
+	client *Client
+	view   *testView
+	done   chan struct{} // Closed once the client stopped
+}
+
+// newTestClient connects a new client to the server at the given address.
+//
+// Parameters:
+//	t - the test
+//	addr - the address of the server
+//	name - tells the client apart in failures
+func newTestClient(t *testing.T, addr string, name string) *testClient {
+
+	t.Helper()
+
+	view := &testView{
+		input:  make(chan string),
+		output: make(chan string, 256),
+		done:   make(chan struct{}),
+	}
+	t.Cleanup(func() { close(view.done) })
+
+	client 		:= NewClient(addr, true)
+	client.view  = view
+
+	tc := &testClient{t: t, name: name, client: client, view: view, done: make(chan struct{})}
+	go func() {
+		defer close(tc.done)
+		client.connectToServer()
+	}()
+
+	tc.expect("[Log] Connection established.")
+	return tc
+
+}
+
+// send types the given lines into the client.
+//
+// Parameters:
+//	lines - the lines to type
+func (tc *testClient) send(lines ...string) {
+
+	tc.t.Helper()
+
+	for _, line := range lines {
+		select {
+		case tc.view.input <- line:
+		case <-time.After(expectTimeout):
+			tc.t.Fatalf("%s: typing %q timed out", tc.name, line)
+		}
+	}
+
+}
+
+// expect waits for a line of the client which is exactly the given one.
+// Lines shown before it are skipped.
+//
+// Parameters:
+//	want - the line to wait for
+func (tc *testClient) expect(want string) {
+
+	tc.t.Helper()
+
+	var skipped []string
+	timeout := time.After(expectTimeout)
+	for {
+		select {
+		case line := <-tc.view.output:
+			if line == want {
+				return
+			}
+			skipped = append(skipped, line)
+		case <-timeout:
+			tc.t.Fatalf("%s: %q was not shown, instead got:\n%s", tc.name, want, strings.Join(skipped, "\n"))
+		}
+	}
+
+}
+
+// expectSuffix waits for a line of the client which ends with the given
+// text, e.g. a chat message behind its random ID. Lines shown before it
+// are skipped.
+//
+// Parameters:
+//	suffix - the end of the line to wait for
+func (tc *testClient) expectSuffix(suffix string) {
+
+	tc.t.Helper()
+
+	var skipped []string
+	timeout := time.After(expectTimeout)
+	for {
+		select {
+		case line := <-tc.view.output:
+			if strings.HasSuffix(line, suffix) {
+				return
+			}
+			skipped = append(skipped, line)
+		case <-timeout:
+			tc.t.Fatalf("%s: no line ending with %q was shown, instead got:\n%s", tc.name, suffix, strings.Join(skipped, "\n"))
+		}
+	}
+
+}
+
+// expectNone checks that the client does not show the given line within
+// a short time.
+//
+// Parameters:
+//	unwanted - the line which must not be shown
+func (tc *testClient) expectNone(unwanted string) {
+
+	tc.t.Helper()
+
+	timeout := time.After(200 * time.Millisecond)
+	for {
+		select {
+		case line := <-tc.view.output:
+			if line == unwanted {
+				tc.t.Fatalf("%s: %q was shown", tc.name, unwanted)
+			}
+		case <-timeout:
+			return
+		}
+	}
+
+}
+
+// register registers the given user and logs in as it.
+//
+// Parameters:
+//	username - the user to register
+//	password - the password of the user
+func (tc *testClient) register(username string, password string) {
+
+	tc.t.Helper()
+
+	tc.send("/register " + username)
+	tc.expect("New password: ")
+	tc.send(password)
+	tc.expect("Repeat the new password: ")
+	tc.send(password)
+	tc.expect("(anonymous) A new user has been added: " + username)
+
+	tc.login(username, password)
+
+}
+
+// login logs in as the given user.
+//
+// Parameters:
+//	username - the user to log in as
+//	password - the password of the user
+func (tc *testClient) login(username string, password string) {
+
+	tc.t.Helper()
+
+	tc.send("/login " + username)
+	tc.expect("Password: ")
+	tc.send(password)
+	tc.expect("(" + username + ") Login successfull.")
+
+	// The client reads no input while it opens the chat history after the login
+	deadline := time.Now().Add(expectTimeout)
+	for {
+		tc.client.mu.Lock()
+		opened := tc.client.history != nil
+		tc.client.mu.Unlock()
+		if opened {
+			return
+		}
+		if time.Now().After(deadline) {
+			tc.t.Fatalf("%s: chat history was not opened after the login", tc.name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+}
+
+// quit quits the client and waits until it stopped.
+func (tc *testClient) quit() {
+
+	tc.t.Helper()
+
+	tc.send("/quit")
+	select {
+	case <-tc.done:
+	case <-time.After(expectTimeout):
+		tc.t.Fatalf("%s: client did not stop after '/quit'", tc.name)
+	}
+
+}
+
+// readAuditEvents returns the event and result of every entry of the
+// audit log, e.g. "login alice: wrong password". Logouts are followed by
+// their reason, e.g. "logout alice: ok (disconnected)".
+//
+// Parameters:
+//	t - the test
+//	server - the server which wrote the audit log
+func readAuditEvents(t *testing.T, server *Server) []string {
+
+	t.Helper()
+
+	count, err := verifyAuditLog(auditLogPath, server.auditKey)
+	if err != nil {
+		t.Fatalf("audit log is broken after %d entries: %s", count, err)
+	}
+
+	content, err := os.ReadFile(auditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []string
+	for line := range strings.Lines(string(content)) {
+		entry, err := lastAuditEntry([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := entry.Event + " " + entry.Actor + ": " + entry.Result
+		if entry.Event == AUDIT_LOGOUT {
+			event += " (" + entry.Args + ")"
+		}
+		events = append(events, event)
+	}
+	return events
+
+}
+
+func TestIntegrationRegisterAndLogin(t *testing.T) {
+
+	setClientDataDir(t.TempDir())
+	server, addr, stop := startTestServer(t, nil)
+
+	alice := newTestClient(t, addr, "alice")
+	alice.send("/register alice")
+	alice.expect("New password: ")
+	alice.send("Secret123")
+	alice.expect("Repeat the new password: ")
+	alice.send("Secret123")
+	alice.expect("(anonymous) A new user has been added: alice")
+
+	alice.send("/register alice")
+	alice.expect("New password: ")
+	alice.send("Secret123")
+	alice.expect("Repeat the new password: ")
+	alice.send("Secret123")
+	alice.expect("(anonymous) [Error] Username already exists. Please retry with different username. (" + USERNAME_TAKEN + ")")
+
+	alice.send("/login alice")
+	alice.expect("Password: ")
+	alice.send("Wrong1234")
+	alice.expect("(anonymous) [Error] Invalid combiation of username and password given.")
+
+	alice.login("alice", "Secret123")
+
+	alice.send("/logout")
+	alice.expect("(anonymous) Logout successfull.")
+	alice.quit()
+
+	stop()
+
+	shadow, err := os.ReadFile(shadowPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "alice:" + hashPassword("Secret123") + "\n"; string(shadow) != want {
+		t.Errorf("shadow file is %q, want %q", shadow, want)
+	}
+
+	device, err := loadOrCreateDevice("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := os.ReadFile(devicesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(devices), device.id) || !strings.Contains(string(devices), device.publicKey()) {
+		t.Errorf("devices file %q does not hold the device of alice %s", devices, device.id)
+	}
+
+	wantEvents := []string{
+		"register alice: ok",
+		"register alice: username taken",
+		"login alice: wrong password",
+		"login alice: ok",
+		"logout alice: ok (logout)",
+	}
+	if events := readAuditEvents(t, server); !slices.Equal(events, wantEvents) {
+		t.Errorf("audit events are %q, want %q", events, wantEvents)
+	}
+
+	// Without the key, the hash of a changed entry can not be computed again
+	content, err := os.ReadFile(auditLogPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := strings.Replace(string(content), `"result":"wrong password"`, `"result":"ok"`, 1)
+	if err := os.WriteFile(auditLogPath, []byte(forged), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifyAuditLog(auditLogPath, server.auditKey); err == nil {
+		t.Error("the changed audit log passed the verification")
+	}
+	if _, err := verifyAuditLog(auditLogPath, make([]byte, auditKeySize)); err == nil {
+		t.Error("the audit log passed the verification with another key")
+	}
+
+}
+
+func TestIntegrationLockout(t *testing.T) {
+
+	setClientDataDir(t.TempDir())
+	_, addr, _ := startTestServer(t, nil)
+
+	alice := newTestClient(t, addr, "alice")
+	alice.register("alice", "Secret123")
+	alice.send("/logout")
+	alice.expect("(anonymous) Logout successfull.")
+
+	for range maxLoginAttempts {
+		alice.send("/login alice")
+		alice.expect("Password: ")
+		alice.send("Wrong1234")
+		alice.expect("(anonymous) [Error] Invalid combiation of username and password given.")
+	}
+	alice.expect(fmt.Sprintf("(anonymous) [Error] Login failed %d times. Closing this connection...", maxLoginAttempts))
+	alice.expect("[Log] Stopping client due to server disconnection.")
+
+}
+
+func TestIntegrationBannedLogin(t *testing.T) {
+
+	setClientDataDir(t.TempDir())
+	server, addr, _ := startTestServer(t, nil)
+
+	alice := newTestClient(t, addr, "alice")
+	alice.register("alice", "Secret123")
+	alice.send("/logout")
+	alice.expect("(anonymous) Logout successfull.")
+
+	if _, err := adminBan(server, "admin", "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the password, a banned account looks like any other one
+	alice.send("/login alice")
+	alice.expect("Password: ")
+	alice.send("Wrong1234")
+	alice.expect("(anonymous) [Error] Invalid combiation of username and password given.")
+
+	alice.send("/login alice")
+	alice.expect("Password: ")
+	alice.send("Secret123")
+	alice.expect("(anonymous) [Error] Login failed because this account is banned.")
+
+}
+
+func TestIntegrationChatRequests(t *testing.T) {
+
+	setClientDataDir(t.TempDir())
+	_, addr, stop := startTestServer(t, nil)
+
+	alice := newTestClient(t, addr, "alice")
+	bob   := newTestClient(t, addr, "bob")
+	carol := newTestClient(t, addr, "carol")
+	alice.register("alice", "Secret123")
+	bob.register("bob", "Secret123")
+	carol.register("carol", "Secret123")
+
+	// Accepted request
+	alice.send("/newChat bob")
+	bob.expect("(bob) You have recieved a chat request from alice. Use '/accept' to accept that request or '/decline' to deny it.")
+	bob.send("/accept")
+	alice.expect("(alice) bob accepted your request.")
+	alice.expect("(alice) Successfully created new chat.")
+	bob.expect("(bob) Successfully created new chat.")
+
+	alice.send("/newChat bob")
+	alice.expect("(alice) [Error] Chat request aborted. This chat already exists.")
+
+	// Declined request
+	carol.send("/newChat alice")
+	alice.expect("(alice) You have recieved a chat request from carol. Use '/accept' to accept that request or '/decline' to deny it.")
+	alice.send("/decline")
+	carol.expect("(carol) alice declined your request.")
+	alice.send("/decline")
+	alice.expect("(alice) [Error] '/decline' command aborted. There is no pending requst.")
+
+	carol.send("/newChat dave")
+	carol.expect("(carol) [Error] Chat request aborted. dave is no registered user.")
+
+	// Chat messages reach the partner through the chat
+	alice.send("/chat bob")
+	alice.expect("Entered chat mode with bob. Use '/exit' to leave it.")
+	alice.expect("Devices of bob:")
+	alice.send("hello bob")
+	bob.expectSuffix(" alice: hello bob")
+
+	alice.quit()
+	bob.quit()
+	carol.quit()
+	stop()
+
+	if !fileExists(chatFilePath("alice", "bob")) {
+		t.Error("chat file of alice and bob is missing")
+	}
+	if fileExists(chatFilePath("alice", "carol")) {
+		t.Error("declined chat of alice and carol has a chat file")
+	}
+
+	records, err := readChatRecords(chatFilePath("alice", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].From != "alice" || records[0].Kind != CHAT_RECORD_MESSAGE {
+		t.Errorf("chat records are %+v, want one message of alice", records)
+	}
+
+}
+
+func TestIntegrationChatMembership(t *testing.T) {
+
+	setClientDataDir(t.TempDir())
+	_, addr, _ := startTestServer(t, nil)
+
+	alice := newTestClient(t, addr, "alice")
+	bob   := newTestClient(t, addr, "bob")
+	carol := newTestClient(t, addr, "carol")
+	alice.register("alice", "Secret123")
+	bob.register("bob", "Secret123")
+	carol.register("carol", "Secret123")
+
+	alice.send("/newChat bob")
+	bob.expect("(bob) You have recieved a chat request from alice. Use '/accept' to accept that request or '/decline' to deny it.")
+	bob.send("/accept")
+	bob.expect("(bob) Successfully created new chat.")
+
+	// carol addresses the chat of alice and bob directly
+	envelope := `{"id":"forged","chat":"` + chatID("alice", "bob") + `","to":"bob","ciphertexts":{}}`
+	if err := carol.client.sendPacket(Packet{MsgType: "MESSAGE", Payload: envelope}); err != nil {
+		t.Fatal(err)
+	}
+	carol.expect("[Error] Message not sent because you are no member of chat '" + chatID("alice", "bob") + "'. (" + CHAT_NOT_MEMBER + ")")
+	bob.expectNone("[carol] #forged carol: ")
+
+	// carol addresses bob by name, but has no chat with him
+	envelope = `{"id":"forged","to":"bob","ciphertexts":{}}`
+	if err := carol.client.sendPacket(Packet{MsgType: "MESSAGE", Payload: envelope}); err != nil {
+		t.Fatal(err)
+	}
+	carol.expect("[Error] Message not sent. There is no chat with bob. Use '/newChat bob' to request one. (" + CHAT_NOT_MEMBER + ")")
+
+	alice.send("/chat bob")
+	alice.expect("Devices of bob:")
+	alice.send("hello bob")
+	bob.expectSuffix(" alice: hello bob")
+
+	records, err := readChatRecords(chatFilePath("alice", "bob"))
+	if err != nil || len(records) != 1 {
+		t.Fatalf("chat records are %+v, %v", records, err)
+	}
+
+	// bob reuses the ID of the message of alice to edit it later
+	envelope = `{"id":"` + records[0].ID + `","chat":"` + chatID("alice", "bob") + `","to":"alice","ciphertexts":{}}`
+	if err := bob.client.sendPacket(Packet{MsgType: "MESSAGE", Payload: envelope}); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect("[Error] Message not sent because another message of the chat has the same ID. (" + CHAT_DUPLICATE_ID + ")")
+
+	// bob can not delete the message of alice
+	envelope = `{"id":"bob-delete","chat":"` + chatID("alice", "bob") + `","to":"alice","action":"` + CHAT_ACTION_DELETE + `","ref":"` + records[0].ID + `","ciphertexts":{}}`
+	if err := bob.client.sendPacket(Packet{MsgType: "MESSAGE", Payload: envelope}); err != nil {
+		t.Fatal(err)
+	}
+	bob.expect("(bob) [Error] Message not sent because the message it refers to does not exist, has disappeared or was not sent by you.")
+
+}
+
+func TestIntegrationInvalidDeviceID(t *testing.T) {
+
+	server, addr, _ := startTestServer(t, nil)
+
+	mallory, err := newLoadClient(t, addr, "mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Device IDs end up in the names of queue files
+	for _, deviceID := range []string{"../shadow", "0123456789ABCDEF", "0123:456789abcde", "0123456789abcdef0"} {
+		pwdHsh := hashPassword("Secret123")
+		if err := mallory.command(strings.Join([]string{"/register", "mallory", pwdHsh, deviceID, mallory.key}, " ")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mallory.expect("[Error] Registration failed because the ID of this device is invalid."); err != nil {
+			t.Fatal(err)
+		}
+		if err := mallory.command(strings.Join([]string{"/login", "mallory", pwdHsh, deviceID, mallory.key}, " ")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mallory.expect("[Error] Login failed because the ID of this device is invalid."); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server.muShadow.Lock()
+	defer server.muShadow.Unlock()
+	if len(server.usrPwdMap) != 0 || len(server.devices) != 0 {
+		t.Errorf("users %v and devices %v were added", server.usrPwdMap, server.devices)
+	}
+
+}
+
+func TestIntegrationInvalidDeviceKey(t *testing.T) {
+
+	server, addr, _ := startTestServer(t, nil)
+
+	alice, err := newLoadClient(t, addr, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.registerAndLogin(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second device with an invalid key is not offered for linking
+	second, err := newLoadClient(t, addr, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.command(strings.Join([]string{"/login", "alice", hashPassword("Secret123 alice"), second.deviceID, "invalid"}, " ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.expect("[Error] Login failed because the key of this device is invalid."); err != nil {
+		t.Fatal(err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.pendingLinks) != 0 {
+		t.Errorf("a device with an invalid key waits for being linked: %v", server.pendingLinks)
+	}
+
+}
+
+func TestIntegrationQuitAndShutdown(t *testing.T) {
+
+	setClientDataDir(t.TempDir())
+	server, addr, stop := startTestServer(t, nil)
+
+	alice := newTestClient(t, addr, "alice")
+	bob   := newTestClient(t, addr, "bob")
+	alice.register("alice", "Secret123")
+	bob.register("bob", "Secret123")
+
+	alice.quit()
+
+	bob.send("/online")
+	bob.expect("(bob) No other user is online right now.")
+
+	stop()
+
+	bob.expect("[Log] Stopping client due to server disconnection.")
+
+	server.mu.Lock()
+	connections := len(server.clientConns)
+	server.mu.Unlock()
+	if connections != 0 {
+		t.Errorf("%d connections are left after the shutdown", connections)
+	}
+
+	shadow, err := os.ReadFile(shadowPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The users are saved in no particular order
+	lines := strings.Split(strings.TrimSpace(string(shadow)), "\n")
+	slices.Sort(lines)
+	want  := []string{"alice:" + hashPassword("Secret123"), "bob:" + hashPassword("Secret123")}
+	if !slices.Equal(lines, want) {
+		t.Errorf("shadow file holds %q, want %q", lines, want)
+	}
+
+	// Sessions which end without '/logout' are written to the audit log as well
+	events := readAuditEvents(t, server)
+	for _, want := range []string{"logout alice: ok (disconnected)", "logout bob: ok (disconnected)"} {
+		if !slices.Contains(events, want) {
+			t.Errorf("audit events %q lack %q", events, want)
+		}
+	}
+
+}
+
+func TestVerifiedContactWithTwoDevices(t *testing.T) {
+
+	view   := &testView{output: make(chan string, 16), done: make(chan struct{})}
+	client := NewClient("", true)
+	client.view 	= view
+	client.verified = map[string][]string{"bob": {"laptop", "phone"}}
+
+	// Messages come from one device of bob at a time
+	for _, keys := range [][]string{{"laptop"}, {"phone"}, {"phone", "laptop"}} {
+		client.warnIfKeysChangedLocked("bob", keys)
+		if len(view.output) != 0 {
+			t.Errorf("keys %q of verified devices raised a warning: %q", keys, <-view.output)
+		}
+	}
+
+	client.warnIfKeysChangedLocked("bob", []string{"laptop", "tablet"})
+	if len(view.output) == 0 {
+		t.Error("the key of an unverified device raised no warning")
+	}
+
+}
+
+func TestIntegrationAdminNames(t *testing.T) {
+
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	server, addr, _ := startTestServer(t, func(s *Server) {
+		unlimitedRates(s)
+		s.adminSocket 	= socket
+		s.admins["alice"] = true
+		s.admins["root"]  = true
+
+		// alice is registered before the server starts, root is not
+		if err := os.WriteFile(shadowPath, []byte("alice:" + hashPassword("Secret123 alice") + "\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	var info os.FileInfo
+	var err error
+	for range 100 {
+		if info, err = os.Stat(socket); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("admin socket has the permissions %v, want 0600", info.Mode().Perm())
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(socket)); len(entries) != 1 {
+		t.Errorf("directory of the admin socket holds %d entries, want only the socket", len(entries))
+	}
+
+	// Registering the name of an admin who is not registered grants nothing
+	root, err := newLoadClient(t, addr, "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.registerAndLogin(); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.command("/stats"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.expect("[Error] '/stats' can only be used by admins."); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := newLoadClient(t, addr, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pwdHsh := hashPassword("Secret123 alice")
+	if err := alice.command(strings.Join([]string{"/login", "alice", pwdHsh, alice.deviceID, alice.key}, " ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.expect("Login successfull."); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.command("/stats"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.expect("Uptime: "); err != nil {
+		t.Fatal(err)
+	}
+
+	// The name of a deleted admin can not be taken over
+	if err := alice.command("/deleteAccount " + pwdHsh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.expect("Your account 'alice' has been deleted."); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.command(strings.Join([]string{"/register", "alice", pwdHsh, alice.deviceID, alice.key}, " ")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.expect("[Error] Registration failed because this username is reserved."); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.command("/rename alice " + hashPassword("Secret123 root")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.expect("[Error] Renaming aborted because this username is reserved."); err != nil {
+		t.Fatal(err)
+	}
+
+	server.muShadow.Lock()
+	defer server.muShadow.Unlock()
+	if _, exists := server.usrPwdMap["alice"]; exists {
+		t.Error("the name of the deleted admin was registered again")
+	}
+
+}
+
+func TestIntegrationRateLimits(t *testing.T) {
+
+	_, addr, _ := startTestServer(t, func(s *Server) {
+		s.chatRequestLimit = RateLimit{Burst: 1, Interval: time.Hour}
+		s.packetLimit 	   = RateLimit{Burst: 8, Interval: 100 * time.Millisecond}
+		s.sessionPolicy    = SESSION_MULTI
+	})
+
+	alice, err := newLoadClient(t, addr, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := newLoadClient(t, addr, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*loadClient{alice, bob} {
+		if err := client.registerAndLogin(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := alice.command("/newChat bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.expect("You have recieved a chat request from alice."); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new name does not bring new chat requests
+	if err := alice.command("/rename carol " + hashPassword("Secret123 alice")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.expect("Your username has been changed from 'alice' to 'carol'."); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.command("/newChat bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.expect("[Error] You are sending too many chat requests."); err != nil {
+		t.Fatal(err)
+	}
+
+	// Packets of every type beyond the packet limit are read more slowly,
+	// but none of them is dropped
+	started := time.Now()
+	for range 10 {
+		if err := writePacket(alice.conn, Packet{MsgType: "RECEIPT", Payload: "{}"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.command("/online"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.expect("Users online: bob"); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(started); took < 500 * time.Millisecond {
+		t.Errorf("11 packets were read within %s, want them to be slowed down by the packet limit", took)
+	}
+
+	// Neither reconnecting nor a second session bring new chat requests
+	alice.conn.Close()
+	<-alice.closed
+	var sessions []*loadClient
+	for range 2 {
+		session, err := newLoadClient(t, addr, "carol")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.deviceID, session.key = alice.deviceID, alice.key
+		if err := session.command(strings.Join([]string{"/login", "carol", hashPassword("Secret123 alice"), session.deviceID, session.key}, " ")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := session.expect("Login successfull."); err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, session)
+	}
+	for _, session := range sessions {
+		if err := session.command("/newChat bob"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := session.expect("[Error] You are sending too many chat requests."); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+}
+
+func TestIntegrationBlockedSenderGetsReceipt(t *testing.T) {
+
+	_, addr, _ := startTestServer(t, unlimitedRates)
+
+	alice, err := newLoadClient(t, addr, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := newLoadClient(t, addr, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, client := range []*loadClient{alice, bob} {
+		if err := client.registerAndLogin(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := alice.openChat(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.command("/block alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.expect("alice has been blocked."); err != nil {
+		t.Fatal(err)
+	}
+
+	// The message is dropped, but alice can not tell it apart from a
+	// delivered one
+	if _, err := alice.sendMessages(bob, 1); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := readChatRecords(chatFilePath("alice", "bob")); err != nil || len(records) != 0 {
+		t.Errorf("chat records are %+v, %v, want the message of a blocked user dropped", records, err)
+	}
+
+}
+
+func TestPurgeExpiredOnlyRewritesDueFiles(t *testing.T) {
+
+	setServerDataDir(t.TempDir())
+	server := NewServer("127.0.0.1:0")
+	now := time.Now()
+
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	if err := os.MkdirAll(serverChatDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	timed := []ChatRecord{
+		{Kind: CHAT_RECORD_MESSAGE, ID: "gone", From: "alice", Time: now, Expires: now.Add(time.Minute)},
+		{Kind: CHAT_RECORD_MESSAGE, ID: "kept", From: "bob", Time: now},
+	}
+	if err := writeChatRecords(chatFilePath("alice", "bob"), timed); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeChatRecords(chatFilePath("alice", "carol"), timed[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if !server.loadChatIDs() {
+		t.Fatal("loading chat IDs failed")
+	}
+
+	delivery, err := json.Marshal(ChatDelivery{ID: "gone", Expires: now.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.queuePacketLocked("bob", "0123456789abcdef", Packet{MsgType: "CHAT", Payload: string(delivery)})
+	server.queuePacketLocked("bob", "0123456789abcdef", Packet{MsgType: "MESSAGE", Payload: "kept"})
+	server.queuePacketLocked("carol", "0123456789abcdef", Packet{MsgType: "MESSAGE", Payload: "kept"})
+
+	files := []string{chatFilePath("alice", "bob"), chatFilePath("alice", "carol"), serverQueueDir + "bob/0123456789abcdef", serverQueueDir + "carol/0123456789abcdef"}
+	stat := func() []os.FileInfo {
+		var infos []os.FileInfo
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			infos = append(infos, info)
+		}
+		return infos
+	}
+
+	// Nothing is due yet, so no file is written
+	before := stat()
+	server.purgeExpiredLocked(now)
+	for i, info := range stat() {
+		if !os.SameFile(before[i], info) {
+			t.Errorf("%s was rewritten although nothing expired", files[i])
+		}
+	}
+
+	// Only the files holding the expired message are written
+	server.purgeExpiredLocked(now.Add(2 * time.Minute))
+	after := stat()
+	for i, rewritten := range []bool{true, false, true, false} {
+		if os.SameFile(before[i], after[i]) == rewritten {
+			t.Errorf("%s was rewritten: %v, want %v", files[i], !rewritten, rewritten)
+		}
+	}
+	if records, err := readChatRecords(chatFilePath("alice", "bob")); err != nil || len(records) != 1 || records[0].ID != "kept" {
+		t.Errorf("chat records are %+v, %v, want only the message which does not expire", records, err)
+	}
+	if index := server.chatIndexes[chatFilePath("alice", "bob")]; index.taken("gone") || !index.nextExpiry.IsZero() {
+		t.Errorf("the index still holds the expired message: %+v", index)
+	}
+	if queue := server.queues[files[2]]; queue.packets != 1 || !queue.nextExpiry.IsZero() {
+		t.Errorf("queue holds %d packets expiring at %v, want 1 which does not expire", queue.packets, queue.nextExpiry)
+	}
+
+}
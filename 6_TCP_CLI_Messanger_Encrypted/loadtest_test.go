@@ -0,0 +1,482 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The load test drives an in-process server with scripted clients which
+// speak the protocol directly: they register, log in, open a chat with a
+// partner and exchange chat messages, each client waiting for the
+// "delivered" receipt of a message before sending the next one. It
+// reports the throughput, the percentiles of the time from sending a
+// message to its receipt and the memory used. The scripted clients run in
+// the same process, so the memory includes theirs.
+//
+//	go test -run TestServerLoad -v -load.clients 2000 -load.messages 50
+//	go test -run '^$' -bench ServerMessages -benchmem
+
+var (
+	loadClients  = flag.Int("load.clients", 20, "number of scripted clients of TestServerLoad, rounded up to pairs")
+	loadMessages = flag.Int("load.messages", 10, "chat messages every scripted client of TestServerLoad sends")
+	loadTimeout  = flag.Duration("load.timeout", 30*time.Second, "how long a scripted client waits for an answer of the server")
+)
+
+// loadClient is a scripted client which speaks the protocol of the server
+// directly.
+type loadClient struct {
+	name 	 string
+	deviceID string
+	key 	 string
+	conn 	 net.Conn
+	messages chan string 	// Payloads of "MESSAGE" packets
+	receipts chan string 	// IDs of delivered chat messages
+	closed 	 chan struct{} 	// Closed once the server closed the connection
+}
+
+// newLoadClient connects a scripted client to the server at the given
+// address. It is disconnected when the test ends.
+//
+// Parameters:
+//	tb - the test or benchmark
+//	addr - the address of the server
+//	name - the username of the client
+func newLoadClient(tb testing.TB, addr string, name string) (*loadClient, error) {
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return startLoadClient(tb, conn, name)
+
+}
+
+// startLoadClient starts a scripted client on the given connection to the
+// server. It is disconnected when the test ends.
+//
+// Parameters:
+//	tb - the test or benchmark
+//	conn - the connection to the server
+//	name - the username of the client
+func startLoadClient(tb testing.TB, conn net.Conn, name string) (*loadClient, error) {
+
+	tb.Cleanup(func() { conn.Close() })
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	rawID := make([]byte, deviceIDBytes)
+	rand.Read(rawID)
+	device := &Device{id: hex.EncodeToString(rawID), key: key}
+
+	lc := &loadClient{
+		name: 	  name,
+		deviceID: device.id,
+		key: 	  device.publicKey(),
+		conn: 	  conn,
+		messages: make(chan string, 256),
+		receipts: make(chan string, 256),
+		closed:   make(chan struct{}),
+	}
+	go lc.read()
+	return lc, nil
+
+}
+
+// read passes the packets of the server on to the channels of the client
+// until the connection is closed. The server blocks while writing to a
+// client, so packets nobody waits for are dropped instead of blocking.
+func (lc *loadClient) read() {
+
+	defer close(lc.closed)
+
+	for {
+
+		packet, err := readPacket(lc.conn)
+		if err != nil {
+			return
+		}
+
+		switch packet.MsgType {
+		case "MESSAGE":
+			select {
+			case lc.messages <- packet.Payload:
+			default:
+			}
+		case "RECEIPT":
+			var receipt Receipt
+			if json.Unmarshal([]byte(packet.Payload), &receipt) != nil || receipt.Status != MESSAGE_DELIVERED {
+				continue
+			}
+			for _, id := range receipt.IDs {
+				select {
+				case lc.receipts <- id:
+				default:
+				}
+			}
+		}
+
+	}
+
+}
+
+// command sends the given command to the server.
+//
+// Parameters:
+//	command - the command with its arguments
+func (lc *loadClient) command(command string) error {
+
+	return writePacket(lc.conn, Packet{MsgType: "MESSAGE", Payload: command})
+
+}
+
+// expect waits for a message of the server which contains the given text
+// and skips every other message.
+// Returns the message or an error if none arrives in time.
+//
+// Parameters:
+//	text - the text the message has to contain
+func (lc *loadClient) expect(text string) (string, error) {
+
+	timeout := time.After(*loadTimeout)
+	for {
+		select {
+		case message := <-lc.messages:
+			if strings.Contains(message, text) {
+				return message, nil
+			}
+		case <-lc.closed:
+			return "", fmt.Errorf("%s: connection closed while waiting for %q", lc.name, text)
+		case <-timeout:
+			return "", fmt.Errorf("%s: no message containing %q", lc.name, text)
+		}
+	}
+
+}
+
+// registerAndLogin registers the user of the client and logs in.
+func (lc *loadClient) registerAndLogin() error {
+
+	pwdHsh := hashPassword("Secret123 " + lc.name)
+
+	if err := lc.command(strings.Join([]string{"/register", lc.name, pwdHsh, lc.deviceID, lc.key}, " ")); err != nil {
+		return err
+	}
+	if _, err := lc.expect("A new user has been added: " + lc.name); err != nil {
+		return err
+	}
+
+	if err := lc.command(strings.Join([]string{"/login", lc.name, pwdHsh, lc.deviceID, lc.key}, " ")); err != nil {
+		return err
+	}
+	_, err := lc.expect("Login successfull.")
+	return err
+
+}
+
+// openChat requests a chat with the given partner, who accepts it.
+//
+// Parameters:
+//	partner - the client to open the chat with
+func (lc *loadClient) openChat(partner *loadClient) error {
+
+	if err := lc.command("/newChat " + partner.name); err != nil {
+		return err
+	}
+	if _, err := partner.expect("You have recieved a chat request from " + lc.name); err != nil {
+		return err
+	}
+	if err := partner.command("/accept"); err != nil {
+		return err
+	}
+	if _, err := partner.expect("Successfully created new chat."); err != nil {
+		return err
+	}
+	_, err := lc.expect("Successfully created new chat.")
+	return err
+
+}
+
+// sendMessages sends the given number of chat messages to the partner,
+// each after the receipt of the one before arrived.
+// Returns the time from sending every message to its receipt.
+//
+// Parameters:
+//	partner - the client the messages are sent to
+//	count - how many messages are sent
+func (lc *loadClient) sendMessages(partner *loadClient, count int) ([]time.Duration, error) {
+
+	latencies := make([]time.Duration, 0, count)
+	for i := range count {
+
+		envelope := ChatEnvelope{
+			ID: 		 fmt.Sprintf("%s-%d", lc.name, i),
+			Chat: 		 chatID(lc.name, partner.name),
+			To: 		 partner.name,
+			Ciphertexts: map[string]string{partner.deviceID: "load test message"},
+		}
+		jsonData, err := json.Marshal(envelope)
+		if err != nil {
+			return latencies, err
+		}
+
+		sent := time.Now()
+		if err := writePacket(lc.conn, Packet{MsgType: "MESSAGE", Payload: string(jsonData)}); err != nil {
+			return latencies, err
+		}
+		if err := lc.awaitReceipt(envelope.ID); err != nil {
+			return latencies, err
+		}
+		latencies = append(latencies, time.Since(sent))
+
+	}
+	return latencies, nil
+
+}
+
+// awaitReceipt waits for the "delivered" receipt of the given message.
+//
+// Parameters:
+//	id - the ID of the message
+func (lc *loadClient) awaitReceipt(id string) error {
+
+	timeout := time.After(*loadTimeout)
+	for {
+		select {
+		case receiptID := <-lc.receipts:
+			if receiptID == id {
+				return nil
+			}
+		case <-lc.closed:
+			return fmt.Errorf("%s: connection closed while waiting for the receipt of %s", lc.name, id)
+		case <-timeout:
+			return fmt.Errorf("%s: no receipt for %s", lc.name, id)
+		}
+	}
+
+}
+
+// loadReport is the result of a load run.
+type loadReport struct {
+	clients 	int
+	setup 		time.Duration 	// Connecting, registering, logging in and opening the chats
+	messaging 	time.Duration
+	latencies 	[]time.Duration // Sorted
+	heapBefore 	uint64
+	heapAfter 	uint64 			// After the clients logged in and opened their chats
+	sys 		uint64
+	goroutines 	int
+}
+
+// percentile returns the latency below which the given share of the
+// messages got their receipt.
+//
+// Parameters:
+//	share - the share between 0 and 1
+func (r *loadReport) percentile(share float64) time.Duration {
+
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	return r.latencies[min(len(r.latencies) - 1, int(share * float64(len(r.latencies))))]
+
+}
+
+// throughput returns the chat messages routed per second.
+func (r *loadReport) throughput() float64 {
+
+	return float64(len(r.latencies)) / r.messaging.Seconds()
+
+}
+
+// runPairs runs the given step for every pair of clients concurrently.
+// Returns the first error of a step.
+//
+// Parameters:
+//	clients - the clients, every even one paired with the one after it
+//	step - what every pair does
+func runPairs(clients []*loadClient, step func(a *loadClient, b *loadClient) error) error {
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(clients) / 2)
+	for i := 0; i + 1 < len(clients); i += 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i / 2] = step(clients[i], clients[i + 1])
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+
+}
+
+// setUpLoadClients connects the given number of scripted clients, rounded
+// up to pairs, registers and logs them in and opens a chat for every
+// pair.
+//
+// Parameters:
+//	tb - the test or benchmark
+//	addr - the address of the server
+//	count - the number of clients
+func setUpLoadClients(tb testing.TB, addr string, count int) []*loadClient {
+
+	tb.Helper()
+
+	clients := make([]*loadClient, count + count % 2)
+	for i := range clients {
+		client, err := newLoadClient(tb, addr, fmt.Sprintf("load%05d", i))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		clients[i] = client
+	}
+
+	err := runPairs(clients, func(a *loadClient, b *loadClient) error {
+		return errors.Join(a.registerAndLogin(), b.registerAndLogin())
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if err := runPairs(clients, (*loadClient).openChat); err != nil {
+		tb.Fatal(err)
+	}
+	return clients
+
+}
+
+// unlimitedRates lets the scripted clients send as fast as they can.
+func unlimitedRates(s *Server) {
+
+	s.chatRequestLimit = RateLimit{Burst: 1 << 30, Interval: time.Nanosecond}
+	s.messageLimit 	   = RateLimit{Burst: 1 << 30, Interval: time.Nanosecond}
+	s.packetLimit 	   = RateLimit{Burst: 1 << 30, Interval: time.Nanosecond}
+
+}
+
+// runLoad sets up the scripted clients and lets every one of them send
+// the given number of messages to its partner.
+//
+// Parameters:
+//	tb - the test or benchmark
+//	count - the number of clients
+//	messages - the messages every client sends
+func runLoad(tb testing.TB, count int, messages int) *loadReport {
+
+	tb.Helper()
+
+	_, addr, _ := startTestServer(tb, unlimitedRates)
+
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	report := &loadReport{heapBefore: mem.HeapAlloc}
+
+	started := time.Now()
+	clients := setUpLoadClients(tb, addr, count)
+	report.clients = len(clients)
+	report.setup   = time.Since(started)
+
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	report.heapAfter  = mem.HeapAlloc
+	report.sys 		  = mem.Sys
+	report.goroutines = runtime.NumGoroutine()
+
+	var mu sync.Mutex
+	started = time.Now()
+	err := runPairs(clients, func(a *loadClient, b *loadClient) error {
+		errCh := make(chan error, 1)
+		go func() {
+			latencies, err := b.sendMessages(a, messages)
+			mu.Lock()
+			report.latencies = append(report.latencies, latencies...)
+			mu.Unlock()
+			errCh <- err
+		}()
+		latencies, err := a.sendMessages(b, messages)
+		mu.Lock()
+		report.latencies = append(report.latencies, latencies...)
+		mu.Unlock()
+		return errors.Join(err, <-errCh)
+	})
+	report.messaging = time.Since(started)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	slices.Sort(report.latencies)
+	return report
+
+}
+
+func TestServerLoad(t *testing.T) {
+
+	if testing.Short() && *loadClients > 20 {
+		t.Skip("large load runs are skipped in short mode")
+	}
+
+	report := runLoad(t, *loadClients, *loadMessages)
+
+	if want := report.clients * *loadMessages; len(report.latencies) != want {
+		t.Fatalf("%d messages got a receipt, want %d", len(report.latencies), want)
+	}
+
+	const mib = 1 << 20
+	t.Logf("clients: %d, set up in %s (%.0f logins/s)", report.clients, report.setup.Round(time.Millisecond), float64(report.clients) / report.setup.Seconds())
+	t.Logf("messages: %d in %s, %.0f messages/s", len(report.latencies), report.messaging.Round(time.Millisecond), report.throughput())
+	t.Logf("latency: p50 %s, p90 %s, p99 %s, max %s",
+		report.percentile(0.5), report.percentile(0.9), report.percentile(0.99), report.latencies[len(report.latencies) - 1])
+	t.Logf("memory: heap %.1f MiB (%.1f KiB per client, server and scripted client together), %.1f MiB from the OS, %d goroutines",
+		float64(report.heapAfter) / mib, float64(report.heapAfter - min(report.heapBefore, report.heapAfter)) / 1024 / float64(report.clients),
+		float64(report.sys) / mib, report.goroutines)
+
+}
+
+func BenchmarkServerMessages(b *testing.B) {
+
+	_, addr, _ := startTestServer(b, unlimitedRates)
+	clients := setUpLoadClients(b, addr, 100)
+
+	// Every pair sends its share of the messages back and forth
+	pairs := len(clients) / 2
+	b.ResetTimer()
+
+	var mu sync.Mutex
+	var latencies []time.Duration
+	err := runPairs(clients, func(a *loadClient, c *loadClient) error {
+		share := b.N / pairs
+		if a == clients[0] {
+			share += b.N % pairs
+		}
+		pairLatencies, err := a.sendMessages(c, share)
+		mu.Lock()
+		latencies = append(latencies, pairLatencies...)
+		mu.Unlock()
+		return err
+	})
+	b.StopTimer()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	report := &loadReport{latencies: latencies}
+	slices.Sort(report.latencies)
+	b.ReportMetric(float64(report.percentile(0.5).Microseconds()), "p50-µs")
+	b.ReportMetric(float64(report.percentile(0.99).Microseconds()), "p99-µs")
+
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+)
+
+// The server logs with the default logger of log/slog, either as text or
+// as one json object per line. Every line of a connection carries the
+// remote address, a random session ID and the user logged in on it, so
+// everything a connection did can be found by its session ID.
+// Credentials and chat messages are never logged: commands are only
+// logged by their name and the logger redacts the values of sensitive
+// attributes and cuts every command which slips into an attribute down
+// to its name, so a password hash can not leak by accident.
+
+// Formats of the log output.
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+// redacted replaces the values of sensitive attributes.
+const redacted = "[REDACTED]"
+
+// sensitiveLogKeys are the attributes whose values are never logged.
+var sensitiveLogKeys = map[string]bool{
+	"password": true,
+	"hash": 	true,
+	"salt": 	true,
+	"key": 		true,
+	"code": 	true,
+	"payload":  true,
+	"text": 	true,
+}
+
+var logLevelNames = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// parseLogLevel converts the name of a log level ("debug", "info", "warn"
+// or "error") into the respective slog.Level.
+// Returns an error if the name is unknown.
+func parseLogLevel(name string) (slog.Level, error) {
+
+	level, ok := logLevelNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return slog.LevelInfo, fmt.Errorf("unknown log level '%s'", name)
+	}
+	return level, nil
+
+}
+
+// newLogger returns a logger which writes the lines of at least the given
+// level in the given format and redacts sensitive attributes.
+// Returns an error if the format is unknown.
+//
+// Parameters:
+//	w - where the log lines are written to
+//	level - the least level of the logged lines
+//	format - LOG_FORMAT_TEXT or LOG_FORMAT_JSON
+func newLogger(w io.Writer, level slog.Level, format string) (*slog.Logger, error) {
+
+	options := &slog.HandlerOptions{
+		Level: 		 level,
+		ReplaceAttr: redactAttr,
+	}
+
+	switch strings.ToLower(format) {
+	case LOG_FORMAT_TEXT, "":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format '%s', expected '%s' or '%s'", format, LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+
+}
+
+// redactAttr replaces the value of sensitive attributes and cuts commands
+// down to their name before an attribute is written.
+//
+// Parameters:
+//	groups - the groups the attribute is in
+//	attr - the attribute to write
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+
+	if sensitiveLogKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+
+	if attr.Value.Kind() == slog.KindString {
+		value := attr.Value.String()
+		if strings.HasPrefix(value, "/") && strings.ContainsAny(value, " \t\n") {
+			return slog.String(attr.Key, strings.Fields(value)[0] + " " + redacted)
+		}
+	}
+	return attr
+
+}
+
+// newSessionID returns a random ID which tells the log lines of a
+// connection apart from those of other connections.
+func newSessionID() string {
+
+	rawID := make([]byte, 6)
+	if _, err := rand.Read(rawID); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(rawID)
+
+}
+
+// connLogger returns a logger for the given connection, which adds its
+// remote address and the given session ID to every line.
+//
+// Parameters:
+//	conn - the connection to log for
+//	session - the session ID of the connection
+func connLogger(conn net.Conn, session string) *slog.Logger {
+
+	return slog.Default().With("remote", conn.RemoteAddr().String(), "session", session)
+
+}
+
+// connLog returns the logger of the given connection, or a logger with
+// just its remote address if the connection is gone already.
+//
+// Parameters:
+//	conn - the connection to log for
+func (s *Server) connLog(conn net.Conn) *slog.Logger {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connLogLocked(conn)
+
+}
+
+// connLogLocked works like connLog.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	conn - the connection to log for
+func (s *Server) connLogLocked(conn net.Conn) *slog.Logger {
+
+	if client, ok := s.clientConns[conn]; ok {
+		return client.log
+	}
+	return slog.Default().With("remote", conn.RemoteAddr().String())
+
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 )
@@ -9,25 +11,83 @@ import (
 var server Server
 
 
-func startServer(port string) {
+func startServer(cfg Config) {
 
 	fmt.Println("Starting server...")
-	listenAddr := ":" + port
-	server := NewServer(listenAddr)
+	server, err := newServerFromConfig(cfg)
+	if err != nil {
+		fmt.Println("[Error] Invalid server settings:", err)
+		os.Exit(1)
+	}
 	server.Start()
 
 }
 
-func startClient(serverAddr string) {
+func startClient(cfg Config) {
 
 	fmt.Println("Starting client...")
-	client := NewClient(serverAddr)
+	client, err := newClientFromConfig(cfg)
+	if err != nil {
+		fmt.Println("[Error] Invalid client settings:", err)
+		os.Exit(1)
+	}
 	client.connectToServer()
 
 }
 
 func main() {
 
+	cfg, err := loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Println("[Error]", err)
+		os.Exit(2)
+	}
+
+	// Without a mode from the flags or the config file the settings are
+	// asked for interactively
+	if cfg.Mode == "" && !runSetup(&cfg) {
+		return
+	}
+
+	switch cfg.Mode {
+	case MODE_SERVER:
+		startServer(cfg)
+	case MODE_CLIENT:
+		startClient(cfg)
+	case MODE_ADMIN:
+		if cfg.AdminSocket == "" {
+			fmt.Println("[Error] The admin console needs the admin socket of the server, use '-admin-socket'")
+			os.Exit(2)
+		}
+		runAdminConsole(cfg.AdminSocket)
+	case MODE_VERIFY_AUDIT:
+		if cfg.DataDir != "" {
+			setServerDataDir(cfg.DataDir)
+		}
+		keyPath, err := auditKeyPathOf(cfg)
+		if err != nil {
+			fmt.Println("[Error]", err)
+			os.Exit(2)
+		}
+		if !runAuditVerifier(keyPath) {
+			os.Exit(1)
+		}
+	}
+
+}
+
+// runSetup asks for the mode and the most important settings on stdin.
+// Settings which are left empty keep the values of the flags and the
+// config file.
+// Returns false if the input ended before the setup was completed.
+//
+// Parameters:
+//	cfg - the config the answers are written to
+func runSetup(cfg *Config) bool {
+
 	fmt.Println("CLI E2EE Messanger")
 	fmt.Println("This applicatoin can either be started as a server or a client. Choose by typing either 's' for Server or 'c' for client:")
 	scanner := bufio.NewScanner(os.Stdin)
@@ -42,7 +102,7 @@ func main() {
 			} else {
 				fmt.Println("Input ended. (EOF)")
 			}
-			return
+			return false
 		}
 
 		input = scanner.Text()
@@ -66,7 +126,7 @@ func main() {
 				} else {
 					fmt.Println("Input ended. (EOF)")
 				}
-				return
+				return false
 			}
 
 			port = scanner.Text()
@@ -78,8 +138,62 @@ func main() {
 
 		}
 
-		startServer(port)
-		
+		fmt.Println("\nServer setup:\nEnter how to handle a login as a user who is already logged in on another connection. 'reject' refuses the login, 'takeover' logs out the old session and 'multi' keeps all sessions. Leave empty for the default:")
+		for {
+
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					fmt.Println("Error reading from stdin:", err)
+				} else {
+					fmt.Println("Input ended. (EOF)")
+				}
+				return false
+			}
+
+			input := scanner.Text()
+			if input == "" {
+				break
+			}
+
+			if _, err := parseSessionPolicy(input); err == nil {
+				cfg.SessionPolicy = input
+				break
+			}
+
+			fmt.Println("Received wrong input. Please enter either 'reject', 'takeover' or 'multi':")
+
+		}
+
+		fmt.Printf("\nServer setup:\nEnter the minimum strength of new passwords as '<minLength> <minClasses>', where the classes are lower case letters, upper case letters, digits and other characters. The policy is checked by the clients only. Leave empty for the default (%d %d):\n", defaultMinPasswordLength, defaultMinPasswordClasses)
+		for {
+
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					fmt.Println("Error reading from stdin:", err)
+				} else {
+					fmt.Println("Input ended. (EOF)")
+				}
+				return false
+			}
+
+			input := scanner.Text()
+			if input == "" {
+				break
+			}
+
+			_, err := parsePasswordPolicy(input)
+			if err == nil {
+				cfg.PasswordPolicy = input
+				break
+			}
+
+			fmt.Printf("Received wrong input: %s. Please enter the minimum length and the number of character classes, e.g. '10 3':\n", err)
+
+		}
+
+		cfg.Mode   = MODE_SERVER
+		cfg.Listen = ":" + port
+
 	case "c", "C":
 		fmt.Println("\nClient setup:\nEnter the IP address of the server to connect to:")
 		var ip string
@@ -91,7 +205,7 @@ func main() {
 				} else {
 					fmt.Println("Input ended. (EOF)")
 				}
-				return
+				return false
 			}
 			ip = scanner.Text()
 
@@ -113,7 +227,7 @@ func main() {
 				} else {
 					fmt.Println("Input ended. (EOF)")
 				}
-				return
+				return false
 			}
 			port = scanner.Text()
 
@@ -125,9 +239,11 @@ func main() {
 
 		}
 
-		serverAddr := ip + ":" + port
-		startClient(serverAddr)
+		cfg.Mode   = MODE_CLIENT
+		cfg.Server = ip + ":" + port
 
 	}
 
+	return true
+
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Chat messages are shown with the first characters of their ID, e.g.
+// '#3fa2c1 alice: hi', which '/edit', '/delete' and '/reply' take to refer
+// to a message. Edits and deletions are chat messages of their own, which
+// are encrypted like every other message and refer to the changed message.
+
+// shortIDLength is the number of characters of a message ID which are
+// shown.
+const shortIDLength = 6
+
+// replySnippetLength is the number of characters of a message which are
+// shown next to the replies to it.
+const replySnippetLength = 30
+
+// ChatMessage is a chat message this client has sent or received.
+type ChatMessage struct {
+	partner string
+	from 	string
+	text 	string
+}
+
+// shortID returns the part of the given message ID which is shown.
+func shortID(id string) string {
+
+	return "#" + id[:min(len(id), shortIDLength)]
+
+}
+
+// chatMessageLine returns the line a chat message is shown as.
+//
+// Parameters:
+//	id - the ID of the message, empty for messages without one
+//	from - the sender of the message
+//	text - the chat message
+func chatMessageLine(id string, from string, text string) string {
+
+	if id == "" {
+		return from + ": " + text
+	}
+	return shortID(id) + " " + from + ": " + text
+
+}
+
+// rememberMessageLocked keeps the given chat message, so it can be edited,
+// deleted or replied to. A later message reusing the ID of a known one
+// does not replace it.
+// The function assumes that the c.mu Mutex is locked.
+func (c *Client) rememberMessageLocked(id string, partner string, from string, text string) {
+
+	if _, known := c.messages[id]; known || id == "" {
+		return
+	}
+	c.messages[id] = &ChatMessage{partner: partner, from: from, text: text}
+
+}
+
+// findMessageLocked returns the message of the open chat whose ID starts
+// with the given prefix.
+// Returns the full ID along with the message.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	prefix - the shown ID of the message, with or without the leading '#'
+func (c *Client) findMessageLocked(prefix string) (string, *ChatMessage, error) {
+
+	if c.activeChat == "" {
+		return "", nil, errors.New("you are not in chat mode. Use '/chat <username>' to enter it.")
+	}
+
+	prefix = strings.TrimPrefix(prefix, "#")
+	if prefix == "" {
+		return "", nil, errors.New("please give the ID of the message as shown in front of it, e.g. '#3fa2c1'.")
+	}
+
+	var foundID string
+	var found *ChatMessage
+	for id, message := range c.messages {
+
+		if message.partner != c.activeChat || !strings.HasPrefix(id, prefix) {
+			continue
+		}
+		if found != nil {
+			return "", nil, errors.New("'#" + prefix + "' refers to more than one message. Please give more characters of the ID.")
+		}
+		foundID, found = id, message
+
+	}
+
+	if found == nil {
+		return "", nil, errors.New("there is no message '#" + prefix + "' in the chat with " + c.activeChat + ".")
+	}
+	return foundID, found, nil
+
+}
+
+// replySuffixLocked returns the text shown behind a reply to the message
+// with the given ID.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	ref - the ID of the message replied to, empty if the message is no reply
+func (c *Client) replySuffixLocked(ref string) string {
+
+	if ref == "" {
+		return ""
+	}
+
+	message, ok := c.messages[ref]
+	if !ok {
+		return " (reply to " + shortID(ref) + ")"
+	}
+
+	snippet := []rune(message.text)
+	if len(snippet) > replySnippetLength {
+		snippet = append(snippet[:replySnippetLength], []rune("...")...)
+	}
+	return fmt.Sprintf(" (reply to %s %s: %s)", shortID(ref), message.from, string(snippet))
+
+}
+
+// sendChatActionLocked encrypts an edit or the deletion of one of the own
+// messages for the open chat and sends it to the server.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	action - CHAT_ACTION_EDIT or CHAT_ACTION_DELETE
+//	ref - the ID of the changed message
+//	text - the new text of an edited message, empty for deletions
+func (c *Client) sendChatActionLocked(action string, ref string, text string) error {
+
+	envelope, err := c.encryptForChatLocked(ChatEnvelope{To: c.activeChat, Action: action, Ref: ref}, []byte(text))
+	if err != nil {
+		return err
+	}
+	return c.sendPacket(Packet{MsgType: "MESSAGE", Payload: envelope})
+
+}
+
+// isChangeOfOwnMessageLocked reports whether the message with the given ID
+// is known to this client as a message of the given chat sent by the given
+// user. IDs are chosen by the clients, so an edit or deletion may refer to
+// the message of another user with the same ID, which must not be changed.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	partner - the user the chat of the message is with
+//	id - the ID of the changed message
+//	from - the sender of the edit or deletion
+func (c *Client) isChangeOfOwnMessageLocked(partner string, id string, from string) bool {
+
+	if message, ok := c.messages[id]; ok {
+		return message.partner == partner && message.from == from
+	}
+	if c.history != nil {
+		if entry, ok := c.history.find(id); ok {
+			return entry.Chat == partner && entry.From == from
+		}
+	}
+	return false
+
+}
+
+// applyEditLocked shows the new text of an edited message in place of the
+// old one and updates the chat history. Edits of messages which were not
+// sent by the editor are ignored.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	partner - the user the chat of the message is with
+//	id - the ID of the edited message
+//	from - the sender of the message
+//	text - the new text of the message
+func (c *Client) applyEditLocked(partner string, id string, from string, text string) {
+
+	if !c.isChangeOfOwnMessageLocked(partner, id, from) {
+		return
+	}
+
+	oldText := ""
+	if message, ok := c.messages[id]; ok {
+		oldText 	 = message.text
+		message.text = text
+	}
+	if sent, ok := c.sent[id]; ok {
+		sent.text = text
+	}
+
+	c.view.ReplaceMessage(partner, id, from, oldText, chatMessageLine(id, from, text) + " (edited)")
+
+	if c.history != nil {
+		err := c.history.edit(id, from, text)
+		if err != nil {
+			c.view.Println("[Error] Editing message in the chat history failed:", err)
+		}
+	}
+
+}
+
+// applyDeleteLocked replaces a deleted message with a note and removes it
+// from the chat history. Deletions of messages which were not sent by the
+// deleter are ignored.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	partner - the user the chat of the message is with
+//	id - the ID of the deleted message
+//	from - the sender of the message
+func (c *Client) applyDeleteLocked(partner string, id string, from string) {
+
+	if !c.isChangeOfOwnMessageLocked(partner, id, from) {
+		return
+	}
+
+	oldText := ""
+	if message, ok := c.messages[id]; ok {
+		oldText = message.text
+	}
+	delete(c.messages, id)
+	delete(c.sent, id)
+
+	c.view.ReplaceMessage(partner, id, from, oldText, shortID(id) + " " + from + " deleted this message.")
+
+	if c.history != nil {
+		err := c.history.remove(id, from)
+		if err != nil {
+			c.view.Println("[Error] Removing message from the chat history failed:", err)
+		}
+	}
+
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The server counts what happens on it and, if a metrics address is
+// given, serves the counters along with gauges of its current load on
+// '/metrics' in the text format of Prometheus. The counters are updated
+// with atomics by the goroutines which do the work, the gauges are
+// collected whenever the endpoint is scraped. The endpoint is not
+// authenticated, so it only listens on a loopback address unless other
+// addresses are allowed explicitly.
+
+// latencyBuckets are the upper bounds in seconds of the buckets of the
+// handler latency histograms.
+var latencyBuckets = [...]float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// packetHandlerNames are the packets which are handled without being a
+// command.
+var packetHandlerNames = [...]string{"MESSAGE", "FILE", "RECEIPT", "SIGNAL"}
+
+// HandlerStats counts how often a command or packet was received and how
+// long handling it took.
+type HandlerStats struct {
+	received atomic.Int64 						// Received, including the ones refused by a rate limit
+	handled  atomic.Int64
+	nanos 	 atomic.Int64 						// Time spent handling, summed up
+	buckets  [len(latencyBuckets)]atomic.Int64 // Handled within the respective latency bucket, not cumulative
+}
+
+// observe records that handling took the given time.
+//
+// Parameters:
+//	took - how long handling took
+func (hs *HandlerStats) observe(took time.Duration) {
+
+	hs.handled.Add(1)
+	hs.nanos.Add(int64(took))
+	for i, bound := range latencyBuckets {
+		if took.Seconds() <= bound {
+			hs.buckets[i].Add(1)
+			return
+		}
+	}
+
+}
+
+// ServerStats counts what happened since the server started. The counters
+// are updated by several goroutines.
+type ServerStats struct {
+	connections  	atomic.Int64 // Connections accepted
+	packets 	 	atomic.Int64 // Packets received from clients
+	chatMessages 	atomic.Int64 // Chat messages routed to the devices of their recipients
+	failedLogins 	atomic.Int64 // Logins refused for wrong credentials, a ban or a wrong device key
+	invalidCommands atomic.Int64 // Commands which do not exist
+	bytesIn 	 	atomic.Int64 // Bytes read from clients
+	bytesOut 	 	atomic.Int64 // Bytes written to clients
+	dispatchQueue 	atomic.Int64 // Packets read and waiting to be handled
+	handlers 	 	map[string]*HandlerStats // Maps from command or packet type to its stats. Never changes after newServerStats
+}
+
+// newServerStats returns stats with zeroed counters for every command and
+// packet type.
+func newServerStats() *ServerStats {
+
+	stats := &ServerStats{handlers: make(map[string]*HandlerStats)}
+	for command := range commands {
+		stats.handlers[command] = &HandlerStats{}
+	}
+	for _, msgType := range packetHandlerNames {
+		stats.handlers[msgType] = &HandlerStats{}
+	}
+	return stats
+
+}
+
+// countingConn counts the bytes read from and written to a connection.
+type countingConn struct {
+	net.Conn
+	stats *ServerStats
+}
+
+func (cc *countingConn) Read(b []byte) (int, error) {
+
+	n, err := cc.Conn.Read(b)
+	cc.stats.bytesIn.Add(int64(n))
+	return n, err
+
+}
+
+func (cc *countingConn) Write(b []byte) (int, error) {
+
+	n, err := cc.Conn.Write(b)
+	cc.stats.bytesOut.Add(int64(n))
+	return n, err
+
+}
+
+// serveMetrics serves the metrics of the server on '/metrics' of
+// s.metricsAddr until the context is cancelled.
+//
+// Parameters:
+// 	ctx - Context for cancellation of function
+// 	mainWG - Waitgroup for syncing
+func (s *Server) serveMetrics(ctx context.Context, mainWG *sync.WaitGroup) {
+
+	defer mainWG.Done()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+
+	if err := checkMetricsAddr(s.metricsAddr, s.metricsPublic); err != nil {
+		slog.Error("Starting to listen for metrics scrapes", "err", err)
+		return
+	}
+
+	ln, err := net.Listen("tcp", s.metricsAddr)
+	if err != nil {
+		slog.Error("Starting to listen for metrics scrapes", "err", err)
+		return
+	}
+
+	httpServer := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	slog.Info("Serving metrics", "addr", ln.Addr().String())
+	err = httpServer.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Serving metrics", "err", err)
+	}
+	slog.Info("Shutting down: Serving metrics")
+
+}
+
+// checkMetricsAddr checks that the metrics are only served on a loopback
+// address, like '127.0.0.1:9100', '[::1]:9100' or 'localhost:9100'.
+// Returns an error if the address is reachable from other hosts and that
+// is not allowed.
+//
+// Parameters:
+//	addr - the address the metrics are served on
+//	public - whether addresses which are reachable from other hosts are allowed
+func checkMetricsAddr(addr string, public bool) error {
+
+	if public {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid metrics address '%s': %w", addr, err)
+	}
+	if ip := net.ParseIP(host); host == "localhost" || ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("the metrics are not authenticated, so '%s' has to be a loopback address like 127.0.0.1:9100. Use '-metrics-public' to serve them on other addresses anyway", addr)
+
+}
+
+// writeMetrics writes every metric of the server in the text format of
+// Prometheus.
+//
+// Parameters:
+//	w - where the metrics are written to
+func (s *Server) writeMetrics(w io.Writer) {
+
+	s.mu.Lock()
+	connections := len(s.clientConns)
+	usersOnline := len(s.clientConnsRev)
+	sessions 	:= 0
+	for _, userSessions := range s.clientConnsRev {
+		sessions += len(userSessions)
+	}
+	chatRequests := len(s.chatRequests)
+	pendingLinks := len(s.pendingLinks)
+	queuedDevices := len(s.queues)
+	queuedPackets := 0
+	for _, queue := range s.queues {
+		queuedPackets += queue.packets
+	}
+	s.mu.Unlock()
+
+	s.muShadow.Lock()
+	users := len(s.usrPwdMap)
+	s.muShadow.Unlock()
+
+	writeMetric(w, "messenger_up_since_seconds", "gauge", "Unix time the server started at.", float64(s.startedAt.Unix()))
+	writeMetric(w, "messenger_connections", "gauge", "Open client connections.", float64(connections))
+	writeMetric(w, "messenger_users_online", "gauge", "Users logged in on at least one connection.", float64(usersOnline))
+	writeMetric(w, "messenger_sessions", "gauge", "Logged in sessions.", float64(sessions))
+	writeMetric(w, "messenger_users_registered", "gauge", "Registered users.", float64(users))
+	writeMetric(w, "messenger_chat_requests_pending", "gauge", "Chat requests waiting for an answer.", float64(chatRequests))
+	writeMetric(w, "messenger_device_links_pending", "gauge", "New devices waiting to be linked.", float64(pendingLinks))
+	writeMetric(w, "messenger_dispatch_queue_depth", "gauge", "Packets read from clients and waiting to be handled.", float64(s.stats.dispatchQueue.Load()))
+	writeMetric(w, "messenger_offline_queue_packets", "gauge", "Packets queued for offline devices.", float64(queuedPackets))
+	writeMetric(w, "messenger_offline_queue_devices", "gauge", "Offline devices with queued packets.", float64(queuedDevices))
+
+	writeMetric(w, "messenger_connections_accepted_total", "counter", "Client connections accepted.", float64(s.stats.connections.Load()))
+	writeMetric(w, "messenger_packets_received_total", "counter", "Packets received from clients.", float64(s.stats.packets.Load()))
+	writeMetric(w, "messenger_chat_messages_routed_total", "counter", "Chat messages routed to the devices of their recipients.", float64(s.stats.chatMessages.Load()))
+	writeMetric(w, "messenger_logins_failed_total", "counter", "Logins refused for wrong credentials, a ban or a wrong device key.", float64(s.stats.failedLogins.Load()))
+	writeMetric(w, "messenger_commands_invalid_total", "counter", "Commands which do not exist.", float64(s.stats.invalidCommands.Load()))
+	writeMetric(w, "messenger_received_bytes_total", "counter", "Bytes read from clients.", float64(s.stats.bytesIn.Load()))
+	writeMetric(w, "messenger_sent_bytes_total", "counter", "Bytes written to clients.", float64(s.stats.bytesOut.Load()))
+
+	names := slices.Sorted(maps.Keys(s.stats.handlers))
+
+	fmt.Fprintln(w, "# HELP messenger_commands_received_total Commands and packets received by type.")
+	fmt.Fprintln(w, "# TYPE messenger_commands_received_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "messenger_commands_received_total{command=%q} %d\n", name, s.stats.handlers[name].received.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP messenger_handler_duration_seconds Time spent handling commands and packets by type.")
+	fmt.Fprintln(w, "# TYPE messenger_handler_duration_seconds histogram")
+	for _, name := range names {
+		handler := s.stats.handlers[name]
+		cumulative := int64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += handler.buckets[i].Load()
+			fmt.Fprintf(w, "messenger_handler_duration_seconds_bucket{command=%q,le=\"%g\"} %d\n", name, bound, cumulative)
+		}
+		fmt.Fprintf(w, "messenger_handler_duration_seconds_bucket{command=%q,le=\"+Inf\"} %d\n", name, handler.handled.Load())
+		fmt.Fprintf(w, "messenger_handler_duration_seconds_sum{command=%q} %g\n", name, time.Duration(handler.nanos.Load()).Seconds())
+		fmt.Fprintf(w, "messenger_handler_duration_seconds_count{command=%q} %d\n", name, handler.handled.Load())
+	}
+
+}
+
+// writeMetric writes a metric without labels along with its help and type.
+//
+// Parameters:
+//	w - where the metric is written to
+//	name - the name of the metric
+//	kind - "counter" or "gauge"
+//	help - what the metric measures
+//	value - the value of the metric
+func writeMetric(w io.Writer, name string, kind string, help string, value float64) {
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+
+}
+
+// loadQueues counts the packets in the queue file of every device and
+// finds the earliest expiry of a chat message in it once on startup. Both
+// are kept up to date whenever a queue changes, so neither scrapes nor the
+// sweeper have to read the queues.
+// Returns true if the queues could be read and false otherwise.
+func (s *Server) loadQueues() bool {
+
+	if !fileExists(serverQueueDir) {
+		return true
+	}
+
+	userEntries, err := os.ReadDir(serverQueueDir)
+	if err != nil {
+		slog.Error("Reading queue directory", "err", err)
+		return false
+	}
+	for _, userEntry := range userEntries {
+
+		deviceEntries, err := os.ReadDir(serverQueueDir + userEntry.Name())
+		if err != nil {
+			slog.Error("Reading queue directory", "err", err)
+			return false
+		}
+
+		for _, deviceEntry := range deviceEntries {
+
+			queuePath := serverQueueDir + userEntry.Name() + "/" + deviceEntry.Name()
+			content, err := os.ReadFile(queuePath)
+			if err != nil {
+				slog.Error("Reading queue file", "file", queuePath, "err", err)
+				return false
+			}
+
+			// Invalid lines are counted, but never expire
+			queue := &QueueState{}
+			for _, line := range strings.Split(string(content), "\n") {
+				if line == "" {
+					continue
+				}
+				var packet Packet
+				json.Unmarshal([]byte(line), &packet)
+				queue.add(packet)
+			}
+			if queue.packets > 0 {
+				s.queues[queuePath] = queue
+			}
+
+		}
+
+	}
+
+	slog.Info("Successfully loaded queues")
+	return true
+
+}
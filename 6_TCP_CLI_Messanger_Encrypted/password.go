@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PasswordPolicy is the minimum strength of new passwords. It is chosen
+// during the server setup and sent to every client in a "POLICY" packet
+// once it connects. The server only ever receives password hashes, so the
+// policy is checked by the clients when registering and changing a
+// password and can not be enforced by the server. The policy is advisory
+// only: a modified client may register any password, which is stored as
+// the unsalted SHA-256 hash the client sent.
+type PasswordPolicy struct {
+	MinLength  int `json:"minLength"`
+	MinClasses int `json:"minClasses"` // Number of different character classes: lower case, upper case, digits and others
+}
+
+// parsePasswordPolicy converts a password policy given as
+// '<minLength> <minClasses>' into a PasswordPolicy.
+// Returns an error if the format or one of the values is invalid.
+func parsePasswordPolicy(input string) (PasswordPolicy, error) {
+
+	fields := strings.Fields(input)
+	if len(fields) != 2 {
+		return PasswordPolicy{}, errors.New("expected '<minLength> <minClasses>'")
+	}
+
+	minLength, err := strconv.Atoi(fields[0])
+	if err != nil || minLength < 1 {
+		return PasswordPolicy{}, fmt.Errorf("invalid minimum length '%s'", fields[0])
+	}
+
+	minClasses, err := strconv.Atoi(fields[1])
+	if err != nil || minClasses < 1 || minClasses > 4 {
+		return PasswordPolicy{}, fmt.Errorf("invalid number of character classes '%s', expected 1 to 4", fields[1])
+	}
+
+	return PasswordPolicy{MinLength: minLength, MinClasses: minClasses}, nil
+
+}
+
+// check returns an error describing why the given password does not
+// meet the policy, or nil if it does.
+//
+// Parameters:
+//	username - the user the password is for. It must not be part of the password
+//	password - the password to check
+func (p PasswordPolicy) check(username string, password string) error {
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("the password has to be at least %d characters long", p.MinLength)
+	}
+
+	var hasLower, hasUpper, hasDigit, hasOther bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		default:
+			hasOther = true
+		}
+	}
+
+	classes := 0
+	for _, hasClass := range []bool{hasLower, hasUpper, hasDigit, hasOther} {
+		if hasClass {
+			classes++
+		}
+	}
+	if classes < p.MinClasses {
+		return fmt.Errorf("the password has to contain at least %d of: lower case letters, upper case letters, digits and other characters", p.MinClasses)
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("the password must not contain the username")
+	}
+
+	return nil
+
+}
+
+// readPassword shows the given prompt and reads the next line typed by
+// the user without showing it, so the password does not show up on the
+// screen or in the scrollback.
+//
+// Parameters:
+//	prompt - the text asking for the password
+func (c *Client) readPassword(prompt string) (string, error) {
+
+	endSecret := c.view.BeginSecret(prompt)
+	defer endSecret()
+
+	select {
+	case password := <-c.inputCh:
+		return password, nil
+	case <-c.quitCh:
+		return "", errors.New("the connection to the server was closed")
+	}
+
+}
+
+// readNewPassword asks for a new password twice and checks it against
+// the password policy of the server.
+// Returns the password if both inputs match and the policy is met.
+//
+// Parameters:
+//	username - the user the password is for
+func (c *Client) readNewPassword(username string) (string, error) {
+
+	password, err := c.readPassword("New password: ")
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	policy := c.pwdPolicy
+	c.mu.Unlock()
+
+	err = policy.check(username, password)
+	if err != nil {
+		return "", err
+	}
+
+	repeated, err := c.readPassword("Repeat the new password: ")
+	if err != nil {
+		return "", err
+	}
+	if repeated != password {
+		return "", errors.New("the passwords do not match")
+	}
+
+	return password, nil
+
+}
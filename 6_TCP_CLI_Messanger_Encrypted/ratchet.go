@@ -0,0 +1,604 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxSkippedKeysPerChain = 1000 // Maximum number of message keys skipped within one chain by a single message
+	maxStoredSkippedKeys   = 2000 // Maximum number of skipped message keys kept per session
+)
+
+// RatchetHeader is sent in plaintext along with every ratchet message.
+// It tells the receiver which ratchet key and which position within the
+// chain the message was encrypted with.
+type RatchetHeader struct {
+	DH string `json:"dh"` // Current ratchet public key of the sender
+	PN int    `json:"pn"` // Number of messages in the previous sending chain
+	N  int    `json:"n"`  // Number of the message in the current sending chain
+}
+
+// RatchetMessage is a chat message encrypted for exactly one device.
+// Session identifies the session of the two devices the message belongs
+// to, as both devices may start a session at the same time.
+type RatchetMessage struct {
+	Session    string 		 `json:"session"`
+	Header 	   RatchetHeader `json:"header"`
+	Ciphertext string 		 `json:"ciphertext"`
+}
+
+// RatchetState is the double ratchet state of one session between two
+// devices. Every message is encrypted with its own message key derived
+// from a symmetric chain, and the chains are replaced with new ones
+// derived from a fresh Diffie-Hellman exchange whenever the direction of
+// the conversation changes. Keys are deleted as soon as they are used, so
+// compromising the current state does not reveal earlier messages.
+type RatchetState struct {
+	DHs 		 []byte 		   `json:"dhs"` // Own current ratchet private key
+	DHr 		 []byte 		   `json:"dhr"` // Current ratchet public key of the other device
+	RK 			 []byte 		   `json:"rk"`  // Root key
+	CKs 		 []byte 		   `json:"cks"` // Sending chain key
+	CKr 		 []byte 		   `json:"ckr"` // Receiving chain key
+	Ns 			 int 			   `json:"ns"`
+	Nr 			 int 			   `json:"nr"`
+	PN 			 int 			   `json:"pn"`
+	Skipped 	 map[string][]byte `json:"skipped"` // Maps from ratchet key and message number to skipped message keys
+	SkippedOrder []string 		   `json:"skippedOrder"`
+}
+
+// PeerSessions holds every session with one device of another user.
+// Active is the session new messages are sent in.
+type PeerSessions struct {
+	Active 	 string 				  `json:"active"`
+	Sessions map[string]*RatchetState `json:"sessions"`
+}
+
+// RatchetStore holds the ratchet sessions of a device with all other
+// devices, keyed by '<username>/<deviceID>'. It is stored in the clients
+// data directory and rewritten after every message, so used keys are
+// deleted from disk as well.
+type RatchetStore struct {
+	path  string
+	Peers map[string]*PeerSessions `json:"peers"`
+}
+
+// loadRatchetStore reads the ratchet sessions of the given user from the
+// clients data directory. If there are none yet, an empty store is
+// returned.
+//
+// Parameters:
+//	username - the user whose sessions are loaded
+func loadRatchetStore(username string) (*RatchetStore, error) {
+
+	store := &RatchetStore{
+		path:  clientDataDir + username + "/sessions",
+		Peers: make(map[string]*PeerSessions),
+	}
+	if !fileExists(store.path) {
+		return store, nil
+	}
+
+	content, err := os.ReadFile(store.path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, store)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+
+}
+
+// save writes the ratchet sessions to a temporary file and moves it over
+// the sessions file afterwards. A store without a path is only kept in
+// memory.
+func (store *RatchetStore) save() error {
+
+	if store.path == "" {
+		return nil
+	}
+
+	jsonData, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+
+	tempPath := store.path + ".tmp"
+	err = os.WriteFile(tempPath, jsonData, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, store.path)
+
+}
+
+// renameUser moves every session with a device of the given user to the
+// new name of that user and writes the store afterwards.
+//
+// Parameters:
+//	oldName - the previous name of the user
+//	newName - the new name of the user
+func (store *RatchetStore) renameUser(oldName string, newName string) error {
+
+	for peer, peerSessions := range store.Peers {
+		username, deviceID, ok := strings.Cut(peer, "/")
+		if !ok || username != oldName {
+			continue
+		}
+		delete(store.Peers, peer)
+		store.Peers[newName + "/" + deviceID] = peerSessions
+	}
+	return store.save()
+
+}
+
+// encrypt encrypts the given plaintext for the given device of another
+// user using the active session with that device. If there is no session
+// yet, a new one is started with this device as initiator.
+// Returns the json encoded RatchetMessage.
+//
+// Parameters:
+//	device - the identity of this device
+//	peer - the other device as '<username>/<deviceID>'
+//	peerKey - the base64 encoded identity key of the other device
+//	plaintext - the message to encrypt
+func (store *RatchetStore) encrypt(device *Device, peer string, peerKey string, plaintext []byte) (string, error) {
+
+	peerSessions, ok := store.Peers[peer]
+	if !ok {
+		peerSessions = &PeerSessions{Sessions: make(map[string]*RatchetState)}
+		store.Peers[peer] = peerSessions
+	}
+
+	state, ok := peerSessions.Sessions[peerSessions.Active]
+	if !ok {
+
+		rawID := make([]byte, 8)
+		if _, err := rand.Read(rawID); err != nil {
+			return "", err
+		}
+
+		var err error
+		state, err = newInitiatorState(device, peerKey)
+		if err != nil {
+			return "", err
+		}
+
+		peerSessions.Active = hex.EncodeToString(rawID)
+		peerSessions.Sessions[peerSessions.Active] = state
+
+	}
+
+	header, ciphertext, err := state.encrypt(plaintext, []byte(peerSessions.Active))
+	if err != nil {
+		return "", err
+	}
+
+	message := RatchetMessage{
+		Session: 	peerSessions.Active,
+		Header: 	header,
+		Ciphertext: ciphertext,
+	}
+	jsonData, err := json.Marshal(message)
+	if err != nil {
+		return "", err
+	}
+
+	return string(jsonData), store.save()
+
+}
+
+// decrypt decrypts a message sent by the given device of another user.
+// If the message starts a new session, this device takes the role of the
+// responder. The session state is only changed if the message could be
+// decrypted.
+//
+// Parameters:
+//	device - the identity of this device
+//	peer - the sending device as '<username>/<deviceID>'
+//	peerKey - the base64 encoded identity key of the sending device
+//	encoded - the json encoded RatchetMessage
+func (store *RatchetStore) decrypt(device *Device, peer string, peerKey string, encoded string) ([]byte, error) {
+
+	var message RatchetMessage
+	err := json.Unmarshal([]byte(encoded), &message)
+	if err != nil {
+		return nil, err
+	}
+
+	peerSessions, ok := store.Peers[peer]
+	if !ok {
+		peerSessions = &PeerSessions{Sessions: make(map[string]*RatchetState)}
+	}
+
+	state, ok := peerSessions.Sessions[message.Session]
+	if !ok {
+		state, err = newResponderState(device, peerKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Work on a copy, so a forged or corrupted message does not break the session
+	updated := state.clone()
+	plaintext, err := updated.decrypt(message.Header, message.Ciphertext, []byte(message.Session))
+	if err != nil {
+		return nil, err
+	}
+
+	peerSessions.Sessions[message.Session] = updated
+	store.Peers[peer] = peerSessions
+
+	// If both devices started a session at the same time, both settle on
+	// the session with the smaller ID
+	_, hasActive := peerSessions.Sessions[peerSessions.Active]
+	if !hasActive || message.Session < peerSessions.Active {
+		peerSessions.Active = message.Session
+	}
+
+	return plaintext, store.save()
+
+}
+
+// newInitiatorState starts a session with the device with the given
+// identity key. The identity key of the other device serves as its first
+// ratchet key, so the initiator can send messages right away.
+//
+// Parameters:
+//	device - the identity of this device
+//	peerKey - the base64 encoded identity key of the other device
+func newInitiatorState(device *Device, peerKey string) (*RatchetState, error) {
+
+	sharedSecret, err := device.sharedSecret(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	peerPubKey, err := parsePublicKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ratchetKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	dhOut, err := ratchetKey.ECDH(peerPubKey)
+	if err != nil {
+		return nil, err
+	}
+
+	rootKey, sendingChain, err := kdfRoot(sharedSecret, dhOut)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RatchetState{
+		DHs: 		  ratchetKey.Bytes(),
+		DHr: 		  peerPubKey.Bytes(),
+		RK: 		  rootKey,
+		CKs: 		  sendingChain,
+		Skipped: 	  make(map[string][]byte),
+	}, nil
+
+}
+
+// newResponderState prepares a session started by the device with the
+// given identity key. The own identity key serves as the first ratchet
+// key, the first message received performs the first ratchet step.
+//
+// Parameters:
+//	device - the identity of this device
+//	peerKey - the base64 encoded identity key of the other device
+func newResponderState(device *Device, peerKey string) (*RatchetState, error) {
+
+	sharedSecret, err := device.sharedSecret(peerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RatchetState{
+		DHs: 	 device.key.Bytes(),
+		RK: 	 sharedSecret,
+		Skipped: make(map[string][]byte),
+	}, nil
+
+}
+
+// encrypt derives the next message key of the sending chain and encrypts
+// the plaintext with it.
+// Returns the header to send along with the base64 encoded ciphertext.
+//
+// Parameters:
+//	plaintext - the message to encrypt
+//	associatedData - data which is authenticated but not encrypted
+func (state *RatchetState) encrypt(plaintext []byte, associatedData []byte) (RatchetHeader, string, error) {
+
+	if state.CKs == nil {
+		return RatchetHeader{}, "", errors.New("session has no sending chain yet")
+	}
+
+	ratchetKey, err := ecdh.X25519().NewPrivateKey(state.DHs)
+	if err != nil {
+		return RatchetHeader{}, "", err
+	}
+
+	header := RatchetHeader{
+		DH: base64.StdEncoding.EncodeToString(ratchetKey.PublicKey().Bytes()),
+		PN: state.PN,
+		N:  state.Ns,
+	}
+
+	var messageKey []byte
+	state.CKs, messageKey = kdfChain(state.CKs)
+	state.Ns++
+
+	ciphertext, err := sealMessage(messageKey, plaintext, headerData(header, associatedData))
+	if err != nil {
+		return RatchetHeader{}, "", err
+	}
+	return header, ciphertext, nil
+
+}
+
+// decrypt decrypts a message with the given header. Skipped message keys
+// are tried first to handle messages which arrive out of order. If the
+// header holds a new ratchet key of the other device, a ratchet step is
+// performed. The state must be discarded if an error is returned.
+//
+// Parameters:
+//	header - the header sent along with the message
+//	ciphertext - the base64 encoded ciphertext
+//	associatedData - data which is authenticated but not encrypted
+func (state *RatchetState) decrypt(header RatchetHeader, ciphertext string, associatedData []byte) ([]byte, error) {
+
+	aad := headerData(header, associatedData)
+
+	skippedID := header.DH + ":" + strconv.Itoa(header.N)
+	if messageKey, ok := state.Skipped[skippedID]; ok {
+		state.deleteSkipped(skippedID)
+		return openMessage(messageKey, ciphertext, aad)
+	}
+
+	peerRatchetKey, err := base64.StdEncoding.DecodeString(header.DH)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hmac.Equal(peerRatchetKey, state.DHr) {
+		err := state.skipMessageKeys(header.PN)
+		if err != nil {
+			return nil, err
+		}
+		err = state.dhRatchet(peerRatchetKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = state.skipMessageKeys(header.N)
+	if err != nil {
+		return nil, err
+	}
+
+	var messageKey []byte
+	state.CKr, messageKey = kdfChain(state.CKr)
+	state.Nr++
+
+	return openMessage(messageKey, ciphertext, aad)
+
+}
+
+// skipMessageKeys derives and stores the message keys of the receiving
+// chain up to the given message number, so messages which arrive later
+// can still be decrypted. At most maxSkippedKeysPerChain keys are skipped
+// at once and at most maxStoredSkippedKeys are kept, dropping the oldest.
+//
+// Parameters:
+//	until - the message number to skip up to
+func (state *RatchetState) skipMessageKeys(until int) error {
+
+	if state.Nr + maxSkippedKeysPerChain < until {
+		return fmt.Errorf("message would skip more than %d message keys", maxSkippedKeysPerChain)
+	}
+	if state.CKr == nil {
+		return nil
+	}
+
+	dhr := base64.StdEncoding.EncodeToString(state.DHr)
+	for state.Nr < until {
+
+		var messageKey []byte
+		state.CKr, messageKey = kdfChain(state.CKr)
+
+		skippedID := dhr + ":" + strconv.Itoa(state.Nr)
+		state.Skipped[skippedID] = messageKey
+		state.SkippedOrder = append(state.SkippedOrder, skippedID)
+		state.Nr++
+
+		if len(state.SkippedOrder) > maxStoredSkippedKeys {
+			state.deleteSkipped(state.SkippedOrder[0])
+		}
+
+	}
+	return nil
+
+}
+
+// deleteSkipped removes a skipped message key once it is used or too old.
+//
+// Parameters:
+//	skippedID - the ratchet key and message number of the skipped key
+func (state *RatchetState) deleteSkipped(skippedID string) {
+
+	delete(state.Skipped, skippedID)
+	for i, id := range state.SkippedOrder {
+		if id == skippedID {
+			state.SkippedOrder = append(state.SkippedOrder[:i], state.SkippedOrder[i+1:]...)
+			break
+		}
+	}
+
+}
+
+// dhRatchet performs a ratchet step after a new ratchet key of the other
+// device was received. A new receiving chain is derived from it, then a
+// new own ratchet key is generated and a new sending chain is derived.
+//
+// Parameters:
+//	peerRatchetKey - the new ratchet public key of the other device
+func (state *RatchetState) dhRatchet(peerRatchetKey []byte) error {
+
+	peerPubKey, err := ecdh.X25519().NewPublicKey(peerRatchetKey)
+	if err != nil {
+		return err
+	}
+	ownKey, err := ecdh.X25519().NewPrivateKey(state.DHs)
+	if err != nil {
+		return err
+	}
+
+	state.PN  = state.Ns
+	state.Ns  = 0
+	state.Nr  = 0
+	state.DHr = peerRatchetKey
+
+	dhOut, err := ownKey.ECDH(peerPubKey)
+	if err != nil {
+		return err
+	}
+	state.RK, state.CKr, err = kdfRoot(state.RK, dhOut)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	state.DHs = newKey.Bytes()
+
+	dhOut, err = newKey.ECDH(peerPubKey)
+	if err != nil {
+		return err
+	}
+	state.RK, state.CKs, err = kdfRoot(state.RK, dhOut)
+	return err
+
+}
+
+// clone returns a deep copy of the state.
+func (state *RatchetState) clone() *RatchetState {
+
+	copied := *state
+	copied.Skipped = make(map[string][]byte, len(state.Skipped))
+	for id, key := range state.Skipped {
+		copied.Skipped[id] = key
+	}
+	copied.SkippedOrder = append([]string(nil), state.SkippedOrder...)
+	return &copied
+
+}
+
+// kdfRoot derives a new root key and a new chain key from the current
+// root key and the output of a Diffie-Hellman exchange.
+func kdfRoot(rootKey []byte, dhOut []byte) ([]byte, []byte, error) {
+
+	output, err := hkdf.Key(sha256.New, dhOut, rootKey, "messanger ratchet root", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return output[:32], output[32:], nil
+
+}
+
+// kdfChain derives the next chain key and the message key for the current
+// position from a chain key.
+func kdfChain(chainKey []byte) ([]byte, []byte) {
+
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	nextChainKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	messageKey := mac.Sum(nil)
+
+	return nextChainKey, messageKey
+
+}
+
+// headerData returns the data authenticated along with a message: the
+// associated data followed by the header.
+func headerData(header RatchetHeader, associatedData []byte) []byte {
+
+	return append(append([]byte(nil), associatedData...), []byte(header.DH + ":" + strconv.Itoa(header.PN) + ":" + strconv.Itoa(header.N))...)
+
+}
+
+// messageCipher derives the AES-GCM cipher and nonce for a message key.
+// Every message key is only used once, so the nonce can be derived from
+// it as well.
+func messageCipher(messageKey []byte) (cipher.AEAD, []byte, error) {
+
+	output, err := hkdf.Key(sha256.New, messageKey, nil, "messanger message key", 44)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(output[:32])
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	return aead, output[32:], nil
+
+}
+
+// sealMessage encrypts the plaintext with the given message key.
+// Returns the base64 encoded ciphertext.
+func sealMessage(messageKey []byte, plaintext []byte, aad []byte) (string, error) {
+
+	aead, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, aad)), nil
+
+}
+
+// openMessage decrypts a ciphertext created by sealMessage.
+func openMessage(messageKey []byte, ciphertext string, aad []byte) ([]byte, error) {
+
+	aead, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, sealed, aad)
+
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+)
+
+func newTestDevice(t *testing.T, id string) *Device {
+
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Device{id: id, key: key}
+
+}
+
+func newTestStore() *RatchetStore {
+
+	return &RatchetStore{Peers: make(map[string]*PeerSessions)}
+
+}
+
+// testPeer holds one side of a conversation between two devices.
+type testPeer struct {
+	name   string
+	device *Device
+	store  *RatchetStore
+}
+
+func newTestPeers(t *testing.T) (*testPeer, *testPeer) {
+
+	t.Helper()
+	alice := &testPeer{name: "alice/a1", device: newTestDevice(t, "a1"), store: newTestStore()}
+	bob   := &testPeer{name: "bob/b1", device: newTestDevice(t, "b1"), store: newTestStore()}
+	return alice, bob
+
+}
+
+func (p *testPeer) send(t *testing.T, to *testPeer, text string) string {
+
+	t.Helper()
+	message, err := p.store.encrypt(p.device, to.name, to.device.publicKey(), []byte(text))
+	if err != nil {
+		t.Fatalf("%s encrypting %q: %s", p.name, text, err)
+	}
+	return message
+
+}
+
+func (p *testPeer) receive(from *testPeer, message string) (string, error) {
+
+	plaintext, err := p.store.decrypt(p.device, from.name, from.device.publicKey(), message)
+	return string(plaintext), err
+
+}
+
+func (p *testPeer) mustReceive(t *testing.T, from *testPeer, message string, want string) {
+
+	t.Helper()
+	got, err := p.receive(from, message)
+	if err != nil {
+		t.Fatalf("%s decrypting %q: %s", p.name, want, err)
+	}
+	if got != want {
+		t.Fatalf("%s decrypted %q, want %q", p.name, got, want)
+	}
+
+}
+
+// compromise returns a copy of the peer as an attacker who steals the
+// complete state of the device would have it.
+func (p *testPeer) compromise(t *testing.T) *testPeer {
+
+	t.Helper()
+	jsonData, err := json.Marshal(p.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stolen := newTestStore()
+	if err := json.Unmarshal(jsonData, stolen); err != nil {
+		t.Fatal(err)
+	}
+	return &testPeer{name: p.name, device: p.device, store: stolen}
+
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+
+}
+
+func TestKdfVectors(t *testing.T) {
+
+	rootKey := make([]byte, 32)
+	dhOut   := make([]byte, 32)
+	for i := range rootKey {
+		rootKey[i] = byte(i)
+		dhOut[i]   = byte(32 + i)
+	}
+
+	newRootKey, chainKey, err := kdfRoot(rootKey, dhOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(newRootKey), "91e25a4d35c51ee9e8751687196168e6866ea43fa8a26f1b1239c72ae4d0f4d9"; got != want {
+		t.Errorf("kdfRoot root key = %s, want %s", got, want)
+	}
+	if got, want := hex.EncodeToString(chainKey), "34df875e801715e1c7cf64360a16e615ff9b1bfaf0127b79609f3495d25ba246"; got != want {
+		t.Errorf("kdfRoot chain key = %s, want %s", got, want)
+	}
+
+	chainKey = mustDecodeHex(t, "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa")
+	nextChainKey, messageKey := kdfChain(chainKey)
+	if got, want := hex.EncodeToString(nextChainKey), "e3593f75e832b460cfc9cdea5a65902f94d9213060090c0e00a5a74306389e2e"; got != want {
+		t.Errorf("kdfChain chain key = %s, want %s", got, want)
+	}
+	if got, want := hex.EncodeToString(messageKey), "790519613efaec118e63904e01475b9543b9a15c61070227d877418c8cca415e"; got != want {
+		t.Errorf("kdfChain message key = %s, want %s", got, want)
+	}
+
+	_, nonce, err := messageCipher(messageKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := hex.EncodeToString(nonce), "7efd5c20bb67be3846461d52"; got != want {
+		t.Errorf("messageCipher nonce = %s, want %s", got, want)
+	}
+
+}
+
+func TestRatchetConversation(t *testing.T) {
+
+	alice, bob := newTestPeers(t)
+
+	// Several messages in a row and changes of direction
+	turns := []struct {
+		from, to *testPeer
+		text 	 string
+	}{
+		{alice, bob, "hi bob"},
+		{alice, bob, "are you there?"},
+		{bob, alice, "hi alice"},
+		{alice, bob, "great"},
+		{bob, alice, "see you"},
+		{bob, alice, "bye"},
+	}
+
+	for _, turn := range turns {
+		message := turn.from.send(t, turn.to, turn.text)
+		turn.to.mustReceive(t, turn.from, message, turn.text)
+	}
+
+}
+
+func TestRatchetFreshKeyPerMessage(t *testing.T) {
+
+	alice, bob := newTestPeers(t)
+
+	first  := alice.send(t, bob, "same text")
+	second := alice.send(t, bob, "same text")
+
+	var firstMsg, secondMsg RatchetMessage
+	if err := json.Unmarshal([]byte(first), &firstMsg); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(second), &secondMsg); err != nil {
+		t.Fatal(err)
+	}
+	if firstMsg.Ciphertext == secondMsg.Ciphertext {
+		t.Fatal("two messages were encrypted with the same key")
+	}
+
+	bob.mustReceive(t, alice, first, "same text")
+	bob.mustReceive(t, alice, second, "same text")
+
+	// A message key can only be used once
+	if _, err := bob.receive(alice, first); err == nil {
+		t.Fatal("replayed message was decrypted")
+	}
+
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+
+	alice, bob := newTestPeers(t)
+
+	texts := []string{"zero", "one", "two", "three", "four"}
+	messages := make([]string, len(texts))
+	for i, text := range texts {
+		messages[i] = alice.send(t, bob, text)
+	}
+
+	for _, i := range []int{3, 0, 4, 2, 1} {
+		bob.mustReceive(t, alice, messages[i], texts[i])
+	}
+
+	// Messages of an older chain arriving after a ratchet step
+	late := alice.send(t, bob, "late")
+	reply := bob.send(t, alice, "reply")
+	alice.mustReceive(t, bob, reply, "reply")
+	newer := alice.send(t, bob, "newer")
+
+	bob.mustReceive(t, alice, newer, "newer")
+	bob.mustReceive(t, alice, late, "late")
+
+}
+
+func TestRatchetSkippedKeyLimit(t *testing.T) {
+
+	alice, bob := newTestPeers(t)
+
+	first := alice.send(t, bob, "first")
+	var last string
+	for i := 0; i <= maxSkippedKeysPerChain + 1; i++ {
+		last = alice.send(t, bob, "filler")
+	}
+
+	if _, err := bob.receive(alice, last); err == nil {
+		t.Fatal("message skipping too many keys was decrypted")
+	}
+
+	// The rejected message must not have changed the session
+	bob.mustReceive(t, alice, first, "first")
+
+}
+
+func TestRatchetForgedMessageKeepsSession(t *testing.T) {
+
+	alice, bob := newTestPeers(t)
+
+	message := alice.send(t, bob, "original")
+
+	var forged RatchetMessage
+	if err := json.Unmarshal([]byte(message), &forged); err != nil {
+		t.Fatal(err)
+	}
+	forged.Header.N = 5
+	forgedData, err := json.Marshal(forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := bob.receive(alice, string(forgedData)); err == nil {
+		t.Fatal("message with forged header was decrypted")
+	}
+	bob.mustReceive(t, alice, message, "original")
+
+}
+
+func TestRatchetCompromiseKeepsOldMessagesUnreadable(t *testing.T) {
+
+	alice, bob := newTestPeers(t)
+
+	old := []string{
+		alice.send(t, bob, "old one"),
+		alice.send(t, bob, "old two"),
+	}
+	bob.mustReceive(t, alice, old[0], "old one")
+	bob.mustReceive(t, alice, old[1], "old two")
+
+	reply := bob.send(t, alice, "reply")
+	alice.mustReceive(t, bob, reply, "reply")
+	recent := alice.send(t, bob, "recent")
+	bob.mustReceive(t, alice, recent, "recent")
+
+	// The attacker steals the identity key and every session of bob
+	attacker := bob.compromise(t)
+
+	for _, message := range append(old, recent) {
+		if plaintext, err := attacker.receive(alice, message); err == nil {
+			t.Fatalf("attacker decrypted an old message: %q", plaintext)
+		}
+	}
+
+	// The sent message can not be decrypted by its sender either
+	if _, err := alice.compromise(t).receive(bob, reply); err == nil {
+		t.Fatal("attacker decrypted an old reply with the state of alice")
+	}
+
+}
+
+func TestRatchetIdentityKeyCompromise(t *testing.T) {
+
+	alice, bob := newTestPeers(t)
+
+	first := alice.send(t, bob, "first")
+	bob.mustReceive(t, alice, first, "first")
+	reply := bob.send(t, alice, "reply")
+	alice.mustReceive(t, bob, reply, "reply")
+	later := alice.send(t, bob, "later")
+	bob.mustReceive(t, alice, later, "later")
+
+	// The attacker only knows the identity keys of both devices and starts
+	// from a fresh state, replaying every recorded message
+	attacker := &testPeer{name: bob.name, device: bob.device, store: newTestStore()}
+	if _, err := attacker.receive(alice, first); err != nil {
+		t.Fatal(err)
+	}
+	if plaintext, err := attacker.receive(alice, later); err == nil {
+		t.Fatalf("attacker decrypted a message sent after a ratchet step: %q", plaintext)
+	}
+
+}
+
+func TestRatchetSimultaneousSessions(t *testing.T) {
+
+	alice, bob := newTestPeers(t)
+
+	// Both devices start a session before receiving anything
+	fromAlice := alice.send(t, bob, "hello from alice")
+	fromBob   := bob.send(t, alice, "hello from bob")
+	bob.mustReceive(t, alice, fromAlice, "hello from alice")
+	alice.mustReceive(t, bob, fromBob, "hello from bob")
+
+	// Both settle on the same session
+	aliceActive := alice.store.Peers[bob.name].Active
+	bobActive   := bob.store.Peers[alice.name].Active
+	if aliceActive != bobActive {
+		t.Fatalf("sessions did not converge: alice uses %s, bob uses %s", aliceActive, bobActive)
+	}
+
+	for i := 0; i < 3; i++ {
+		message := alice.send(t, bob, "ping")
+		bob.mustReceive(t, alice, message, "ping")
+		message = bob.send(t, alice, "pong")
+		alice.mustReceive(t, bob, message, "pong")
+	}
+
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit is the number of actions a user may take in a row, after
+// which one more action is allowed every Interval.
+type RateLimit struct {
+	Burst 	 int
+	Interval time.Duration
+}
+
+// parseRateLimit converts a rate limit given as '<burst>/<interval>',
+// e.g. '3/20s', into a RateLimit.
+// Returns an error if the format or one of the values is invalid.
+//
+// Parameters:
+//	input - the rate limit to parse
+func parseRateLimit(input string) (RateLimit, error) {
+
+	burstStr, intervalStr, found := strings.Cut(strings.TrimSpace(input), "/")
+	if !found {
+		return RateLimit{}, errors.New("expected '<burst>/<interval>'")
+	}
+
+	burst, err := strconv.Atoi(burstStr)
+	if err != nil || burst < 1 {
+		return RateLimit{}, fmt.Errorf("invalid burst '%s'", burstStr)
+	}
+
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid interval '%s'", intervalStr)
+	}
+
+	return RateLimit{Burst: burst, Interval: interval}, nil
+
+}
+
+// tokenBucket holds the actions a user may currently take. Every action
+// takes a token and a token is added every Interval of the RateLimit,
+// up to Burst tokens.
+type tokenBucket struct {
+	tokens 	float64
+	updated time.Time
+}
+
+// refill adds the tokens gained since the last update to the bucket.
+//
+// Parameters:
+//	limit - the rate limit the bucket is filled by
+//	now - the current time
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+
+	if limit.Interval > 0 {
+		b.tokens += float64(now.Sub(b.updated)) / float64(limit.Interval)
+	}
+	b.tokens  = min(b.tokens, float64(limit.Burst))
+	b.updated = now
+
+}
+
+// take adds the tokens gained since the last update to the bucket and
+// takes one token if there is one.
+// Returns true if the action is allowed and false otherwise.
+//
+// Parameters:
+//	limit - the rate limit the bucket is filled by
+//	now - the current time
+func (b *tokenBucket) take(limit RateLimit, now time.Time) bool {
+
+	b.refill(limit, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+
+}
+
+// reserve adds the tokens gained since the last update to the bucket and
+// takes one token, even if there is none yet.
+// Returns how long to wait until the token is gained, zero if there was
+// one.
+//
+// Parameters:
+//	limit - the rate limit the bucket is filled by
+//	now - the current time
+func (b *tokenBucket) reserve(limit RateLimit, now time.Time) time.Duration {
+
+	b.refill(limit, now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens * float64(limit.Interval))
+
+}
+
+// rateLimitKinds are the kinds of actions which are limited per user.
+var rateLimitKinds = [...]string{"request", "message"}
+
+// limitOf returns the rate limit of the given kind of action.
+//
+// Parameters:
+//	kind - "request" for chat requests and "message" for chat messages
+func (s *Server) limitOf(kind string) RateLimit {
+
+	if kind == "request" {
+		return s.chatRequestLimit
+	}
+	return s.messageLimit
+
+}
+
+// allowOutgoing checks the rate limit of the given kind for the user the
+// connection is logged in as and sends an error message to the client if
+// it is exceeded. The buckets belong to the user, so they are shared by
+// every session of the user and kept across reconnects and renames.
+// Connections which are not logged in are not limited, as the handlers
+// reject them anyway.
+// Returns true if the chat request or message may be processed.
+//
+// Parameters:
+//	conn - the connection of the sender
+//	kind - what is sent, "request" for chat requests and "message" for chat messages
+func (s *Server) allowOutgoing(conn net.Conn, kind string) bool {
+
+	limit := s.limitOf(kind)
+
+	s.mu.Lock()
+	username := s.clientConns[conn].username
+	_, isLoggedIn := s.clientConnsRev[username]
+	allowed := true
+	if isLoggedIn {
+		key := kind + ":" + username
+		bucket, ok := s.rateBuckets[key]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(limit.Burst), updated: time.Now()}
+			s.rateBuckets[key] = bucket
+		}
+		allowed = bucket.take(limit, time.Now())
+	}
+	s.mu.Unlock()
+
+	if allowed {
+		return true
+	}
+
+	s.connLog(conn).Info("Rate limit exceeded", "kind", kind)
+	msg    := fmt.Sprintf("[Error] You are sending too many chat %ss. Please wait %s before sending the next one.", kind, limit.Interval)
+	errMsg := "[Error] Writing 'rate limit exceeded' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClient(conn, msg, errMsg)
+	return false
+
+}
+
+// renameRateBucketsLocked moves the buckets of a renamed user to the new
+// name, so a new name does not bring new chat requests or messages.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	oldName - the name the user had
+//	newName - the name the user has now
+func (s *Server) renameRateBucketsLocked(oldName string, newName string) {
+
+	for _, kind := range rateLimitKinds {
+		if bucket, ok := s.rateBuckets[kind + ":" + oldName]; ok {
+			s.rateBuckets[kind + ":" + newName] = bucket
+			delete(s.rateBuckets, kind + ":" + oldName)
+		}
+	}
+
+}
+
+// pruneRateBucketsLocked removes the buckets which are full again. A full
+// bucket allows as much as a new one, so removing it does not loosen the
+// limits.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	now - the current time
+func (s *Server) pruneRateBucketsLocked(now time.Time) {
+
+	for key, bucket := range s.rateBuckets {
+		kind, _, _ := strings.Cut(key, ":")
+		limit := s.limitOf(kind)
+		bucket.refill(limit, now)
+		if bucket.tokens >= float64(limit.Burst) {
+			delete(s.rateBuckets, key)
+		}
+	}
+
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// Message states shown next to sent messages. A state is only ever
+// replaced by a later one, e.g. a "delivered" receipt arriving after a
+// "read" receipt of another device is ignored.
+const (
+	MESSAGE_SENT 	  = "sent"
+	MESSAGE_DELIVERED = "delivered"
+	MESSAGE_READ 	  = "read"
+)
+
+var messageStateOrder = map[string]int{
+	MESSAGE_SENT: 	   0,
+	MESSAGE_DELIVERED: 1,
+	MESSAGE_READ: 	   2,
+}
+
+// SentMessage is a chat message sent from this client which has not been
+// read by its recipient yet.
+type SentMessage struct {
+	partner string
+	text 	string
+	state 	string
+}
+
+// newMessageID returns a random ID for a chat message, which is used to
+// match receipts with the message.
+func newMessageID() (string, error) {
+
+	rawID := make([]byte, 8)
+	if _, err := rand.Read(rawID); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(rawID), nil
+
+}
+
+// markReceivedLocked remembers a chat message received from another user
+// until it is read. If the chat with the sender is open in chat mode, the
+// message counts as read right away.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	delivery - the received chat message
+func (c *Client) markReceivedLocked(delivery ChatDelivery) {
+
+	if delivery.ID == "" || delivery.From == c.username {
+		return
+	}
+
+	c.unread[delivery.From] = append(c.unread[delivery.From], delivery.ID)
+	if c.activeChat == delivery.From {
+		c.sendReadReceiptsLocked(delivery.From)
+	}
+
+}
+
+// sendReadReceiptsLocked tells the given user that every message received
+// from them has been read.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	partner - the user whose chat is open in chat mode
+func (c *Client) sendReadReceiptsLocked(partner string) {
+
+	// The chat may have been opened by a name the messages were not received under, e.g. 'Alice'
+	for sender, ids := range c.unread {
+
+		if canonicalUsername(sender) != canonicalUsername(partner) {
+			continue
+		}
+
+		jsonData, err := json.Marshal(Receipt{To: sender, IDs: ids, Status: MESSAGE_READ})
+		if err != nil {
+			c.view.Println("[Error] Marshalling read receipt failed:", err)
+			return
+		}
+
+		err = c.sendPacket(Packet{MsgType: "RECEIPT", Payload: string(jsonData)})
+		if err != nil {
+			c.view.Println("[Error] Sending read receipt failed:", err)
+			return
+		}
+		delete(c.unread, sender)
+
+	}
+
+}
+
+// printReceipt shows the new state of the messages of a "RECEIPT" packet
+// next to the messages.
+//
+// Parameters:
+//	payload - the json encoded Receipt
+func (c *Client) printReceipt(payload string) {
+
+	var receipt Receipt
+	err := json.Unmarshal([]byte(payload), &receipt)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling receipt failed:", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range receipt.IDs {
+
+		message, ok := c.sent[id]
+		if !ok || messageStateOrder[receipt.Status] <= messageStateOrder[message.state] {
+			continue
+		}
+
+		message.state = receipt.Status
+		c.view.ChatLine(message.partner, "%s (%s)", chatMessageLine(id, c.username, message.text), message.state)
+
+		// Nothing changes for a message once it is read
+		if message.state == MESSAGE_READ {
+			delete(c.sent, id)
+		}
+
+	}
+
+}
+
+// printChatError shows why the server did not route a chat message. A
+// message of this device which was not routed is marked as not sent.
+//
+// Parameters:
+//	payload - the json encoded ChatError
+func (c *Client) printChatError(payload string) {
+
+	var chatErr ChatError
+	err := json.Unmarshal([]byte(payload), &chatErr)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling chat error failed:", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	message, ok := c.sent[chatErr.ID]
+	if !ok {
+		c.view.Printf("[Error] %s (%s)\n", chatErr.Message, chatErr.Code)
+		return
+	}
+
+	delete(c.sent, chatErr.ID)
+	c.view.ChatLine(message.partner, "%s (not sent: %s)", chatMessageLine(chatErr.ID, c.username, message.text), chatErr.Message)
+
+}
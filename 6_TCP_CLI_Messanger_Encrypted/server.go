@@ -2,13 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -26,22 +34,66 @@ var commands = map[string]CommandHandler {
 	"/newChat": 	handleNewChat,
 	"/accept": 		handleAccept,
 	"/decline": 	handleDecline,
+	"/devices": 	handleDevices,
+	"/linkDevice": 	handleLinkDevice,
+	"/unlinkDevice":handleUnlinkDevice,
+	"/passwd": 		handlePasswd,
+	"/deleteAccount":handleDeleteAccount,
+	"/rename": 		handleRename,
+	"/contacts": 	handleContacts,
+	"/addContact": 	handleAddContact,
+	"/removeContact":handleRemoveContact,
+	"/online": 		handleOnline,
+	"/presence": 	handlePresence,
+	"/block": 		handleBlock,
+	"/unblock": 	handleUnblock,
+	"/timer": 		handleTimer,
+	"/kick": 		handleAdminCommand,
+	"/ban": 		handleAdminCommand,
+	"/unban": 		handleAdminCommand,
+	"/broadcast": 	handleAdminCommand,
+	"/stats": 		handleAdminCommand,
+	"/users": 		handleAdminCommand,
 }
 
 var commandDescriptions = [...]string {
 	"- '/help': Lists all the available commands with a description.",
 	"- '/quit': Signals the server to close the connection.",
-	"- '/register <username> <password>': Sends username and locally hashed password to the server to set up a new user. If the given username is already in use an error will be returned.",
-	"- '/login <username> <password>': Sends username and locally hashed password to the server to verify the combination of both. If valid you will be logged in. At 3 wrong login attempts this connection will be closed by the server.",
+	"- '/register <username>': Asks for a password and sends username and locally hashed password to the server to set up a new user. If the given username is already in use an error will be returned.",
+	"- '/login <username>': Asks for the password and sends username and locally hashed password to the server to verify the combination of both. If valid you will be logged in. At 3 wrong login attempts this connection will be closed by the server.",
 	"- '/logout': Logs you out of the user account you are currently logged in as.",
 	"- '/newChat <username>': Will send a request to start a new chat to the given user. Only works if other user is online and the chat doesn't exist so far.",
 	"- '/accept': accept an incomming request to start a new chat.",
 	"- '/decline': decline an incomming request to start a new chat.",
+	"- '/chat <username>': Enters chat mode with the given user. Every line you type which is not a command is encrypted for all devices of both of you and sent as a chat message.",
+	"- '/exit': Leaves chat mode.",
+	"- '/devices [username]': Lists the registered devices of the given user or of yourself if no user is given.",
+	"- '/linkDevice <code>': Links a new device to your account. The code is shown on the new device when logging in there.",
+	"- '/unlinkDevice <deviceID>': Removes one of your other devices from your account and logs it out.",
+	"- '/passwd': Asks for your current and a new password and changes the password of your account.",
+	"- '/deleteAccount': Asks for your password and deletes your account along with all of your chats, pending chat requests and queued messages. Every session of your account is logged out.",
+	"- '/rename <newUsername>': Asks for your password and changes your username. Your chats, devices and queued messages move to the new name and your chat partners are informed.",
+	"- '/contacts': Lists your contacts and whether they are online. You are informed whenever one of your contacts logs in or out.",
+	"- '/addContact <username>': Adds the given user to your contacts.",
+	"- '/removeContact <username>': Removes the given user from your contacts.",
+	"- '/online': Lists every user who is currently online.",
+	"- '/presence <hide|show>': Hides your presence, so you appear offline to everyone else, or shows it again.",
+	"- '/block <username>': Blocks the given user. Chat requests and messages of the user are dropped without the user being told.",
+	"- '/unblock <username>': Unblocks the given user.",
+	"- '/send <path>': Sends the file at the given path to your chat partner while in chat mode. Sending the same file again resumes an interrupted transfer. Received files are stored in 'clientdata/<username>/downloads'.",
+	"- '/verify <username> [confirm]': Shows the safety number of you and the given user. Compare it with the one shown to the other user and use 'confirm' to mark the user as verified. You will be warned if the keys of a verified user change.",
+	"- '/timer <duration|off>': Sets the disappearing message timer of the chat you are in, e.g. '/timer 1h'. Messages sent afterwards are deleted by both of you and the server once the timer has run out. 'off' keeps messages again.",
+	"- '/reply <id> <text>': Answers the message with the given ID in the chat you are in. Messages are shown with the first characters of their ID, e.g. '#3fa2c1'.",
+	"- '/edit <id> <text>': Replaces the text of one of your messages in the chat you are in for everyone in the chat.",
+	"- '/delete <id>': Deletes one of your messages in the chat you are in for everyone in the chat.",
+	"- '/search <terms>': Searches the messages of all of your chats on this device for the given terms. The history is stored encrypted with your password in 'clientdata/<username>/history'.",
 }
 
 type Message struct {
 	sender  net.Conn
+	msgType string
 	payload []byte
+	reply 	chan<- string // Receives the reply to a command of the admin console
 }
 
 type State int
@@ -50,34 +102,121 @@ const (
 	LOGGING_IN
 	LOGGED_IN
 	CHATTING
+	LINKING
 )
 
+// SessionPolicy determines how the server reacts to a login as a user
+// who already has an active session on another connection.
+type SessionPolicy int
+const (
+	SESSION_REJECT SessionPolicy = iota // Refuse the new login
+	SESSION_TAKEOVER 					// Log out the old session and close its connection
+	SESSION_MULTI 						// Keep all sessions. Messages are sent to every one of them
+)
+
+var sessionPolicyNames = map[string]SessionPolicy {
+	"reject": 	SESSION_REJECT,
+	"takeover": SESSION_TAKEOVER,
+	"multi": 	SESSION_MULTI,
+}
+
+// parseSessionPolicy converts the name of a session policy ("reject",
+// "takeover" or "multi") into the respective SessionPolicy.
+// Returns an error if the name is unknown.
+func parseSessionPolicy(name string) (SessionPolicy, error) {
+
+	policy, ok := sessionPolicyNames[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return SESSION_REJECT, fmt.Errorf("unknown session policy '%s'", name)
+	}
+	return policy, nil
+
+}
+
 type ClientState struct {
 	conn 		net.Conn
 	username	string
+	deviceID	string
 	state 		State
+	session 	string 		 // Random ID which the log lines of the connection carry
+	failedLogins int 			 // Failed logins on this connection, which is closed at maxLoginAttempts
+	log 		*slog.Logger // Logs with the remote address, the session ID and the username of the connection
+}
+
+// PendingLink is a login from a device which is not linked to the
+// account yet. It waits for '/linkDevice <code>' from a linked device.
+type PendingLink struct {
+	conn 		net.Conn
+	username	string
+	deviceID	string
+	key 		string
 }
 
 func NewClientState(conn net.Conn) *ClientState {
 
+	session := newSessionID()
 	return &ClientState{
 		conn: 	  conn,
 		username: "anonymous",
 		state: 	  LOGGED_OUT,
+		session:  session,
+		log: 	  connLogger(conn, session).With("user", "anonymous"),
 	}
 
 }
 
+// setUsername changes the user the connection is logged in as and the
+// username its log lines carry.
+//
+// Parameters:
+//	username - the user the connection is logged in as, "anonymous" if none
+func (cs *ClientState) setUsername(username string) {
+
+	cs.username = username
+	cs.log 		= connLogger(cs.conn, cs.session).With("user", username)
+
+}
+
 type Server struct {
 	listenAddr 	   	string
 	clientConns    	map[net.Conn]*ClientState // Maps from connection to client representation
-	clientConnsRev	map[string]*ClientState   // Maps from username to client representation
+	clientConnsRev	map[string]map[net.Conn]*ClientState // Maps from username to the client representations of every session of that user
 	chatRequests	map[string]string	// Maps requests from request recipient to sender of the request
 	qtChs 		   	map[net.Conn]chan struct{}
+	sessionPolicy	SessionPolicy
+	passwordPolicy	PasswordPolicy
+	pendingLinks	map[string]*PendingLink // Maps from link code to the device waiting to be linked
 	msgChannel	   	chan Message
 	mu  		   	sync.Mutex
 	usrPwdMap 	   	map[string]string
+	devices 	   	map[string]map[string]string // Maps from username to the public keys of the users devices by device ID
 	muShadow 	   	sync.Mutex
+	contacts 	   	map[string][]string // Maps from username to the contacts of the user
+	hiddenPresence 	map[string]bool 	// Users who appear offline to everyone else
+	blocked 	   	map[string][]string // Maps from username to the users blocked by the user
+	muContacts 	   	sync.Mutex 			// Locked after s.mu and s.muShadow
+	chatRequestLimit RateLimit
+	messageLimit 	RateLimit
+	packetLimit 	RateLimit
+	rateBuckets 	map[string]*tokenBucket // Maps from '<kind>:<username>' to the remaining chat requests or messages of the user
+	chatTimers 		map[string]time.Duration // Maps from chat file to the disappearing message timer of the chat, only holds chats which ever had a timer
+	chatIDs 		map[string][2]string // Maps from chat ID to the two members of the chat, in alphabetical order
+	chatIndexes 	map[string]*ChatIndex // Maps from chat file to the index of its records
+	queues 			map[string]*QueueState // Maps from the queue file of a device to what is queued in it, only holds queues which are not empty
+	tlsConfig 		*tls.Config 		// Wraps the connections in TLS if set
+	admins 			map[string]bool 	// The users who may use the admin commands
+	adminSocket 	string 				// The unix socket of the admin console, none if empty
+	banned 			map[string]bool 	// Users who may not log in
+	muAudit 		sync.Mutex 			// Protects the audit log file, auditHead and auditSeq
+	auditKeyPath 	string 				// The file holding the key of the audit log, outside of the data directory
+	auditKey 		[]byte 				// The key of the HMAC chaining the entries of the audit log
+	auditHead 		string 				// Hash of the last entry of the audit log
+	auditSeq 		int64 				// Sequence number of the last entry of the audit log
+	startedAt 		time.Time
+	stats 			*ServerStats
+	metricsAddr 	string 				// The address the metrics are served on, none if empty
+	metricsPublic 	bool 				// Whether metricsAddr may be an address which is not a loopback address
+	wsAddr 			string 				// The address the browser client and WebSocket connections are served on, none if empty
 }
 
 func NewServer(listenAddr string) *Server {
@@ -85,53 +224,156 @@ func NewServer(listenAddr string) *Server {
 	return &Server{
 		listenAddr:   	listenAddr,
 		clientConns:  	make(map[net.Conn]*ClientState),
-		clientConnsRev:	make(map[string]*ClientState),
+		clientConnsRev:	make(map[string]map[net.Conn]*ClientState),
 		chatRequests:   make(map[string]string),
 		qtChs:  	  	make(map[net.Conn]chan struct{}),
+		sessionPolicy:	defaultSessionPolicy,
+		passwordPolicy:	PasswordPolicy{MinLength: defaultMinPasswordLength, MinClasses: defaultMinPasswordClasses},
+		pendingLinks:	make(map[string]*PendingLink),
 		msgChannel:   	make(chan Message),
 		usrPwdMap: 	  	make(map[string]string),
+		devices: 	  	make(map[string]map[string]string),
+		contacts: 	  	make(map[string][]string),
+		hiddenPresence:	make(map[string]bool),
+		blocked: 	  	make(map[string][]string),
+		chatRequestLimit: defaultChatRequestLimit,
+		messageLimit: 	defaultMessageLimit,
+		packetLimit: 	defaultPacketLimit,
+		rateBuckets: 	make(map[string]*tokenBucket),
+		chatTimers: 	make(map[string]time.Duration),
+		chatIDs: 		make(map[string][2]string),
+		chatIndexes: 	make(map[string]*ChatIndex),
+		queues: 		make(map[string]*QueueState),
+		admins: 		make(map[string]bool),
+		banned: 		make(map[string]bool),
+		stats: 			newServerStats(),
 	}
 
 }
 
-// Start starts up the server by spawning 2 goroutines in order
-// to listen for incomming connections and process the input of the
-// clients.
-// It then blocks to receive a shutdown signal upon which
-// the 2 goroutines will shut down and finally the programm will terminate.
+// Start listens on the address of the server and serves the clients
+// until a shutdown signal is received.
 func (s *Server) Start() {
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	slog.Info("Setting up listener")
+	ln, err := net.Listen("tcp", s.listenAddr)
+	if err != nil {
+		slog.Error("Starting to listen for connections", "err", err)
+		return
+	}
+
+	if err := s.Serve(ctx, ln); err != nil {
+		slog.Error("Starting server failed. Aborting", "err", err)
+	}
+
+}
+
+// Serve loads the data of the server and spawns 3 goroutines in order
+// to accept connections on the given listener, process the input of the
+// clients and purge expired messages, and one more each for the admin
+// socket, the metrics endpoint and the WebSocket listener if there are
+// any.
+// It then blocks until the context is cancelled, upon which the
+// goroutines shut down and the data of the server is saved.
+// The listener is closed when Serve returns.
+// Returns an error if the data of the server could not be loaded.
+//
+// Parameters:
+// 	ctx - Context for cancellation of function
+// 	ln - the listener to accept client connections on
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	var wg sync.WaitGroup
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-
 	if !s.loadUserPasswordHashes() {
-		fmt.Println("[Error] Loading passwords failed. Aborting...")
-		return
+		return errors.New("loading passwords failed")
+	}
+
+	if !s.loadDevices() {
+		return errors.New("loading devices failed")
+	}
+
+	s.dropUnregisteredAdmins()
+
+	if !s.loadContacts() {
+		return errors.New("loading contacts failed")
+	}
+
+	if !s.loadBans() {
+		return errors.New("loading bans failed")
+	}
+
+	if !s.loadAuditLog() {
+		return errors.New("loading audit log failed")
+	}
+
+	if !s.recoverAccountChange() {
+		return errors.New("completing interrupted account change failed")
+	}
+
+	if !s.loadChatTimers() {
+		return errors.New("loading chat timers failed")
+	}
+
+	if !s.loadChatIDs() {
+		return errors.New("loading chat IDs failed")
+	}
+
+	if !s.loadQueues() {
+		return errors.New("loading queues failed")
 	}
 
-	wg.Add(2)
+	s.reportInvalidUsernames()
+
+	s.startedAt = time.Now()
+
+	wg.Add(3)
 	go s.processMessageChannelInput(ctx, &wg)
-	go s.acceptClientConnections(ctx, &wg)
+	go s.acceptClientConnections(ctx, &wg, ln)
+	go s.sweepExpiredMessages(ctx, &wg)
 
-	select {
-	case <-sigCh:
-		fmt.Println("[Log] Server Received shutdown signal. Initiating shutdown...")
-		cancel()
+	if s.adminSocket != "" {
+		wg.Add(1)
+		go s.serveAdminSocket(ctx, &wg)
+	}
+
+	if s.metricsAddr != "" {
+		wg.Add(1)
+		go s.serveMetrics(ctx, &wg)
 	}
 
+	if s.wsAddr != "" {
+		wg.Add(1)
+		go s.serveWebSocket(ctx, &wg)
+	}
+
+	<-ctx.Done()
+	slog.Info("Server Received shutdown signal. Initiating shutdown")
+
 	wg.Wait()
 
 	s.saveUserPasswordHashes()
+	s.saveDevices()
+
+	s.muAudit.Lock()
+	slog.Info("Closed audit log", "entries", s.auditSeq, "head", s.auditHead)
+	s.muAudit.Unlock()
 
-	fmt.Println("[Log] Shutdown complete.")
+	slog.Info("Shutdown complete")
+	return nil
 
 }
 
+
+
 // loadUserPasswordHashes reads from the shadow file which stores the
 // username-hash pairs for login verification and loads those values
 // into the servers usrPwdMap.
@@ -143,37 +385,37 @@ func (s *Server) loadUserPasswordHashes() bool {
 
 		err := os.MkdirAll(serverDataDir, 0700)
 		if err != nil {
-			fmt.Println("[Error] Creating directory for server data:", err)
+			slog.Error("Creating directory for server data", "err", err)
 			return false
 		}
 
 		pwdFile, err := os.Create(shadowPath)
 		if err != nil {
-			fmt.Println("[Error] Creating shadow file:", err)
+			slog.Error("Creating shadow file", "err", err)
 			return false
 		}
 		pwdFile.Close()
-		fmt.Println("[Log] No shadow file yet. Created it.")
+		slog.Info("No shadow file yet. Created it")
 		return true
 	}
 
 	pwdFile, err := os.Open(shadowPath)
 	if err != nil {
-		fmt.Println("[Error] Opening shadow file:", err)
+		slog.Error("Opening shadow file", "err", err)
 		return false
 	}
 	defer pwdFile.Close()
 
 	pwdFileLen, err := getFileSize(shadowPath)
 	if err != nil {
-		fmt.Println("[Error] Gettings length of file:", err)
+		slog.Error("Gettings length of file", "err", err)
 		return false
 	}
 
 	var buffer = make([]byte, pwdFileLen)
 	_, err = pwdFile.Read(buffer)
 	if err != nil {
-		fmt.Println("[Error] Reading shadow file:" ,err)
+		slog.Error("Reading shadow file", "err", err)
 		return false
 	}
 
@@ -185,16 +427,23 @@ func (s *Server) loadUserPasswordHashes() bool {
 			continue
 		}
 
-		entry := strings.Split(line, ":")
-		if len(entry) < 2 {
-			fmt.Printf("[Warning] Invalid shadow file entry: %s\n", line)
+		// Usernames registered before the username policy existed may contain ':'
+		separator := strings.LastIndex(line, ":")
+		if separator < 0 {
+			slog.Warn("Invalid shadow file entry")
 			continue
 		}
+		entry := []string{line[:separator], line[separator+1:]}
+
+		// Entries written before password hashes were hex encoded hold the raw hash
+		if len(entry[1]) == sha256.Size {
+			entry[1] = hex.EncodeToString([]byte(entry[1]))
+		}
 		s.usrPwdMap[entry[0]] = entry[1]
 
 	}
 
-	fmt.Println("[Log] Successfully loaded shadow file.")
+	slog.Info("Successfully loaded shadow file")
 	return true
 
 }
@@ -202,87 +451,154 @@ func (s *Server) loadUserPasswordHashes() bool {
 // saveUserPasswordHashes writes all the entries from the servers
 // usrPwdMap into a temporary shadow file. After that it overwrites
 // the original shadow file.
+// The function assumes that the s.muShadow Mutex is locked or that every
+// other goroutine has been canceled before.
 // Returns true on success and false otherwise.
 func (s *Server) saveUserPasswordHashes() bool {
 
-	fmt.Println("[Log] Writing user-passwordHash pairs to temporary shadow file...")
+	slog.Info("Writing user-passwordHash pairs to shadow file")
+
+	var builder strings.Builder
+	for user, pwdHsh := range s.usrPwdMap {
+		builder.WriteString(user + ":" + pwdHsh + "\n")
+	}
 
-	tempShadowFile, err := os.Create(tempShadowPath)
+	err := writeFileAtomic(shadowPath, []byte(builder.String()))
 	if err != nil {
-		fmt.Println("[Error] Creating tempShadowFile, aborting...:", err)
+		slog.Error("Writing shadow file, aborting", "err", err)
 		return false
 	}
-	defer tempShadowFile.Close()
 
-	// NOTE: Mutex muShadow not needed, because other threads have been canceled before.
-	for user, pwdHsh := range s.usrPwdMap {
+	slog.Info("Successfully saved user-passwordHash pairs")
 
-		line := user + ":" + pwdHsh + "\n"
+	return true
 
-		n, err := tempShadowFile.WriteString(line)
-		if err != nil {
-			fmt.Printf("[Error] Writing user-passwordHash pair of '%s' to temporary shadow file:\n%s\n", user, err)
-			return false
+}
+
+// loadDevices reads the devices file which stores the public keys of
+// every registered device and loads them into the servers devices map.
+// Every line of the file is of the pattern '<username>:<deviceID>:<publicKey>'.
+// If there is no devices file yet, the server starts without any devices.
+// Returns true on successfull loading and false otherwise
+func (s *Server) loadDevices() bool {
+
+	if !fileExists(devicesPath) {
+		slog.Info("No devices file yet")
+		return true
+	}
+
+	content, err := os.ReadFile(devicesPath)
+	if err != nil {
+		slog.Error("Reading devices file", "err", err)
+		return false
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
 		}
-		if n != len(line) {
-			fmt.Println("[Error] Couldn't write entire line into temporary shadow file.")
-			return false
+
+		// Usernames registered before the username policy existed may contain ':'
+		entry := strings.Split(line, ":")
+		if len(entry) < 3 {
+			slog.Warn("Invalid devices file entry", "entry", line)
+			continue
 		}
+		entry = []string{strings.Join(entry[:len(entry)-2], ":"), entry[len(entry)-2], entry[len(entry)-1]}
+		if !validDeviceID(entry[1]) {
+			slog.Warn("Invalid device ID in devices file", "entry", line)
+			continue
+		}
+
+		if _, ok := s.devices[entry[0]]; !ok {
+			s.devices[entry[0]] = make(map[string]string)
+		}
+		s.devices[entry[0]][entry[1]] = entry[2]
 
 	}
 
-	fmt.Println("[Log] Moving temporary shadow file to permanent shadow file...")
+	slog.Info("Successfully loaded devices file")
+	return true
+
+}
+
+// saveDevices writes all the entries from the servers devices map into
+// a temporary devices file. After that it overwrites the original
+// devices file.
+// The function assumes that the s.muShadow Mutex is locked or that every
+// other goroutine has been canceled before.
+// Returns true on success and false otherwise.
+func (s *Server) saveDevices() bool {
+
+	slog.Info("Writing devices to devices file")
+
+	var builder strings.Builder
+	for user, userDevices := range s.devices {
+		for deviceID, key := range userDevices {
+			builder.WriteString(user + ":" + deviceID + ":" + key + "\n")
+		}
+	}
 
-	err = os.Rename(tempShadowPath, shadowPath)
+	err := writeFileAtomic(devicesPath, []byte(builder.String()))
 	if err != nil {
-		fmt.Println("[Error] Moving temporary shadow file to permanent shadow file.")
+		slog.Error("Writing devices file, aborting", "err", err)
 		return false
 	}
 
-	fmt.Println("[Log] Successfully saved user-passwordHash pairs.")
+	slog.Info("Successfully saved devices")
 
 	return true
 
 }
 
-// acceptClientConnections starts a listener on the servers listenAddr.
-// It then waits for new incomming connections and spawns a new goroutine
-// per connection. If a cancellation signal is received via ctx, it waits 
-// for all the summoned goroutines to terminate and then returns.
+// acceptClientConnections waits for new incomming connections on the given
+// listener and spawns a new goroutine per connection. If a cancellation
+// signal is received via ctx, it waits for all the summoned goroutines to
+// terminate, closes the listener and then returns.
 //
 // Parameters:
 // 	ctx - Context for cancellation of function
 // 	mainWG - Waitgroup for syncing
-func (s *Server) acceptClientConnections(ctx context.Context, mainWG *sync.WaitGroup) {
+// 	tcpLn - the listener to accept connections on
+func (s *Server) acceptClientConnections(ctx context.Context, mainWG *sync.WaitGroup, tcpLn net.Listener) {
 
 	defer mainWG.Done()
 
 	var wg sync.WaitGroup
 
-	// Start listener
-	fmt.Println("[Log] Setting up listener...")
-	ln, err := net.Listen("tcp", s.listenAddr)
-	if err != nil {
-		fmt.Println("[Error] Starting to listen for connections:", err)
+	defer tcpLn.Close()
+
+	// Accept only waits until the deadline, so the context is checked regularly
+	deadlineLn, ok := tcpLn.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		slog.Error("Listener does not support deadlines")
 		return
 	}
-	defer ln.Close()
+
+	// The TLS handshake of a connection happens on its first read or write
+	ln := tcpLn
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(tcpLn, s.tlsConfig)
+		slog.Info("Connections are encrypted with TLS")
+	}
 
 	// Wait for incomming connections
-	fmt.Println("[Log] Now listening for incomming client connections...")
+	slog.Info("Now listening for incomming client connections")
 	for {
 
-		if err := ln.(*net.TCPListener).SetDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
-			fmt.Println("[Log] Error setting deadline for incomming client connections:", err)
+		if err := deadlineLn.SetDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+			slog.Error("Setting deadline for incomming client connections", "err", err)
 			return
 		}
 
 		select {
 		case <-ctx.Done():
-			fmt.Println("[Log] Shutting down: Accepting incomming client connections...")
-			fmt.Println("[Log] Waiting for client handlers to termiante...")
+			slog.Info("Shutting down: Accepting incomming client connections")
+			slog.Info("Waiting for client handlers to termiante")
 			wg.Wait()
-			fmt.Println("[Log] All client handlers terminated.")
+			slog.Info("All client handlers terminated")
 			return
 		default:
 			conn, err := ln.Accept()
@@ -290,10 +606,12 @@ func (s *Server) acceptClientConnections(ctx context.Context, mainWG *sync.WaitG
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
-				fmt.Println("[Error] Accepting incomming connection:", err)
+				slog.Error("Accepting incomming connection", "err", err)
 				continue
 			}
 
+			conn = &syncConn{Conn: &countingConn{Conn: conn, stats: s.stats}}
+
 			// Spawn client handler
 			wg.Add(1)
 			go s.handleClientConnection(ctx, &wg, conn)
@@ -317,11 +635,12 @@ func (s *Server) handleClientConnection(ctx context.Context,
 	 									wg *sync.WaitGroup, 
 	 									conn net.Conn) {
 
-	fmt.Println("[Log] Received new client. Setting up handler...")
+	slog.Info("Received new client. Setting up handler", "remote", conn.RemoteAddr().String())
 
 	defer func() {
 		s.mu.Lock()
-		delete(s.clientConnsRev, s.clientConns[conn].username)
+		s.removeSessionLocked(conn, LOGOUT_DISCONNECTED)
+		s.removePendingLinksLocked(conn)
 		delete(s.clientConns, conn)
 		delete(s.qtChs, conn)
 		s.mu.Unlock()
@@ -329,27 +648,51 @@ func (s *Server) handleClientConnection(ctx context.Context,
 		wg.Done()
 	}()
 
+	client := NewClientState(conn)
+	log := client.log
+
+	// Other connections add to s.qtChs while this one reads, so its quit channel is kept
+	quitCh := make(chan struct{})
+
 	s.mu.Lock()
-	s.clientConns[conn] = NewClientState(conn)
-	s.qtChs[conn] 		= make(chan struct{})
+	s.clientConns[conn] = client
+	s.qtChs[conn] 		= quitCh
 	s.mu.Unlock()
 
-	fmt.Println("[Log] New client is now set up.")
+	s.stats.connections.Add(1)
+	log.Info("New client is now set up")
+
+	// Packets of any type are limited by the connection they are read
+	// from. Packets beyond the limit are not dropped but read more slowly,
+	// so file transfers slow down instead of losing chunks
+	packets := &tokenBucket{tokens: float64(s.packetLimit.Burst), updated: time.Now()}
+
+	// Clients check new passwords against the password policy before hashing them
+	policyData, err := json.Marshal(s.passwordPolicy)
+	if err != nil {
+		log.Error("Marshalling password policy", "err", err)
+		return
+	}
+	err = writePacket(conn, Packet{MsgType: "POLICY", Payload: string(policyData)})
+	if err != nil {
+		log.Error("Sending password policy", "err", err)
+		return
+	}
 
 	for {
 
 		err := conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
 		if err != nil {
-			fmt.Printf("[Error|%s] Setting up Read deadline:\n%s\n",conn.RemoteAddr(),  err)
+			s.connLog(conn).Error("Setting up read deadline", "err", err)
 			return
 		}
 
 		select {
 		case <-ctx.Done():
-			fmt.Println("[Log] Shutting down client handler...")
+			s.connLog(conn).Info("Shutting down client handler")
 			return
-		case <-s.qtChs[conn]:
-			fmt.Println("[Log] Received '/quit' command. Shutting down connection.")
+		case <-quitCh:
+			s.connLog(conn).Info("Received '/quit' command. Shutting down connection")
 			return
 		default:
 			var length uint32
@@ -359,16 +702,16 @@ func (s *Server) handleClientConnection(ctx context.Context,
 					continue
 				}
 				if errLen == io.EOF {
-					fmt.Printf("[Log|%s] Client closed connection.\n", conn.RemoteAddr())
+					s.connLog(conn).Info("Client closed connection")
 					return
 				}
-				fmt.Println("[Error] Reading package length:", errLen)
+				s.connLog(conn).Error("Reading package length", "err", errLen)
 				return
 			}
 
 			// Extend deadline for reading the full payload
             if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-                fmt.Printf("[Error|%s] Setting payload read deadline: %v\n", conn.RemoteAddr(), err)
+                log.Error("Setting payload read deadline", "err", err)
                 return
             }
 
@@ -381,24 +724,39 @@ func (s *Server) handleClientConnection(ctx context.Context,
 					continue
 				}
 				if err == io.EOF {
-					fmt.Printf("[Log|%s] Client closed connection.\n", conn.RemoteAddr())
+					s.connLog(conn).Info("Client closed connection")
 					return
 				}
-				fmt.Println("[Error] Reading message from client:", err)
+				s.connLog(conn).Error("Reading message from client", "err", err)
 				return
 			}
 
 			var packet Packet
 			errJ := json.Unmarshal(data, &packet)
 			if errJ != nil {
-				fmt.Println("[Error] Unmarshalling failed:", errJ)
+				s.connLog(conn).Error("Unmarshalling failed", "err", errJ)
 				return
 			}
 
-			fmt.Println("Received:", packet.Payload)
+			s.stats.packets.Add(1)
+			s.connLog(conn).Debug("Received packet", "type", packet.MsgType, "size", len(packet.Payload))
+
+			if wait := packets.reserve(s.packetLimit, time.Now()); wait > 0 {
+				select {
+				case <-ctx.Done():
+					s.connLog(conn).Info("Shutting down client handler")
+					return
+				case <-quitCh:
+					s.connLog(conn).Info("Received '/quit' command. Shutting down connection")
+					return
+				case <-time.After(wait):
+				}
+			}
 
+			s.stats.dispatchQueue.Add(1)
 			s.msgChannel <- Message{
 				sender:  conn,
+				msgType: packet.MsgType,
 				payload: []byte(packet.Payload),
 			}
 		}
@@ -409,7 +767,8 @@ func (s *Server) handleClientConnection(ctx context.Context,
 
 // processMessageChannelInput listens to a channel into which every clients
 // handler sends the received messages. It then prints out the content and calls
-// the handler functions for the different commands.
+// the handler functions for the different commands. Chat messages and file
+// chunks are routed to the devices of their recipients.
 //
 // Parameters:
 // 	ctx - Context for cancellation of function
@@ -422,24 +781,59 @@ func (s *Server) processMessageChannelInput(ctx context.Context, wg *sync.WaitGr
 
 		select {
 		case <-ctx.Done():
-			fmt.Println("[Log] Shutting down: Processing of message channel...")
+			slog.Info("Shutting down: Processing of message channel")
 			return
 		case msg :=<- s.msgChannel:
-			fmt.Printf("[Log] Message received from %s:\n%s\n", msg.sender.RemoteAddr(), string(msg.payload))
-
+			s.stats.dispatchQueue.Add(-1)
+			if msg.msgType == "ADMIN" {
+				msg.reply <- s.runAdminCommand(ADMIN_CONSOLE, string(msg.payload))
+				continue
+			}
+			// Commands carry password hashes and chat messages are none of
+			// the servers business, so only the name of a command is logged
 			pld := string(msg.payload)
 			if strings.HasPrefix(pld, "/") {
-				fmt.Printf("[Log] Command from %s: '%s'.\n", msg.sender.RemoteAddr(), pld)
 				command := strings.Fields(pld)[0]
 				handler, ok := commands[command]
 				if !ok {
-					fmt.Printf("[Log] Command from %s was invalid: %s\n", msg.sender.RemoteAddr(), string(msg.payload))
+					s.stats.invalidCommands.Add(1)
+					s.connLog(msg.sender).Info("Invalid command", "command", command)
+					continue
+				}
+				s.connLog(msg.sender).Debug("Handling command", "command", command)
+				handlerStats := s.stats.handlers[command]
+				handlerStats.received.Add(1)
+
+				if command == "/newChat" && !s.allowOutgoing(msg.sender, "request") {
 					continue
 				}
 
+				started := time.Now()
 				handler(s, msg.sender, msg.payload)
+				handlerStats.observe(time.Since(started))
+				continue
+			}
 
+			handlerStats, ok := s.stats.handlers[msg.msgType]
+			if !ok {
+				continue
+			}
+			handlerStats.received.Add(1)
+			started := time.Now()
+
+			if msg.msgType == "MESSAGE" {
+				if !s.allowOutgoing(msg.sender, "message") {
+					continue
+				}
+				s.routeChatMessage(msg.sender, "CHAT", msg.payload)
+			} else if msg.msgType == "FILE" {
+				s.routeChatMessage(msg.sender, "FILE", msg.payload)
+			} else if msg.msgType == "RECEIPT" {
+				s.routeReadReceipt(msg.sender, msg.payload)
+			} else if msg.msgType == "SIGNAL" {
+				s.relaySignal(msg.sender, msg.payload)
 			}
+			handlerStats.observe(time.Since(started))
 		}
 
 	}
@@ -457,17 +851,13 @@ func (s *Server) processMessageChannelInput(ctx context.Context, wg *sync.WaitGr
 //	errMsg - the error message to print for context
 func (s *Server) sendMessageToClient(conn net.Conn, msg string, errMsg string) {
 
+	log := s.connLog(conn)
+
 	username := "anonymous"
 
 	s.mu.Lock()
 	_, exists := s.clientConnsRev[s.clientConns[conn].username]
-	fmt.Println("[Debugging] Current map:", s.clientConns)
-	fmt.Println("[Debugging] Current reverse map:", s.clientConnsRev)
-	fmt.Println("[Debugging] s.clientConns[conn] = ", s.clientConns[conn])
-	fmt.Println("[Debugging] s.clientConnsRev[s.clientConns[conn]] = ", s.clientConnsRev[s.clientConns[conn].username])
-	fmt.Println("[Debugging] s.clientConns[conn].state = ", s.clientConns[conn].state)
 	if exists {
-		// fmt.Println("[Debugging] user is loggin in. Personalizing message...")
 		username = s.clientConns[conn].username
 	}
 	s.mu.Unlock()
@@ -479,21 +869,9 @@ func (s *Server) sendMessageToClient(conn net.Conn, msg string, errMsg string) {
 		Payload: personalizedMsg,
 	}
 
-	jsonData, errJ := json.Marshal(packet)
-	if errJ != nil {
-		fmt.Println("[Error] Marshalling message to json format:", errJ)
-		return
-	}
-
-	length := uint32(len(jsonData))
-	errLen := binary.Write(conn, binary.BigEndian, length)
-	if errLen != nil {
-		fmt.Println("[Error] Sending message length:", errLen)
-	}
-
-	_, err := conn.Write(jsonData)
+	err := writePacket(conn, packet)
 	if err != nil {
-		fmt.Println(errMsg + ":", err)
+		log.Error(strings.TrimPrefix(errMsg, "[Error] "), "err", err)
 		return
 	}
 	return
@@ -512,6 +890,8 @@ func (s *Server) sendMessageToClient(conn net.Conn, msg string, errMsg string) {
 //	errMsg - the error message to print for context
 func (s *Server) sendMessageToClientLocked(conn net.Conn, msg string, errMsg string) {
 
+	log := s.connLogLocked(conn)
+
 	username := "anonymous"
 
 	_, exists := s.clientConnsRev[s.clientConns[conn].username]
@@ -526,419 +906,2466 @@ func (s *Server) sendMessageToClientLocked(conn net.Conn, msg string, errMsg str
 		Payload: personalizedMsg,
 	}
 
-	jsonData, errJ := json.Marshal(packet)
-	if errJ != nil {
-		fmt.Println("[Error] Marshalling message to json format:", errJ)
+	err := writePacket(conn, packet)
+	if err != nil {
+		log.Error(strings.TrimPrefix(errMsg, "[Error] "), "err", err)
 		return
 	}
 
-	length := uint32(len(jsonData))
-	errLen := binary.Write(conn, binary.BigEndian, length)
-	if errLen != nil {
-		fmt.Println("[Error] Sending message length:", errLen)
-	}
+}
 
-	_, err := conn.Write(jsonData)
-	if err != nil {
-		fmt.Println(errMsg + ":", err)
-		return
+// sendMessageToUserLocked sends the given message to every session the
+// given user is currently logged in with. If the user is offline, nothing
+// is sent.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	username - the user to send the message to
+// 	msg - the message to send
+//	errMsg - the error message to print for context
+func (s *Server) sendMessageToUserLocked(username string, msg string, errMsg string) {
+
+	for conn := range s.clientConnsRev[username] {
+		s.sendMessageToClientLocked(conn, msg, errMsg)
 	}
 
 }
 
-// -----------------------------
-// ---------- Handler ----------
-// -----------------------------
-
-// handleQuit closes the channel of the given connection to terminate a connection.
+// addSessionLocked logs the given connection in as the given user by
+// updating its client representation and adding it to the sessions of
+// that user. If it is the first session of the user, the contacts of the
+// user are informed that the user is online.
+// The function assumes that the s.mu Mutex is locked.
 //
-// Parameters
-// 	s - the server
-// 	conn - the connection which will be closed
-//	payload - the arguments of the command. Not used with this command.
-func handleQuit(s *Server, conn net.Conn, payload []byte) {
-
-	fmt.Printf("Handling '/quit' command from %s...\n", conn.RemoteAddr())
+// Parameters:
+//	conn - the connection to log in
+//	username - the user the connection is logged in as
+//	deviceID - the device the connection is logged in from
+func (s *Server) addSessionLocked(conn net.Conn, username string, deviceID string) {
+
+	s.clientConns[conn].setUsername(username)
+	s.clientConns[conn].deviceID = deviceID
+	s.clientConns[conn].state 	 = LOGGED_IN
+
+	_, wasOnline := s.clientConnsRev[username]
+	if !wasOnline {
+		s.clientConnsRev[username] = make(map[net.Conn]*ClientState)
+	}
+	s.clientConnsRev[username][conn] = s.clientConns[conn]
 
-	close(s.qtChs[conn])
+	if !wasOnline {
+		s.pushPresenceLocked(username, true)
+	}
 
 }
 
-// handleRegister checks if a given username is already registered
-// at the server. If it is not, a new user will be added to the server.
+// removeSessionLocked removes the given connection from the sessions of
+// the user it is logged in as and resets its client representation to
+// the logged out state. If it was the last session of that user, the user
+// is removed from the username-to-session map entirely and the contacts
+// of the user are informed that the user is offline. The logout is written
+// to the audit log along with the reason for it.
+// The function assumes that the s.mu Mutex is locked.
 //
 // Parameters:
-// 	s - the server
-// 	conn - the clients connection
-// 	payload - the arguments of the command. In this case: <command> <username> <password-hash>
-func handleRegister(s *Server, conn net.Conn, payload []byte) {
+//	conn - the connection to log out
+//	reason - why the session ends, e.g. LOGOUT_DISCONNECTED
+func (s *Server) removeSessionLocked(conn net.Conn, reason string) {
+
+	client, ok := s.clientConns[conn]
+	if !ok {
+		return
+	}
 
-	fmt.Printf("Handling '/register' command from %s...\n", conn.RemoteAddr())
+	sessions, ok := s.clientConnsRev[client.username]
+	if ok {
+		delete(sessions, conn)
+		if len(sessions) == 0 {
+			delete(s.clientConnsRev, client.username)
+			s.pushPresenceLocked(client.username, false)
+		}
+		s.audit(AuditEntry{Event: AUDIT_LOGOUT, Actor: client.username, Remote: conn.RemoteAddr().String(), Args: reason, Result: AUDIT_OK})
+	}
 
-	slicedPld := strings.Fields(string(payload))
-	username  := slicedPld[1]
-	pwdHsh 	  := slicedPld[2]
+	client.setUsername("anonymous")
+	client.deviceID = ""
+	client.state 	= LOGGED_OUT
 
-	// fmt.Printf("[Debugging] Received username: %s, password hash: %s\n", username, pwdHsh)
+}
 
-	s.muShadow.Lock()
-	_, exists := s.usrPwdMap[username]
-	if exists || username == "anonymous" {
-		fmt.Println("[Log] '/register' failed because of duplicate username.")
-		s.sendMessageToClientLocked(conn, "[Error] Username already exists. Please retry with different username.", "")
-		s.muShadow.Unlock()
+// closeConnectionLocked signals the handler of the given connection to
+// shut the connection down. Closing a connection which is already
+// shutting down has no effect.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	conn - the connection to close
+func (s *Server) closeConnectionLocked(conn net.Conn) {
+
+	qtCh, ok := s.qtChs[conn]
+	if !ok {
 		return
 	}
-	s.usrPwdMap[username] = pwdHsh
-	s.muShadow.Unlock()
-
-	fmt.Println("[Log] Successfully added new user to usrPwdMap.")
 
-	msg    := "A new user has been added: " + username
-	errMsg := "[Error|" + conn.RemoteAddr().String() + "] Writing 'new user added' message."
-	s.sendMessageToClient(conn, msg, errMsg)
+	select {
+	case <-qtCh:
+	default:
+		close(qtCh)
+	}
 
 }
 
-// handleHelp sends a list of all possible commands to the given user.
-// 
+// sendPacketToDeviceLocked sends the given packet to every session of the
+// given user which is logged in from the given device. If the device is
+// offline, the packet is queued and delivered once the device logs in.
+// Returns true if the packet was written to a session or to the queue.
+// The function assumes that the s.mu Mutex is locked.
+//
 // Parameters:
-// 	s - the server
-// 	conn - the clients connection
-// 	payload - the arguments of the command. Not used with this command.
-func handleHelp(s *Server, conn net.Conn, payload []byte) {
+//	username - the user the device belongs to
+//	deviceID - the device to send the packet to
+//	packet - the packet to send
+func (s *Server) sendPacketToDeviceLocked(username string, deviceID string, packet Packet) bool {
 
-	fmt.Printf("Handling '/help' command from %s...\n", conn.RemoteAddr())
+	delivered := false
+	for conn, client := range s.clientConnsRev[username] {
 
-	var builder strings.Builder
-	builder.Write([]byte("The following is a list of all available commands and their usecase:\n"))
-	for _, line := range commandDescriptions {
-		_, err := builder.Write([]byte(line + "\n"))
+		if client.deviceID != deviceID {
+			continue
+		}
+
+		err := writePacket(conn, packet)
 		if err != nil {
-			fmt.Println("[Error] Concatenation of command description failed:", err)
+			slog.Error("Writing packet", "type", packet.MsgType, "user", username, "device", deviceID, "remote", conn.RemoteAddr().String(), "err", err)
+			continue
+		}
+		delivered = true
 
-			msg := "[Error] Something went wrong at the server. Please try again..."
-			errMsg := "[Error] Writing 'failed concatenation' message to the client:"
-			s.sendMessageToClient(conn, msg, errMsg)
+	}
 
-			return
-		}
+	if !delivered {
+		return s.queuePacketLocked(username, deviceID, packet)
 	}
+	return true
 
-	msg    := builder.String()
-	errMsg := "[Error] Writing list of command descriptions to " + conn.RemoteAddr().String()
-	s.sendMessageToClient(conn, msg, errMsg)
+}
 
+// QueueState is what the server keeps in memory about the queue file of a
+// device, so neither the metrics nor the sweeper have to read the queues.
+type QueueState struct {
+	packets 	int
+	nextExpiry 	time.Time // The earliest expiry of a queued chat message, zero if none expires
 }
 
-// handleLogin maps a connection onto a user, thereby logging him in.
-// The function checks if the client is already logged in as another user
-// or if another client is logged in as the given user to avoid duplicate 
-// log ins. Invalid usernames and passwords are also checked. If valid 
-// credentials are provided and the user isn't already logged in, 
-// the servers maps are updated, to log the client in as a user.
+// add counts a packet appended to the queue.
 //
 // Parameters:
-// 	s - the server
-// 	conn - the clients connection
-// 	payload - the arguments of the command. In this case: <command> <username> <password-hash>
-func handleLogin(s *Server, conn net.Conn, payload []byte) {
+//	packet - the queued packet
+func (qs *QueueState) add(packet Packet) {
 
-	fmt.Printf("Handling '/login' command from %s...\n", conn.RemoteAddr())
+	qs.packets++
+	expires := packetExpiry(packet)
+	if !expires.IsZero() && (qs.nextExpiry.IsZero() || expires.Before(qs.nextExpiry)) {
+		qs.nextExpiry = expires
+	}
 
-	slicedPld  	  := strings.Fields(string(payload))
-	inputUsername := slicedPld[1]
-	inputPwdHsh   := slicedPld[2]
+}
 
-	// fmt.Printf("[Debugging] Received username: %s, password hash: %s as a login combination.\n", inputUsername, inputPwdHsh)
+// queuePacketLocked appends the given packet to the queue of the given
+// device. Every device has its own queue file in the servers queue
+// directory holding one json encoded packet per line.
+// Returns true if the packet was queued and false otherwise.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	username - the user the device belongs to
+//	deviceID - the device to queue the packet for
+//	packet - the packet to queue
+func (s *Server) queuePacketLocked(username string, deviceID string, packet Packet) bool {
 
-	// Handle login request while being logged in already
-	s.mu.Lock()
-	_, clientLoggedIn := s.clientConnsRev[s.clientConns[conn].username]
-	if clientLoggedIn {
-		fmt.Printf("[Log] '/login' as '%s' failed because client is already logged in as '%s'.\n", inputUsername, s.clientConns[conn].username)
-		msg    := "[Error] Login failed because you are already logged in as '" + s.clientConns[conn].username + "'. Please log out first in order to log back in as another user."
-		errMsg := "[Error] Failed writing 'already logged in as another user' message to " + conn.RemoteAddr().String()
-		s.sendMessageToClientLocked(conn, msg, errMsg)
+	queueDir := serverQueueDir + username + "/"
+	err := os.MkdirAll(queueDir, 0700)
+	if err != nil {
+		slog.Error("Creating queue directory", "err", err)
+		return false
+	}
 
-		s.mu.Unlock()
-		return
+	jsonData, err := json.Marshal(packet)
+	if err != nil {
+		slog.Error("Marshalling queued packet", "err", err)
+		return false
 	}
-	s.mu.Unlock()
 
-	// Handle duplicate login of two clients as the same user
+	queuePath := queueDir + deviceID
+	queueFile, err := os.OpenFile(queuePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		slog.Error("Opening queue file", "err", err)
+		return false
+	}
+	defer queueFile.Close()
+
+	_, err = queueFile.Write(append(jsonData, '\n'))
+	if err != nil {
+		slog.Error("Writing to queue file", "err", err)
+		return false
+	}
+	queue, ok := s.queues[queuePath]
+	if !ok {
+		queue = &QueueState{}
+		s.queues[queuePath] = queue
+	}
+	queue.add(packet)
+
+	slog.Info("Queued packet", "type", packet.MsgType, "user", username, "device", deviceID)
+	return true
+
+}
+
+// deliverQueuedPacketsLocked sends every packet which has been queued for
+// the device the given connection is logged in from. The queue is emptied
+// afterwards.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	conn - the connection of the device which just logged in
+func (s *Server) deliverQueuedPacketsLocked(conn net.Conn) {
+
+	log := s.connLogLocked(conn)
+
+	client    := s.clientConns[conn]
+	queuePath := serverQueueDir + client.username + "/" + client.deviceID
+	if !fileExists(queuePath) {
+		return
+	}
+
+	content, err := os.ReadFile(queuePath)
+	if err != nil {
+		log.Error("Reading queue file", "err", err)
+		return
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+
+		if line == "" {
+			continue
+		}
+
+		var packet Packet
+		err := json.Unmarshal([]byte(line), &packet)
+		if err != nil {
+			log.Warn("Invalid entry in queue file", "err", err)
+			continue
+		}
+
+		// The sweeper may not have purged the message yet
+		if packetExpired(packet, time.Now()) {
+			continue
+		}
+
+		err = writePacket(conn, packet)
+		if err != nil {
+			log.Error("Delivering queued packet", "err", err)
+			return
+		}
+
+	}
+
+	err = os.Remove(queuePath)
+	if err != nil {
+		log.Error("Removing queue file", "err", err)
+		return
+	}
+	delete(s.queues, queuePath)
+
+}
+
+// sendDeviceListLocked sends a "DEVICES" packet holding every registered
+// device of the given user to the given connection.
+// The function assumes that the s.mu and s.muShadow Mutexes are locked.
+//
+// Parameters:
+//	conn - the connection to send the device list to
+//	username - the user whose devices are sent
+func (s *Server) sendDeviceListLocked(conn net.Conn, username string) {
+
+	log := s.connLogLocked(conn)
+
+	deviceList := DeviceList{
+		Username: username,
+		Devices:  []DeviceInfo{},
+	}
+	for deviceID, key := range s.devices[username] {
+		deviceList.Devices = append(deviceList.Devices, DeviceInfo{ID: deviceID, Key: key})
+	}
+	sort.Slice(deviceList.Devices, func(i, j int) bool {
+		return deviceList.Devices[i].ID < deviceList.Devices[j].ID
+	})
+
+	jsonData, err := json.Marshal(deviceList)
+	if err != nil {
+		log.Error("Marshalling device list", "err", err)
+		return
+	}
+
+	err = writePacket(conn, Packet{MsgType: "DEVICES", Payload: string(jsonData)})
+	if err != nil {
+		log.Error("Writing device list", "err", err)
+	}
+
+}
+
+// removePendingLinksLocked drops every pending device link which was
+// started from the given connection.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	conn - the connection whose pending links are dropped
+func (s *Server) removePendingLinksLocked(conn net.Conn) {
+
+	for code, pending := range s.pendingLinks {
+		if pending.conn == conn {
+			delete(s.pendingLinks, code)
+		}
+	}
+
+}
+
+// routeChatMessage delivers an encrypted chat message to every device of
+// its recipient and to every other device of its sender. Messages
+// addressed to a chat ID go to the other member of the chat, an "ERROR"
+// packet is sent back if the sender is no member of it or has no chat
+// with the recipient. Devices which are offline receive the message once
+// they log in again. If the sender did not encrypt the message for every
+// device, the current device lists are sent back so the client can update
+// its keys. Messages to a user who blocked the sender are dropped
+// silently, the sender receives the usual receipt. Once a chat message
+// with an ID reached a device of the recipient, a "delivered" receipt is
+// sent to the sender.
+// Chat messages are recorded in the chat file, edits and deletions only if
+// they refer to an existing message of the sender.
+//
+// Parameters:
+//	conn - the connection of the sender
+//	deliveryType - the type of the packets delivered: "CHAT" for messages, "FILE" for file chunks
+//	payload - the json encoded ChatEnvelope
+func (s *Server) routeChatMessage(conn net.Conn, deliveryType string, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sender := s.clientConns[conn]
+
+	_, senderIsLoggedIn := s.clientConnsRev[sender.username]
+	if !senderIsLoggedIn {
+		log.Info("Chat message dropped. Client is not logged in")
+		msg    := "[Error] Message not sent as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	var envelope ChatEnvelope
+	err := json.Unmarshal(payload, &envelope)
+	if err != nil {
+		log.Info("Chat message dropped. Invalid format", "err", err)
+		msg    := "[Error] Message not sent because its format is invalid. Use '/chat <username>' to enter chat mode before writing messages."
+		errMsg := "[Error] Writing 'invalid message' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	if envelope.Action != "" && envelope.Action != CHAT_ACTION_EDIT && envelope.Action != CHAT_ACTION_DELETE {
+		log.Info("Chat message dropped. Unknown action", "action", envelope.Action)
+		msg    := "[Error] Message not sent because its action '" + envelope.Action + "' is unknown."
+		errMsg := "[Error] Writing 'unknown action' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	defer s.muShadow.Unlock()
+
+	if envelope.Chat != "" {
+		partner, isMember := s.chatPartnerLocked(envelope.Chat, sender.username)
+		if !isMember {
+			log.Info("Chat message dropped. Sender is no member of the chat", "chat", envelope.Chat)
+			s.sendChatErrorLocked(conn, ChatError{
+				ID: 	 envelope.ID,
+				Chat: 	 envelope.Chat,
+				Code: 	 CHAT_NOT_MEMBER,
+				Message: "Message not sent because you are no member of chat '" + envelope.Chat + "'.",
+			})
+			return
+		}
+		envelope.To = partner
+	}
+	envelope.To = s.resolveUsernameLocked(envelope.To)
+
+	// chat file names are of the pattern '<user1>:<user2>' in alphabetical username order
+	firstUser  := min(sender.username, envelope.To)
+	secondUser := max(sender.username, envelope.To)
+	chatPath   := serverChatDir + firstUser + ":" + secondUser
+
+	if !fileExists(chatPath) {
+		log.Info("Chat message dropped. Chat does not exist", "to", envelope.To)
+		s.sendChatErrorLocked(conn, ChatError{
+			ID: 	 envelope.ID,
+			Chat: 	 chatID(sender.username, envelope.To),
+			Code: 	 CHAT_NOT_MEMBER,
+			Message: "Message not sent. There is no chat with " + envelope.To + ". Use '/newChat " + envelope.To + "' to request one.",
+		})
+		return
+	}
+
+	// Messages to a user who blocked the sender only reach the other
+	// devices of the sender, the sender is not told about it and receives
+	// the usual "delivered" receipt
+	participants := []string{envelope.To}
+	s.muContacts.Lock()
+	isBlocked := s.isBlockedLocked(envelope.To, sender.username)
+	if isBlocked {
+		log.Info("Chat message dropped. Sender is blocked", "to", envelope.To)
+		participants = nil
+	}
+	s.muContacts.Unlock()
+	if sender.username != envelope.To {
+		participants = append(participants, sender.username)
+	}
+
+	// Chat messages disappear once the timer of the chat has run out
+	now := time.Now()
+	var expires time.Time
+	if timer := s.chatTimers[chatPath]; timer > 0 && deliveryType == "CHAT" {
+		expires = now.Add(timer)
+	}
+
+	// The ID of a message has to be unique within its chat. Edits,
+	// deletions and replies have to refer to a message of the chat which
+	// still exists and only the sender of a message may change it.
+	// Changes expire along with the message they change.
+	kind := CHAT_RECORD_MESSAGE
+	var index *ChatIndex
+	if deliveryType == "CHAT" && !isBlocked {
+
+		var err error
+		index, err = s.chatIndexLocked(chatPath)
+		if err != nil {
+			log.Error("Reading chat file", "err", err)
+			msg    := "[Error] Something went wrong at the server. Please try again..."
+			errMsg := "[Error] Writing 'failed reading chat' message to " + conn.RemoteAddr().String()
+			s.sendMessageToClientLocked(conn, msg, errMsg)
+			return
+		}
+
+		if index.taken(envelope.ID) {
+			log.Info("Chat message dropped. Its ID is taken", "to", envelope.To)
+			s.sendChatErrorLocked(conn, ChatError{
+				ID: 	 envelope.ID,
+				Chat: 	 chatID(sender.username, envelope.To),
+				Code: 	 CHAT_DUPLICATE_ID,
+				Message: "Message not sent because another message of the chat has the same ID.",
+			})
+			return
+		}
+
+	}
+	if deliveryType == "CHAT" && !isBlocked && (envelope.Action != "" || envelope.Ref != "") {
+
+		target, found := index.message(envelope.Ref)
+		if !found || (envelope.Action != "" && target.from != sender.username) {
+			log.Info("Chat message dropped. It refers to a message which does not exist or is not theirs", "to", envelope.To, "ref", envelope.Ref)
+			msg    := "[Error] Message not sent because the message it refers to does not exist, has disappeared or was not sent by you."
+			errMsg := "[Error] Writing 'invalid reference' message to " + conn.RemoteAddr().String()
+			s.sendMessageToClientLocked(conn, msg, errMsg)
+			return
+		}
+
+		switch envelope.Action {
+		case CHAT_ACTION_EDIT:
+			kind, expires = CHAT_RECORD_EDIT, target.expires
+		case CHAT_ACTION_DELETE:
+			kind, expires = CHAT_RECORD_DELETE, target.expires
+		}
+
+	}
+
+	if deliveryType == "CHAT" && !isBlocked {
+		record := ChatRecord{Kind: kind, ID: envelope.ID, Ref: envelope.Ref, From: sender.username, Time: now, Expires: expires}
+		if err := appendChatRecord(chatPath, record); err != nil {
+			log.Error("Recording chat message", "err", err)
+		} else {
+			index.add(record)
+		}
+		s.stats.chatMessages.Add(1)
+	}
+
+	missing := 0
+	reachedRecipient := false
+	for _, user := range participants {
+		for deviceID := range s.devices[user] {
+
+			if user == sender.username && deviceID == sender.deviceID {
+				continue
+			}
+
+			ciphertext, ok := envelope.Ciphertexts[deviceID]
+			if !ok {
+				missing++
+				continue
+			}
+
+			delivery := ChatDelivery{
+				ID: 		envelope.ID,
+				Chat: 		chatID(sender.username, envelope.To),
+				From: 		sender.username,
+				FromDevice: sender.deviceID,
+				FromKey: 	s.devices[sender.username][sender.deviceID],
+				To: 		envelope.To,
+				Action: 	envelope.Action,
+				Ref: 		envelope.Ref,
+				Ciphertext: ciphertext,
+				Expires: 	expires,
+			}
+			jsonData, err := json.Marshal(delivery)
+			if err != nil {
+				log.Error("Marshalling chat delivery", "err", err)
+				continue
+			}
+
+			reached := s.sendPacketToDeviceLocked(user, deviceID, Packet{MsgType: deliveryType, Payload: string(jsonData)})
+			if reached && user == envelope.To && user != sender.username {
+				reachedRecipient = true
+			}
+
+		}
+	}
+
+	if (reachedRecipient || isBlocked) && deliveryType == "CHAT" && envelope.ID != "" {
+		s.sendReceiptLocked(conn, Receipt{From: envelope.To, To: sender.username, IDs: []string{envelope.ID}, Status: "delivered"})
+	}
+
+	if missing > 0 {
+		log.Info("Chat message was not encrypted for every device", "to", envelope.To, "missing", missing)
+		msg    := fmt.Sprintf("[Warning] Your message was not delivered to %d device(s) because your device list is outdated. The device list has been updated for your next messages.", missing)
+		errMsg := "[Error] Writing 'outdated device list' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		for _, user := range participants {
+			s.sendDeviceListLocked(conn, user)
+		}
+	}
+
+}
+
+// sendReceiptLocked writes the given receipt to the given connection.
+// The function assumes that the s.mu Mutex is locked.
+//
+// Parameters:
+//	conn - the connection to send the receipt to
+//	receipt - the receipt to send
+func (s *Server) sendReceiptLocked(conn net.Conn, receipt Receipt) {
+
+	log := s.connLogLocked(conn)
+
+	jsonData, err := json.Marshal(receipt)
+	if err != nil {
+		log.Error("Marshalling receipt", "err", err)
+		return
+	}
+
+	err = writePacket(conn, Packet{MsgType: "RECEIPT", Payload: string(jsonData)})
+	if err != nil {
+		log.Error("Writing receipt", "err", err)
+	}
+
+}
+
+// routeReadReceipt forwards a "read" receipt of a client to every device
+// of the sender of the read messages. Devices which are offline receive
+// the receipt once they log in again. Receipts are only forwarded between
+// users who have a chat.
+//
+// Parameters:
+//	conn - the connection of the user who read the messages
+//	payload - the json encoded Receipt
+func (s *Server) routeReadReceipt(conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reader := s.clientConns[conn].username
+	if _, readerIsLoggedIn := s.clientConnsRev[reader]; !readerIsLoggedIn {
+		log.Info("Receipt dropped. Client is not logged in")
+		return
+	}
+
+	var receipt Receipt
+	err := json.Unmarshal(payload, &receipt)
+	if err != nil || receipt.Status != "read" || len(receipt.IDs) == 0 {
+		log.Info("Receipt dropped. Invalid format")
+		return
+	}
+	receipt.From = reader
+
+	s.muShadow.Lock()
+	defer s.muShadow.Unlock()
+
+	receipt.To = s.resolveUsernameLocked(receipt.To)
+	if !fileExists(chatFilePath(reader, receipt.To)) {
+		log.Info("Receipt dropped. Chat does not exist", "to", receipt.To)
+		return
+	}
+
+	jsonData, err := json.Marshal(receipt)
+	if err != nil {
+		log.Error("Marshalling receipt", "err", err)
+		return
+	}
+
+	for deviceID := range s.devices[receipt.To] {
+		s.sendPacketToDeviceLocked(receipt.To, deviceID, Packet{MsgType: "RECEIPT", Payload: string(jsonData)})
+	}
+
+}
+
+// relaySignal passes a signal of a client on to every session of the chat
+// partner it is meant for. Signals are ephemeral, so they are dropped if
+// the partner is offline instead of being queued, and they are dropped
+// silently if there is no chat between both users or the partner blocked
+// the sender.
+//
+// Parameters:
+//	conn - the connection of the sender
+//	payload - the json encoded Signal
+func (s *Server) relaySignal(conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sender := s.clientConns[conn].username
+	if _, senderIsLoggedIn := s.clientConnsRev[sender]; !senderIsLoggedIn {
+		return
+	}
+
+	var signal Signal
+	err := json.Unmarshal(payload, &signal)
+	if err != nil || (signal.Kind != SIGNAL_TYPING && signal.Kind != SIGNAL_STOPPED) {
+		log.Info("Signal dropped. Invalid format")
+		return
+	}
+	signal.From = sender
+
+	s.muShadow.Lock()
+	signal.To = s.resolveUsernameLocked(signal.To)
+	s.muShadow.Unlock()
+
+	sessions, recipientIsOnline := s.clientConnsRev[signal.To]
+	if !recipientIsOnline || signal.To == sender || !fileExists(chatFilePath(sender, signal.To)) {
+		return
+	}
+
+	s.muContacts.Lock()
+	isBlocked := s.isBlockedLocked(signal.To, sender)
+	s.muContacts.Unlock()
+	if isBlocked {
+		return
+	}
+
+	jsonData, err := json.Marshal(signal)
+	if err != nil {
+		log.Error("Marshalling signal", "err", err)
+		return
+	}
+	packet := Packet{MsgType: "SIGNAL", Payload: string(jsonData)}
+
+	for recipientConn := range sessions {
+		err := writePacket(recipientConn, packet)
+		if err != nil {
+			log.Error("Writing signal", "recipient", recipientConn.RemoteAddr().String(), "err", err)
+		}
+	}
+
+}
+
+// -----------------------------
+// ---------- Handler ----------
+// -----------------------------
+
+// handleQuit closes the channel of the given connection to terminate a connection.
+//
+// Parameters
+// 	s - the server
+// 	conn - the connection which will be closed
+//	payload - the arguments of the command. Not used with this command.
+func handleQuit(s *Server, conn net.Conn, payload []byte) {
+
+	s.mu.Lock()
+	s.closeConnectionLocked(conn)
+	s.mu.Unlock()
+
+}
+
+// handleRegister checks if a given username is already registered
+// at the server. If it is not, a new user will be added to the server.
+// The device the user registered from becomes the first device of the user.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <username> <password-hash> <deviceID> <public-key>
+func handleRegister(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 5 {
+		log.Info("'/register' failed because of a wrong number of arguments")
+		msg    := "[Error] Invalid '/register' command. Please use '/register <username>'."
+		errMsg := "[Error] Writing 'invalid register' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+	pwdHsh 	  := slicedPld[2]
+	deviceID  := slicedPld[3]
+	deviceKey := slicedPld[4]
+
+	if !validDeviceID(deviceID) {
+		log.Info("'/register' failed because of an invalid device ID")
+		msg    := "[Error] Registration failed because the ID of this device is invalid."
+		errMsg := "[Error] Writing 'invalid device ID' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+
+	username, err := normalizeUsername(slicedPld[1])
+	if err != nil {
+		log.Info("'/register' failed because of an invalid username", "err", err)
+		s.audit(AuditEntry{Event: AUDIT_REGISTER, Actor: slicedPld[1], Remote: conn.RemoteAddr().String(), Result: "invalid username"})
+		msg    := "[Error] Registration failed because " + err.Error() + "."
+		errMsg := "[Error] Writing 'invalid username' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+
+	if _, err := parsePublicKey(deviceKey); err != nil {
+		log.Info("'/register' failed because of an invalid device key", "err", err)
+		msg    := "[Error] Registration failed because the key of this device is invalid."
+		errMsg := "[Error] Writing 'invalid device key' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	if _, exists := s.findUsernameLocked(username, ""); exists {
+		log.Info("'/register' failed because of duplicate username")
+		s.audit(AuditEntry{Event: AUDIT_REGISTER, Actor: username, Remote: conn.RemoteAddr().String(), Result: "username taken"})
+		s.muShadow.Unlock()
+		s.sendMessageToClient(conn, "[Error] Username already exists. Please retry with different username. (" + USERNAME_TAKEN + ")", "")
+		return
+	}
+	// The name of an admin who deleted or renamed their account must not give the admin commands to someone else
+	if s.admins[username] {
+		log.Info("'/register' failed because the username belongs to an admin")
+		s.audit(AuditEntry{Event: AUDIT_REGISTER, Actor: username, Remote: conn.RemoteAddr().String(), Result: "admin username"})
+		s.muShadow.Unlock()
+		s.sendMessageToClient(conn, "[Error] Registration failed because this username is reserved.", "")
+		return
+	}
+	s.usrPwdMap[username] = pwdHsh
+	s.devices[username]   = map[string]string{deviceID: deviceKey}
+	s.muShadow.Unlock()
+
+	log.Info("Successfully added new user to usrPwdMap")
+	s.audit(AuditEntry{Event: AUDIT_REGISTER, Actor: username, Remote: conn.RemoteAddr().String(), Result: AUDIT_OK})
+
+	msg    := "A new user has been added: " + username
+	errMsg := "[Error|" + conn.RemoteAddr().String() + "] Writing 'new user added' message."
+	s.sendMessageToClient(conn, msg, errMsg)
+
+}
+
+// handleHelp sends a list of all possible commands to the given user.
+// 
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. Not used with this command.
+func handleHelp(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	var builder strings.Builder
+	builder.Write([]byte("The following is a list of all available commands and their usecase:\n"))
+	for _, line := range commandDescriptions {
+		_, err := builder.Write([]byte(line + "\n"))
+		if err != nil {
+			log.Error("Concatenation of command description failed", "err", err)
+
+			msg := "[Error] Something went wrong at the server. Please try again..."
+			errMsg := "[Error] Writing 'failed concatenation' message to the client:"
+			s.sendMessageToClient(conn, msg, errMsg)
+
+			return
+		}
+	}
+
+	// Admins are shown the admin commands as well
+	s.mu.Lock()
+	isAdmin := s.admins[s.clientConns[conn].username] && s.clientConns[conn].state != LOGGED_OUT
+	s.mu.Unlock()
+	if isAdmin {
+		builder.WriteString("Admin commands:\n" + strings.Join(adminCommandDescriptions[:], "\n") + "\n")
+	}
+
+	msg    := builder.String()
+	errMsg := "[Error] Writing list of command descriptions to " + conn.RemoteAddr().String()
+	s.sendMessageToClient(conn, msg, errMsg)
+
+}
+
+// handleLogin maps a connection onto a user, thereby logging him in.
+// The function checks if the client is already logged in as another user.
+// Invalid usernames and passwords are also checked. If the device the client
+// logs in from is not linked to the account yet, a link code is sent to it
+// instead and the login has to be confirmed from a linked device via
+// '/linkDevice <code>'. If another client is already logged in as the given
+// user, the servers sessionPolicy decides whether the login is rejected, the
+// old session is taken over or both sessions are kept. If the login is valid,
+// the servers maps are updated, to log the client in as a user, and queued
+// messages for the device are delivered.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <username> <password-hash> <deviceID> <public-key>
+func handleLogin(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	slicedPld  	  := strings.Fields(string(payload))
+	if len(slicedPld) != 5 {
+		log.Info("'/login' failed because of a wrong number of arguments")
+		msg    := "[Error] Invalid '/login' command. Please use '/login <username>'."
+		errMsg := "[Error] Writing 'invalid login' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+	inputPwdHsh   := slicedPld[2]
+	inputDeviceID := slicedPld[3]
+	inputKey 	  := slicedPld[4]
+
+	if !validDeviceID(inputDeviceID) {
+		log.Info("'/login' failed because of an invalid device ID")
+		msg    := "[Error] Login failed because the ID of this device is invalid."
+		errMsg := "[Error] Writing 'invalid device ID' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	inputUsername := s.resolveUsernameLocked(slicedPld[1])
+	s.muShadow.Unlock()
+
+	// Handle login request while being logged in already
+	s.mu.Lock()
+	_, clientLoggedIn := s.clientConnsRev[s.clientConns[conn].username]
+	if clientLoggedIn {
+		log.Info("'/login' failed because client is already logged in as another user", "login", inputUsername)
+		msg    := "[Error] Login failed because you are already logged in as '" + s.clientConns[conn].username + "'. Please log out first in order to log back in as another user."
+		errMsg := "[Error] Failed writing 'already logged in as another user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	// Handle duplicate login of two clients as the same user
+	s.mu.Lock()
+	_, userLoggedIn := s.clientConnsRev[inputUsername]
+	if userLoggedIn && s.sessionPolicy == SESSION_REJECT {
+		log.Info("'/login' failed because user was already logged in", "login", inputUsername)
+		msg    := "[Error] Login failed because user is already logged in."
+		errMsg := "[Error] Failed writing 'duplicate login' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	s.muShadow.Lock()
+	// Handle invalid username
+	pwdHsh, userExists := s.usrPwdMap[inputUsername]
+	if !userExists {
+		log.Info("'/login' failed because invalid username was given")
+		msg    := "[Error] Invalid combiation of username and password given."
+		errMsg := "[Error] Failed writin 'invalid username' message to " + conn.RemoteAddr().String()
+		s.muShadow.Unlock()
+		s.sendMessageToClient(conn, msg, errMsg)
+		s.failLogin(conn, inputUsername, "unknown user")
+		return
+	}
+
+	// Handle wrong password
+	if pwdHsh != inputPwdHsh {
+		log.Info("'/login' failed because invalid password hash was given")
+		msg    := "[Error] Invalid combiation of username and password given."
+		errMsg := "[Error] Writin 'wrong password' message to " + conn.RemoteAddr().String()
+		s.muShadow.Unlock()
+		s.sendMessageToClient(conn, msg, errMsg)
+		s.failLogin(conn, inputUsername, "wrong password")
+		return
+	}
+	s.muShadow.Unlock()
+
+	// Handle login of a banned user. Only those who know the password are
+	// told about the ban, so nobody can find out which accounts are banned
+	s.mu.Lock()
+	isBanned := s.banned[inputUsername]
+	s.mu.Unlock()
+	if isBanned {
+		log.Info("'/login' failed because the user is banned", "login", inputUsername)
+		msg    := "[Error] Login failed because this account is banned."
+		errMsg := "[Error] Writing 'banned' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		s.failLogin(conn, inputUsername, "banned")
+		return
+	}
+	s.muShadow.Lock()
+
+	// Handle the device the client logs in from
+	deviceKey, deviceIsLinked := s.devices[inputUsername][inputDeviceID]
+	if deviceIsLinked && deviceKey != inputKey {
+		log.Info("'/login' failed because the key of the device does not match", "login", inputUsername, "device", inputDeviceID)
+		msg    := "[Error] Login failed because the key of this device does not match the one registered for it."
+		errMsg := "[Error] Writing 'device key mismatch' message to " + conn.RemoteAddr().String()
+		s.muShadow.Unlock()
+		s.sendMessageToClient(conn, msg, errMsg)
+		s.failLogin(conn, inputUsername, "device key mismatch")
+		return
+	}
+	if !deviceIsLinked {
+		// The key of a new device is handed to every chat partner, who
+		// could not encrypt for the user anymore if it was invalid
+		if _, err := parsePublicKey(inputKey); err != nil {
+			log.Info("'/login' failed because of an invalid device key", "err", err)
+			msg    := "[Error] Login failed because the key of this device is invalid."
+			errMsg := "[Error] Writing 'invalid device key' message to " + conn.RemoteAddr().String()
+			s.muShadow.Unlock()
+			s.sendMessageToClient(conn, msg, errMsg)
+			return
+		}
+	}
+	if !deviceIsLinked && len(s.devices[inputUsername]) > 0 {
+		s.muShadow.Unlock()
+		s.startDeviceLink(conn, inputUsername, inputDeviceID, inputKey)
+		return
+	}
+	if !deviceIsLinked {
+		// Users registered before devices existed adopt their first device
+		s.devices[inputUsername] = map[string]string{inputDeviceID: inputKey}
+		log.Info("Registered first device of user", "login", inputUsername, "device", inputDeviceID)
+	}
+	s.muShadow.Unlock()
+
+	s.mu.Lock()
+	s.removePendingLinksLocked(conn)
+
+	// The new session is added first, so the user does not appear offline in between
+	s.addSessionLocked(conn, inputUsername, inputDeviceID)
+	log = s.clientConns[conn].log
+	log.Info("Logged in", "device", inputDeviceID)
+	s.clientConns[conn].failedLogins = 0
+	s.audit(AuditEntry{Event: AUDIT_LOGIN, Actor: inputUsername, Remote: conn.RemoteAddr().String(), Args: "device " + inputDeviceID, Result: AUDIT_OK})
+
+	// Kick all other sessions of the user if they are to be taken over
+	if s.sessionPolicy == SESSION_TAKEOVER {
+		for oldConn := range s.clientConnsRev[inputUsername] {
+			if oldConn == conn {
+				continue
+			}
+			log.Info("Session is taken over", "login", inputUsername, "old", oldConn.RemoteAddr().String())
+			msg    := "You have been logged out because '" + inputUsername + "' logged in from another connection. Closing this connection..."
+			errMsg := "[Error] Failed writing 'session taken over' message to " + oldConn.RemoteAddr().String()
+			s.sendMessageToClientLocked(oldConn, msg, errMsg)
+
+			s.removeSessionLocked(oldConn, LOGOUT_TAKEN_OVER)
+			s.closeConnectionLocked(oldConn)
+		}
+	}
+	s.mu.Unlock()
+
+	msg    := "Login successfull." 
+	errMsg := "[Error] Failed writing 'successfull login' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClient(conn, msg, errMsg)
+
+	// The client unlocks the data it protects with the password once the login is confirmed
+	err := writePacket(conn, Packet{MsgType: "AUTH", Payload: "login"})
+	if err != nil {
+		log.Error("Sending login confirmation", "err", err)
+	}
+
+	// Accounts registered before the username policy existed keep working, but are asked to choose a valid name
+	if canonical, err := normalizeUsername(inputUsername); err != nil || canonical != inputUsername {
+		reason := "it is not in its canonical form '" + canonical + "'"
+		if err != nil {
+			reason = err.Error()
+		}
+		msg    := "[Warning] Your username does not meet the username policy: " + reason + ". Please choose a new one with '/rename <newUsername>'."
+		errMsg := "[Error] Failed writing 'invalid username' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+	}
+
+	s.mu.Lock()
+	s.deliverQueuedPacketsLocked(conn)
+	s.mu.Unlock()
+
+}
+
+// failLogin counts a failed login, writes it to the audit log and closes
+// the connection once it failed maxLoginAttempts times in a row.
+//
+// Parameters:
+//	conn - the clients connection
+//	username - the user the client tried to log in as
+//	reason - why the login failed
+func (s *Server) failLogin(conn net.Conn, username string, reason string) {
+
+	s.stats.failedLogins.Add(1)
+	s.audit(AuditEntry{Event: AUDIT_LOGIN, Actor: username, Remote: conn.RemoteAddr().String(), Result: reason})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, ok := s.clientConns[conn]
+	if !ok {
+		return
+	}
+	client.failedLogins++
+	if client.failedLogins < maxLoginAttempts {
+		return
+	}
+
+	client.log.Info("Closing connection after too many failed logins", "attempts", client.failedLogins)
+	s.audit(AuditEntry{Event: AUDIT_LOCKOUT, Actor: username, Remote: conn.RemoteAddr().String(), Result: fmt.Sprintf("%d failed logins", client.failedLogins)})
+
+	msg    := fmt.Sprintf("[Error] Login failed %d times. Closing this connection...", client.failedLogins)
+	errMsg := "[Error] Writing 'too many failed logins' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
+	s.closeConnectionLocked(conn)
+
+}
+
+// handleLogout removes the clients entry from the username-to-connection map
+// thereby logging him out.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. Not used with this command.
+func handleLogout(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	s.removeSessionLocked(conn, LOGOUT_REQUESTED)
+	s.mu.Unlock()
+
+	msg := "Logout successfull."
+	errMsg := "[Error] Failed writing 'logout successfull' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClient(conn, msg, errMsg)
+
+	log.Info("Successfully logged out")
+
+}
+
+// handleNewChat sends a request out to a given user. It checks for multiple
+// conditions to be met in order for it to be a valid request:
+//  - The recipient must be a registered user.
+//  - The recipient must be logged in as user (currently online).
+//  - The sender must be logged in as a user.
+//  - The chat must not exist already.
+//  - There must not be a different chat request pending for the recipient.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. The recipient of the chat request.
+func handleNewChat(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	// Check if recipient is a registered user
+	s.muShadow.Lock()
+	reqRecipient := s.resolveUsernameLocked(strings.Fields(string(payload))[1])
+	_, isRegisteredUser := s.usrPwdMap[reqRecipient]
+	if !isRegisteredUser {
+		log.Info("Chat request aborted. Recipient is no registered user", "to", reqRecipient)
+		msg := "[Error] Chat request aborted. " + reqRecipient + " is no registered user."
+		errMsg := "[Error] Writing 'no registered user' message to " + conn.RemoteAddr().String()
+		s.muShadow.Unlock()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+	s.muShadow.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	
+	// Check if request initiator is logged in as a user
+	_, initiatorIsLoggedIn := s.clientConnsRev[s.clientConns[conn].username]
+	if !initiatorIsLoggedIn {
+		log.Info("Chat request aborted. Client is not logged in", "to", reqRecipient)
+		msg := "[Error] Chat request aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	// Check if other user is online
+	_, recipientIsOnline := s.clientConnsRev[reqRecipient]
+	if !recipientIsOnline {
+		log.Info("Chat request aborted. Recipient is offline", "to", reqRecipient)
+		msg := "[Error] Chat request aborted. " + reqRecipient + " is currently offline. Please try again later."
+		errMsg := "[Error] Writing 'recipient offline' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	// Check if chat already exists.
+	// chat file names are of the pattern '<user1>:<user2>' in alphabetical username order
+	firstUser  := min(s.clientConns[conn].username, reqRecipient)
+	secondUser := max(s.clientConns[conn].username, reqRecipient)
+	chatPath   := serverChatDir + firstUser + ":" + secondUser
+
+	if fileExists(chatPath) {
+		log.Info("Chat request aborted. Chat already exists", "to", reqRecipient)
+		msg := "[Error] Chat request aborted. This chat already exists."
+		errMsg := "[Error] Writing 'chat already exists' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	// Check for pending request
+	_, recipientHasPendingRequest := s.chatRequests[reqRecipient]
+	if recipientHasPendingRequest {
+		log.Info("Chat request aborted. Recipient already has a pending request", "to", reqRecipient)
+		msg := "[Error] Chat request aborted. " + reqRecipient + " already has a pending request."
+		errMsg := "[Error] Writing 'recipient has pending request' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	// Requests from blocked users are dropped without telling them
+	s.muContacts.Lock()
+	isBlocked := s.isBlockedLocked(reqRecipient, s.clientConns[conn].username)
+	s.muContacts.Unlock()
+	if isBlocked {
+		log.Info("Chat request dropped. Sender is blocked", "to", reqRecipient)
+		return
+	}
+
+	// Add request recipient to 'request-map'
+	s.chatRequests[reqRecipient] = s.clientConns[conn].username
+
+	// Send request message to user
+	msg := "You have recieved a chat request from " + s.clientConns[conn].username + ". Use '/accept' to accept that request or '/decline' to deny it."
+	errMsg := "[Error] Sending chat request to " + reqRecipient
+	s.sendMessageToUserLocked(reqRecipient, msg, errMsg)
+
+}
+
+// handleAccept checks if there is a pending chat request for the user
+// the client is logged in as. If there is one, that request is accepted.
+// Both request sender and acceptor are being notified that a new 
+// chat is created. 
+// Also checks for no duplicate chats and creates chat directory
+// if it does not exist yet.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. Not used with this command.
+func handleAccept(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requestInitiator := s.chatRequests[s.clientConns[conn].username]
+	requestAcceptor  := s.clientConns[conn].username
+
+	// Check if pending request exists
+	_, reqIsPending := s.chatRequests[requestAcceptor]
+	if !reqIsPending {
+		log.Info("Invalid '/accept' command. No request pending")
+		msg := "[Error] '/accept' command aborted. There is no pending requst." 
+		errMsg := "[Error] Writing 'no pending request' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	// Send acceptance message
+	log.Debug("Request accepted")
+	msg    := requestAcceptor + " accepted your request."
+	errMsg := "[Error] Writing 'request accepted' message to " + requestInitiator
+	s.sendMessageToUserLocked(requestInitiator, msg, errMsg)
+
+	// Determine chat participants in alphabetical order
+	// chat file names are of the pattern '<user1>:<user2>' in alphabetical username order
+	firstUser        := min(requestInitiator, requestAcceptor)
+	secondUser       := max(requestInitiator, requestAcceptor)
+	chatPath         := serverChatDir + firstUser + ":" + secondUser
+
+	// Create chat directory if it doesn't exist
+	if !fileExists(serverChatDir) {
+
+		err := os.MkdirAll(serverChatDir, 0700)
+		if err != nil {
+			log.Error("Creating directory for chats", "err", err)
+			return
+		}
+
+	}
+
+	// Create new chat file
+	chatFile, err := os.Create(chatPath)
+	if err != nil {
+		log.Error("Creating new chat", "err", err)
+		msg    := "[Error] An error occured while creating the new chat file."
+		errMsg := "[Error] Writing 'error while creating chat file' message to " + requestInitiator + ", " + requestAcceptor
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		s.sendMessageToUserLocked(requestInitiator, msg, errMsg)
+		return
+	}
+	defer chatFile.Close()
+	s.chatIDs[chatID(firstUser, secondUser)] = [2]string{firstUser, secondUser}
+	s.chatIndexes[chatPath] = newChatIndex(nil)
+
+	log.Info("Successfully created new chat file", "file", chatFile)
+	msg    = "Successfully created new chat."
+	errMsg = "[Error] Writing 'successfull chat creation' message to " + requestInitiator + ", " + requestAcceptor
+	s.sendMessageToClientLocked(conn, msg, errMsg)
+	s.sendMessageToUserLocked(requestInitiator, msg, errMsg)
+
+	delete(s.chatRequests, s.clientConns[conn].username)
+
+}
+
+// handleDecline checks if there is a pending chat-request for the
+// user the client is logged in as. If so, that request is deleted
+// from the map of requests and thereby declined. A notifcation message
+// is sent to the sender of the request.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. Not used with this command.
+func handleDecline(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check if pending request exists
+	_, reqIsPending := s.chatRequests[s.clientConns[conn].username]
+	if !reqIsPending {
+		log.Info("Invalid '/decline' command. No request pending")
+		msg := "[Error] '/decline' command aborted. There is no pending requst." 
+		errMsg := "[Error] Writing 'no pending request' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	log.Debug("Request declined")
+	msg    := s.clientConns[conn].username + " declined your request."
+	errMsg := "[Error] Writing 'request declined' message to " + s.chatRequests[s.clientConns[conn].username]
+	s.sendMessageToUserLocked(s.chatRequests[s.clientConns[conn].username], msg, errMsg)
+
+	delete(s.chatRequests, s.clientConns[conn].username)
+
+}
+
+// startDeviceLink puts a login from a device which is not linked to the
+// account yet on hold. A link code is sent to the new device and every
+// other session of the user is informed that a device is waiting to be
+// linked. The code has to be entered on a linked device via
+// '/linkDevice <code>' to prove that the owner of the account has access
+// to both devices.
+//
+// Parameters:
+// 	conn - the connection of the new device
+// 	username - the user the device is supposed to be linked to
+// 	deviceID - the ID of the new device
+// 	key - the public key of the new device
+func (s *Server) startDeviceLink(conn net.Conn, username string, deviceID string, key string) {
+
+	log := s.connLog(conn)
+
+	rawCode := make([]byte, 4)
+	_, err := rand.Read(rawCode)
+	if err != nil {
+		log.Error("Generating link code", "err", err)
+		msg    := "[Error] Something went wrong at the server. Please try again..."
+		errMsg := "[Error] Writing 'link code failed' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClient(conn, msg, errMsg)
+		return
+	}
+	code := strings.ToUpper(hex.EncodeToString(rawCode))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removePendingLinksLocked(conn)
+	s.pendingLinks[code] = &PendingLink{
+		conn: 	  conn,
+		username: username,
+		deviceID: deviceID,
+		key: 	  key,
+	}
+	s.clientConns[conn].state = LINKING
+
+	log.Info("Device is waiting to be linked", "login", username, "device", deviceID)
+
+	msg    := "This device is not linked to '" + username + "' yet. Use '/linkDevice " + code + "' on one of your linked devices to link it."
+	errMsg := "[Error] Writing 'link code' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
+
+	msg    = "A new device wants to be linked to your account. If this is you, use '/linkDevice <code>' with the code shown on the new device."
+	errMsg = "[Error] Writing 'device waiting for link' message to " + username
+	s.sendMessageToUserLocked(username, msg, errMsg)
+
+}
+
+// handleLinkDevice links the device waiting with the given link code to
+// the account of the client. The client must be logged in as the same
+// user the new device tried to log in as. The new device is informed and
+// has to log in again afterwards.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <link-code>
+func handleLinkDevice(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 2 {
+		msg    := "[Error] Invalid '/linkDevice' command. Please use '/linkDevice <code>'."
+		errMsg := "[Error] Writing 'invalid linkDevice' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	code := strings.ToUpper(slicedPld[1])
+
+	client := s.clientConns[conn]
+	_, clientIsLoggedIn := s.clientConnsRev[client.username]
+	if !clientIsLoggedIn {
+		log.Info("'/linkDevice' aborted. Client is not logged in")
+		msg    := "[Error] Linking aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	pending, ok := s.pendingLinks[code]
+	if !ok || pending.username != client.username {
+		log.Info("'/linkDevice' aborted. No matching device is waiting")
+		msg    := "[Error] Linking aborted. No device with this code is waiting to be linked to your account."
+		errMsg := "[Error] Writing 'no pending link' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	s.devices[client.username][pending.deviceID] = pending.key
+	s.muShadow.Unlock()
+
+	delete(s.pendingLinks, code)
+	if pendingClient, ok := s.clientConns[pending.conn]; ok {
+		pendingClient.state = LOGGED_OUT
+	}
+
+	log.Info("Linked device", "device", pending.deviceID)
+
+	msg    := "This device has been linked to '" + client.username + "'. Please log in again."
+	errMsg := "[Error] Writing 'device linked' message to " + pending.conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(pending.conn, msg, errMsg)
+
+	msg    = "Device " + pending.deviceID + " has been linked to your account."
+	errMsg = "[Error] Writing 'device linked' message to " + client.username
+	s.sendMessageToUserLocked(client.username, msg, errMsg)
+
+}
+
+// handleUnlinkDevice removes one of the other devices of the client from
+// its account. Every session of that device is logged out and closed and
+// messages queued for it are dropped.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <deviceID>
+func handleUnlinkDevice(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 2 {
+		msg    := "[Error] Invalid '/unlinkDevice' command. Please use '/unlinkDevice <deviceID>'."
+		errMsg := "[Error] Writing 'invalid unlinkDevice' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	deviceID := slicedPld[1]
+
+	client := s.clientConns[conn]
+	_, clientIsLoggedIn := s.clientConnsRev[client.username]
+	if !clientIsLoggedIn {
+		log.Info("'/unlinkDevice' aborted. Client is not logged in")
+		msg    := "[Error] Unlinking aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	if deviceID == client.deviceID {
+		msg    := "[Error] Unlinking aborted. You can not unlink the device you are currently using."
+		errMsg := "[Error] Writing 'unlink own device' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	_, deviceExists := s.devices[client.username][deviceID]
+	if !deviceExists {
+		s.muShadow.Unlock()
+		msg    := "[Error] Unlinking aborted. There is no device " + deviceID + " linked to your account."
+		errMsg := "[Error] Writing 'unknown device' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	delete(s.devices[client.username], deviceID)
+	s.muShadow.Unlock()
+
+	for sessionConn, session := range s.clientConnsRev[client.username] {
+		if session.deviceID != deviceID {
+			continue
+		}
+		msg    := "This device has been unlinked from your account. Closing this connection..."
+		errMsg := "[Error] Writing 'device unlinked' message to " + sessionConn.RemoteAddr().String()
+		s.sendMessageToClientLocked(sessionConn, msg, errMsg)
+
+		s.removeSessionLocked(sessionConn, LOGOUT_UNLINKED)
+		s.closeConnectionLocked(sessionConn)
+	}
+
+	queuePath := serverQueueDir + client.username + "/" + deviceID
+	if fileExists(queuePath) {
+		err := os.Remove(queuePath)
+		if err != nil {
+			log.Error("Removing queue file of unlinked device", "err", err)
+		} else {
+			delete(s.queues, queuePath)
+		}
+	}
+
+	log.Info("Unlinked device", "device", deviceID)
+
+	msg    := "Device " + deviceID + " has been unlinked from your account."
+	errMsg := "[Error] Writing 'device unlinked' message to " + client.username
+	s.sendMessageToUserLocked(client.username, msg, errMsg)
+
+}
+
+// handleDevices sends the registered devices of every given user to the
+// client as "DEVICES" packets. The client needs them to encrypt chat
+// messages for every device of a user.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <username>...
+func handleDevices(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) < 2 {
+		msg    := "[Error] Invalid '/devices' command. Please use '/devices <username>'."
+		errMsg := "[Error] Writing 'invalid devices' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	_, clientIsLoggedIn := s.clientConnsRev[s.clientConns[conn].username]
+	if !clientIsLoggedIn {
+		log.Info("'/devices' aborted. Client is not logged in")
+		msg    := "[Error] Listing devices aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	defer s.muShadow.Unlock()
+
+	for _, username := range slicedPld[1:] {
+
+		username = s.resolveUsernameLocked(username)
+		if _, isRegisteredUser := s.usrPwdMap[username]; !isRegisteredUser {
+			msg    := "[Error] " + username + " is no registered user."
+			errMsg := "[Error] Writing 'no registered user' message to " + conn.RemoteAddr().String()
+			s.sendMessageToClientLocked(conn, msg, errMsg)
+			continue
+		}
+
+		s.sendDeviceListLocked(conn, username)
+
+	}
+
+}
+
+// reauthenticateLocked checks that the given connection is logged in and
+// that the given password hash is the one of the user it is logged in as.
+// Changes to an account require the password again, so an unattended
+// session can not be used to take the account over. If a check fails, an
+// error message is sent to the client.
+// Returns the client representation of the connection and whether both
+// checks passed.
+// The function assumes that the s.mu and s.muShadow Mutexes are locked.
+//
+// Parameters:
+//	conn - the clients connection
+//	command - the command which requires the password, used in messages
+//	pwdHsh - the password hash given with the command
+func (s *Server) reauthenticateLocked(conn net.Conn, command string, pwdHsh string) (*ClientState, bool) {
+
+	log := s.connLogLocked(conn)
+
+	client := s.clientConns[conn]
+	_, clientIsLoggedIn := s.clientConnsRev[client.username]
+	if !clientIsLoggedIn {
+		log.Info("Command aborted. Client is not logged in", "command", command)
+		msg    := "[Error] '" + command + "' aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return client, false
+	}
+
+	if s.usrPwdMap[client.username] != pwdHsh {
+		log.Info("Command aborted because of a wrong password", "command", command)
+		msg    := "[Error] '" + command + "' aborted. The given password is wrong."
+		errMsg := "[Error] Writing 'wrong password' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return client, false
+	}
+
+	return client, true
+
+}
+
+// handlePasswd changes the password of the user the client is logged in
+// as. The current password has to be given again. The shadow file is
+// written right away, so the new password survives a crash of the server.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <old-password-hash> <new-password-hash>
+func handlePasswd(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 3 {
+		msg    := "[Error] Invalid '/passwd' command. Please use '/passwd'."
+		errMsg := "[Error] Writing 'invalid passwd' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	defer s.muShadow.Unlock()
+
+	client, ok := s.reauthenticateLocked(conn, "/passwd", slicedPld[1])
+	if !ok {
+		return
+	}
+
+	oldPwdHsh := s.usrPwdMap[client.username]
+	s.usrPwdMap[client.username] = slicedPld[2]
+	if !s.saveUserPasswordHashes() {
+		s.usrPwdMap[client.username] = oldPwdHsh
+		msg    := "[Error] Changing the password failed. Your old password is still valid."
+		errMsg := "[Error] Writing 'password change failed' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	log.Info("Changed the password")
+
+	for sessionConn := range s.clientConnsRev[client.username] {
+		msg    := "The password of your account has been changed from another session."
+		errMsg := "[Error] Writing 'password changed' message to " + sessionConn.RemoteAddr().String()
+		if sessionConn == conn {
+			msg = "Your password has been changed."
+		}
+		s.sendMessageToClientLocked(sessionConn, msg, errMsg)
+	}
+
+	// The client protects its local data with the new password from now on
+	err := writePacket(conn, Packet{MsgType: "AUTH", Payload: "passwd"})
+	if err != nil {
+		log.Error("Sending password change confirmation", "err", err)
+	}
+
+}
+
+// handleDeleteAccount deletes the account of the user the client is
+// logged in as after the password has been given again. Every chat of the
+// user, every chat request from or to the user, every device waiting to
+// be linked to the account and every queued message of the user is
+// removed as well. Chat partners who are online are informed and every
+// session of the user is logged out. Sessions on other connections are
+// closed.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <password-hash>
+func handleDeleteAccount(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 2 {
+		msg    := "[Error] Invalid '/deleteAccount' command. Please use '/deleteAccount'."
+		errMsg := "[Error] Writing 'invalid deleteAccount' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	defer s.muShadow.Unlock()
+
+	client, ok := s.reauthenticateLocked(conn, "/deleteAccount", slicedPld[1])
+	if !ok {
+		return
+	}
+	username := client.username
+
+	partners, err := chatPartnersOf(username)
+	if err != nil {
+		log.Error("Listing chats of deleted account", "err", err)
+	}
+
+	err = beginAccountChange("delete", username)
+	if err != nil {
+		log.Error("Writing account journal", "err", err)
+		msg    := "[Error] Deleting your account failed. Nothing has been changed."
+		errMsg := "[Error] Writing 'delete account failed' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	err = s.deleteAccountDataLocked(username)
+	if err != nil {
+		log.Error("Deleting account", "err", err)
+		msg    := "[Error] Deleting your account could not be completed. The server will complete it on its next start."
+		errMsg := "[Error] Writing 'delete account incomplete' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	finishAccountChange()
+
+	log.Info("Deleted account", "account", username)
+
+	for recipient, sender := range s.chatRequests {
+		if recipient == username {
+			delete(s.chatRequests, recipient)
+			msg    := "Your chat request to " + username + " has been dropped because " + username + " deleted their account."
+			errMsg := "[Error] Writing 'request dropped' message to " + sender
+			s.sendMessageToUserLocked(sender, msg, errMsg)
+		} else if sender == username {
+			delete(s.chatRequests, recipient)
+			msg    := "The chat request from " + username + " has been withdrawn because " + username + " deleted their account."
+			errMsg := "[Error] Writing 'request withdrawn' message to " + recipient
+			s.sendMessageToUserLocked(recipient, msg, errMsg)
+		}
+	}
+
+	for code, pending := range s.pendingLinks {
+		if pending.username != username {
+			continue
+		}
+		delete(s.pendingLinks, code)
+		if pendingClient, ok := s.clientConns[pending.conn]; ok {
+			pendingClient.state = LOGGED_OUT
+		}
+		msg    := "The account '" + username + "' this device was waiting to be linked to has been deleted."
+		errMsg := "[Error] Writing 'account deleted' message to " + pending.conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(pending.conn, msg, errMsg)
+	}
+
+	for _, partner := range partners {
+		if partner == username {
+			continue
+		}
+		msg    := username + " deleted their account. Your chat with " + username + " has been deleted."
+		errMsg := "[Error] Writing 'chat partner deleted' message to " + partner
+		s.sendMessageToUserLocked(partner, msg, errMsg)
+	}
+
+	for sessionConn := range s.clientConnsRev[username] {
+		if sessionConn == conn {
+			continue
+		}
+		msg    := "This account has been deleted from another session. Closing this connection..."
+		errMsg := "[Error] Writing 'account deleted' message to " + sessionConn.RemoteAddr().String()
+		s.sendMessageToClientLocked(sessionConn, msg, errMsg)
+
+		s.removeSessionLocked(sessionConn, LOGOUT_ACCOUNT_DELETED)
+		s.closeConnectionLocked(sessionConn)
+	}
+	s.removeSessionLocked(conn, LOGOUT_ACCOUNT_DELETED)
+
+	msg    := "Your account '" + username + "' has been deleted."
+	errMsg := "[Error] Writing 'account deleted' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
+
+}
+
+// handleRename changes the name of the user the client is logged in as
+// after the password has been given again. Chats, devices, queued
+// messages, pending chat requests and every session move to the new name.
+// Every device of the user and of the users chat partners receives a
+// "RENAMED" packet, so the clients can move their sessions to the new
+// name. Devices which are offline receive it on their next login.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <new-username> <password-hash>
+func handleRename(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 3 {
+		msg    := "[Error] Invalid '/rename' command. Please use '/rename <newUsername>'."
+		errMsg := "[Error] Writing 'invalid rename' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	defer s.muShadow.Unlock()
+
+	client, ok := s.reauthenticateLocked(conn, "/rename", slicedPld[2])
+	if !ok {
+		return
+	}
+	oldName := client.username
+
+	newName, err := normalizeUsername(slicedPld[1])
+	if err != nil {
+		log.Info("'/rename' failed because of an invalid username", "err", err)
+		msg    := "[Error] Renaming aborted because " + err.Error() + "."
+		errMsg := "[Error] Writing 'invalid username' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	// A user may rename an old account to its own canonical form, e.g. 'Alice' to 'alice'
+	if _, exists := s.findUsernameLocked(newName, oldName); exists || newName == oldName {
+		log.Info("'/rename' failed because the username already exists", "new", newName)
+		msg    := "[Error] Username already exists. Please retry with different username. (" + USERNAME_TAKEN + ")"
+		errMsg := "[Error] Writing 'duplicate username' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	if s.admins[newName] {
+		log.Info("'/rename' failed because the username belongs to an admin", "new", newName)
+		msg    := "[Error] Renaming aborted because this username is reserved."
+		errMsg := "[Error] Writing 'admin username' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	partners, err := chatPartnersOf(oldName)
+	if err != nil {
+		log.Error("Listing chats of renamed account", "err", err)
+	}
+
+	err = beginAccountChange("rename", oldName, newName)
+	if err != nil {
+		log.Error("Writing account journal", "err", err)
+		msg    := "[Error] Renaming your account failed. Nothing has been changed."
+		errMsg := "[Error] Writing 'rename failed' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	err = s.renameAccountDataLocked(oldName, newName)
+	if err != nil {
+		log.Error("Renaming account", "new", newName, "err", err)
+		msg    := "[Error] Renaming your account could not be completed. The server will complete it on its next start."
+		errMsg := "[Error] Writing 'rename incomplete' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	finishAccountChange()
+
+	log.Info("Renamed account", "old", oldName, "new", newName)
+
+	// Move every session to the new name
+	sessions := s.clientConnsRev[oldName]
+	delete(s.clientConnsRev, oldName)
+	s.clientConnsRev[newName] = sessions
+	for _, session := range sessions {
+		session.setUsername(newName)
+	}
+
+	renamedRequests := make(map[string]string)
+	for recipient, sender := range s.chatRequests {
+		if recipient == oldName {
+			recipient = newName
+		}
+		if sender == oldName {
+			sender = newName
+		}
+		renamedRequests[recipient] = sender
+	}
+	s.chatRequests = renamedRequests
+
+	for _, pending := range s.pendingLinks {
+		if pending.username == oldName {
+			pending.username = newName
+		}
+	}
+
+	jsonData, err := json.Marshal(AccountRename{Old: oldName, New: newName})
+	if err != nil {
+		log.Error("Marshalling rename notification", "err", err)
+		return
+	}
+	packet := Packet{MsgType: "RENAMED", Payload: string(jsonData)}
+
+	notified := []string{newName}
+	for _, partner := range partners {
+		if partner != oldName {
+			notified = append(notified, partner)
+		}
+	}
+	for _, user := range notified {
+		for deviceID := range s.devices[user] {
+			s.sendPacketToDeviceLocked(user, deviceID, packet)
+		}
+	}
+
+	msg    := "Your username has been changed from '" + oldName + "' to '" + newName + "'."
+	errMsg := "[Error] Writing 'account renamed' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
+
+}
+
+// handleContacts sends the contact list of the user along with whether
+// each contact is online. Contacts who hide their presence are shown as
+// offline.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. Not used with this command.
+func handleContacts(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	if !clientIsLoggedIn {
+		log.Info("'/contacts' aborted. Client is not logged in")
+		msg    := "[Error] Listing contacts aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muContacts.Lock()
+	defer s.muContacts.Unlock()
+
+	contacts := s.contacts[username]
+	if len(contacts) == 0 {
+		msg    := "Your contact list is empty. Use '/addContact <username>' to add someone."
+		errMsg := "[Error] Writing 'empty contact list' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	var builder strings.Builder
+	builder.WriteString("Your contacts:")
+	for _, contact := range contacts {
+		status := "offline"
+		if s.isVisiblyOnlineLocked(contact) {
+			status = "online"
+		}
+		builder.WriteString("\n- " + contact + " (" + status + ")")
+	}
+
+	msg    := builder.String()
+	errMsg := "[Error] Writing contact list to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
+
+}
+
+// handleAddContact adds the given user to the contact list of the user.
+// From then on the user is informed whenever the contact logs in or out.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <username>
+func handleAddContact(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 2 {
+		msg    := "[Error] Invalid '/addContact' command. Please use '/addContact <username>'."
+		errMsg := "[Error] Writing 'invalid addContact' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	if !clientIsLoggedIn {
+		log.Info("'/addContact' aborted. Client is not logged in")
+		msg    := "[Error] Adding a contact aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muShadow.Lock()
+	contact := s.resolveUsernameLocked(slicedPld[1])
+	_, isRegisteredUser := s.usrPwdMap[contact]
+	s.muShadow.Unlock()
+	if !isRegisteredUser {
+		msg    := "[Error] Adding a contact aborted. " + contact + " is no registered user."
+		errMsg := "[Error] Writing 'no registered user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	if contact == username {
+		msg    := "[Error] You can not add yourself as a contact."
+		errMsg := "[Error] Writing 'contact is self' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muContacts.Lock()
+	defer s.muContacts.Unlock()
+
+	if slices.Contains(s.contacts[username], contact) {
+		msg    := "[Error] " + contact + " is already one of your contacts."
+		errMsg := "[Error] Writing 'already a contact' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.contacts[username] = append(s.contacts[username], contact)
+	if !s.saveContactsLocked() {
+		s.contacts[username] = slices.DeleteFunc(s.contacts[username], func(c string) bool {
+			return c == contact
+		})
+		msg    := "[Error] Something went wrong at the server. Please try again..."
+		errMsg := "[Error] Writing 'failed saving contacts' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	log.Info("Added contact", "contact", contact)
+
+	status := "offline"
+	if s.isVisiblyOnlineLocked(contact) {
+		status = "online"
+	}
+	msg    := contact + " has been added to your contacts and is currently " + status + "."
+	errMsg := "[Error] Writing 'contact added' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
+
+}
+
+// handleRemoveContact removes the given user from the contact list of the
+// user.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <username>
+func handleRemoveContact(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
+
 	s.mu.Lock()
-	_, userLoggedIn := s.clientConnsRev[inputUsername]
-	if userLoggedIn {
-		fmt.Printf("[Log] '/login'failed because user '%s' was already logged in.\n", inputUsername)
-		msg    := "[Error] Login failed because user is already logged in."
-		errMsg := "[Error] Failed writing 'duplicate login' message to " + conn.RemoteAddr().String()
-		s.sendMessageToClientLocked(conn, msg, errMsg)
+	defer s.mu.Unlock()
 
-		s.mu.Unlock()
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 2 {
+		msg    := "[Error] Invalid '/removeContact' command. Please use '/removeContact <username>'."
+		errMsg := "[Error] Writing 'invalid removeContact' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
-	s.mu.Unlock()
-
-	s.muShadow.Lock()
-	// Handle invalid username
-	pwdHsh, userExists := s.usrPwdMap[inputUsername]
-	if !userExists {
-		fmt.Println("[Log] '/login' failed because invalid username was given.")
-		msg    := "[Error] Invalid combiation of username and password given."
-		errMsg := "[Error] Failed writin 'invalid username' message to " + conn.RemoteAddr().String()
-		s.sendMessageToClientLocked(conn, msg, errMsg)	
 
-		s.muShadow.Unlock()
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	if !clientIsLoggedIn {
+		log.Info("'/removeContact' aborted. Client is not logged in")
+		msg    := "[Error] Removing a contact aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
 
-	// fmt.Printf("[Debugging] shadowfileHash: %s\ninputHash: %s\n", pwdHsh, inputPwdHsh)
+	s.muShadow.Lock()
+	contact := s.resolveUsernameLocked(slicedPld[1])
+	s.muShadow.Unlock()
 
-	// Handle wrong password
-	if pwdHsh != inputPwdHsh {
-		fmt.Println("[Log] '/login' failed because invalid password hash was given.")
-		msg    := "[Error] Invalid combiation of username and password given."
-		errMsg := "[Error] Writin 'wrong password' message to " + conn.RemoteAddr().String()
-		s.sendMessageToClient(conn, msg, errMsg)
+	s.muContacts.Lock()
+	defer s.muContacts.Unlock()
 
-		s.muShadow.Unlock()
+	contacts := s.contacts[username]
+	index := slices.Index(contacts, contact)
+	if index == -1 {
+		msg    := "[Error] " + contact + " is not one of your contacts."
+		errMsg := "[Error] Writing 'not a contact' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
-	s.muShadow.Unlock()
 
-	s.mu.Lock()
-	s.clientConns[conn].username 	= inputUsername
-	s.clientConns[conn].state 		= LOGGED_IN
-	s.clientConnsRev[inputUsername] = s.clientConns[conn]
-	s.mu.Unlock()
+	s.contacts[username] = slices.Delete(slices.Clone(contacts), index, index + 1)
+	if len(s.contacts[username]) == 0 {
+		delete(s.contacts, username)
+	}
+	if !s.saveContactsLocked() {
+		s.contacts[username] = contacts
+		msg    := "[Error] Something went wrong at the server. Please try again..."
+		errMsg := "[Error] Writing 'failed saving contacts' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	log.Info("Removed contact", "contact", contact)
 
-	msg    := "Login successfull." 
-	errMsg := "[Error] Failed writing 'successfull login' message to " + conn.RemoteAddr().String()
-	s.sendMessageToClient(conn, msg, errMsg)
+	msg    := contact + " has been removed from your contacts."
+	errMsg := "[Error] Writing 'contact removed' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
 
 }
 
-// handleLogout removes the clients entry from the username-to-connection map
-// thereby logging him out.
+// handleOnline sends the list of every user who is currently online to the
+// client. Users who hide their presence are not listed.
 //
 // Parameters:
 // 	s - the server
 // 	conn - the clients connection
 // 	payload - the arguments of the command. Not used with this command.
-func handleLogout(s *Server, conn net.Conn, payload []byte) {
+func handleOnline(s *Server, conn net.Conn, payload []byte) {
 
-	fmt.Printf("Handling '/logout' command from %s...\n", conn.RemoteAddr())
+	log := s.connLog(conn)
 
 	s.mu.Lock()
-	delete(s.clientConnsRev, s.clientConns[conn].username)
-	s.clientConns[conn].username = "anonymous"
-	s.clientConns[conn].state    = LOGGED_OUT
-	s.mu.Unlock()
+	defer s.mu.Unlock()
 
-	msg := "Logout successfull."
-	errMsg := "[Error] Failed writing 'logout successfull' message to " + conn.RemoteAddr().String()
-	s.sendMessageToClient(conn, msg, errMsg)
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	if !clientIsLoggedIn {
+		log.Info("'/online' aborted. Client is not logged in")
+		msg    := "[Error] Listing online users aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	s.muContacts.Lock()
+	var online []string
+	for user := range s.clientConnsRev {
+		if user != username && s.isVisiblyOnlineLocked(user) {
+			online = append(online, user)
+		}
+	}
+	s.muContacts.Unlock()
 
-	fmt.Println("[Log] Successfully logged out", conn.RemoteAddr())
+	if len(online) == 0 {
+		msg    := "No other user is online right now."
+		errMsg := "[Error] Writing 'nobody online' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	slices.Sort(online)
+
+	msg    := "Users online: " + strings.Join(online, ", ")
+	errMsg := "[Error] Writing list of online users to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
 
 }
 
-// handleNewChat sends a request out to a given user. It checks for multiple
-// conditions to be met in order for it to be a valid request:
-//  - The recipient must be a registered user.
-//  - The recipient must be logged in as user (currently online).
-//  - The sender must be logged in as a user.
-//  - The chat must not exist already.
-//  - There must not be a different chat request pending for the recipient.
+// handlePresence lets the user hide their presence or show it again. A
+// user who hides their presence appears offline in '/contacts' and
+// '/online' and no presence updates are sent for them. Hiding or showing
+// the presence while online is announced to the contacts as if the user
+// logged out or in.
 //
 // Parameters:
 // 	s - the server
 // 	conn - the clients connection
-// 	payload - the arguments of the command. The recipient of the chat request.
-func handleNewChat(s *Server, conn net.Conn, payload []byte) {
+// 	payload - the arguments of the command. In this case: <command> <hide|show>
+func handlePresence(s *Server, conn net.Conn, payload []byte) {
 
-	fmt.Printf("Handling '/newChat' command from %s...\n", conn.RemoteAddr())
+	log := s.connLog(conn)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	reqRecipient := strings.Fields(string(payload))[1]
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 2 || (slicedPld[1] != "hide" && slicedPld[1] != "show") {
+		msg    := "[Error] Invalid '/presence' command. Please use '/presence <hide|show>'."
+		errMsg := "[Error] Writing 'invalid presence' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	hide := slicedPld[1] == "hide"
 
-	// Check if recipient is a registered user
-	s.muShadow.Lock()
-	_, isRegisteredUser := s.usrPwdMap[reqRecipient]
-	if !isRegisteredUser {
-		fmt.Printf("[Log] Chat request from %s to %s aborted. %s is no registered user.\n", s.clientConns[conn].username, reqRecipient, reqRecipient)
-		msg := "[Error] Chat request aborted. " + reqRecipient + " is no registered user."
-		errMsg := "[Error] Writing 'no registered user' message to " + conn.RemoteAddr().String()
-		s.sendMessageToClient(conn, msg, errMsg)
-		s.muShadow.Unlock()
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	if !clientIsLoggedIn {
+		log.Info("'/presence' aborted. Client is not logged in")
+		msg    := "[Error] Changing your presence aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
-	s.muShadow.Unlock()
+
+	s.muContacts.Lock()
+	isHidden := s.hiddenPresence[username]
+	s.muContacts.Unlock()
+	if isHidden == hide {
+		msg    := "Your presence is already shown."
+		if hide {
+			msg = "Your presence is already hidden."
+		}
+		errMsg := "[Error] Writing 'presence unchanged' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	// The contacts see the user go offline before the presence is hidden
+	// and come online after it is shown again
+	if hide {
+		s.pushPresenceLocked(username, false)
+	}
+
+	s.muContacts.Lock()
+	if hide {
+		s.hiddenPresence[username] = true
+	} else {
+		delete(s.hiddenPresence, username)
+	}
+	saved := s.saveContactsLocked()
+	s.muContacts.Unlock()
+
+	if !hide {
+		s.pushPresenceLocked(username, true)
+	}
+
+	if !saved {
+		msg    := "[Error] Your presence has been changed, but saving it failed. It will be reset once the server restarts."
+		errMsg := "[Error] Writing 'failed saving presence' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	log.Info("Changed presence", "presence", slicedPld[1])
+
+	msg    := "Your presence is now hidden. You appear offline to everyone else."
+	if !hide {
+		msg = "Your presence is now shown again."
+	}
+	errMsg := "[Error] Writing 'presence changed' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
+
+}
+
+// handleBlock adds the given user to the users blocked by the user. Chat
+// requests and messages of a blocked user are dropped without telling
+// the blocked user. A pending chat request of the blocked user to the
+// user is dropped as well.
+//
+// Parameters:
+// 	s - the server
+// 	conn - the clients connection
+// 	payload - the arguments of the command. In this case: <command> <username>
+func handleBlock(s *Server, conn net.Conn, payload []byte) {
+
+	log := s.connLog(conn)
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	
-	// Check if request initiator is logged in as a user
-	_, initiatorIsLoggedIn := s.clientConnsRev[s.clientConns[conn].username]
-	if !initiatorIsLoggedIn {
-		fmt.Printf("[Log] Chat request from %s to %s aborted. %s is not logged in.\n", conn.RemoteAddr(), reqRecipient, conn.RemoteAddr())
-		msg := "[Error] Chat request aborted as you are not logged in as a user."
+
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 2 {
+		msg    := "[Error] Invalid '/block' command. Please use '/block <username>'."
+		errMsg := "[Error] Writing 'invalid block' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	if !clientIsLoggedIn {
+		log.Info("'/block' aborted. Client is not logged in")
+		msg    := "[Error] Blocking a user aborted as you are not logged in as a user."
 		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
 		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
 
-	// Check if other user is online
-	_, recipientIsOnline := s.clientConnsRev[reqRecipient]
-	if !recipientIsOnline {
-		fmt.Printf("[Log] Chat request from %s to %s aborted. %s is offline.\n", s.clientConns[conn].username, reqRecipient, reqRecipient)
-		msg := "[Error] Chat request aborted. " + reqRecipient + " is currently offline. Please try again later."
-		errMsg := "[Error] Writing 'recipient offline' message to " + conn.RemoteAddr().String()
+	s.muShadow.Lock()
+	blockedUser := s.resolveUsernameLocked(slicedPld[1])
+	_, isRegisteredUser := s.usrPwdMap[blockedUser]
+	s.muShadow.Unlock()
+	if !isRegisteredUser {
+		msg    := "[Error] Blocking aborted. " + blockedUser + " is no registered user."
+		errMsg := "[Error] Writing 'no registered user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	if blockedUser == username {
+		msg    := "[Error] You can not block yourself."
+		errMsg := "[Error] Writing 'blocking self' message to " + conn.RemoteAddr().String()
 		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
 
-	// Check if chat already exists.
-	// chat file names are of the pattern '<user1>:<user2>' in alphabetical username order
-	firstUser  := min(s.clientConns[conn].username, reqRecipient)
-	secondUser := max(s.clientConns[conn].username, reqRecipient)
-	chatPath   := serverChatDir + firstUser + ":" + secondUser
+	s.muContacts.Lock()
+	defer s.muContacts.Unlock()
 
-	if fileExists(chatPath) {
-		fmt.Printf("[Log] Chat request from %s to %s aborted. Chat already exists.\n", s.clientConns[conn].username, reqRecipient)
-		msg := "[Error] Chat request aborted. This chat already exists."
-		errMsg := "[Error] Writing 'chat already exists' message to " + conn.RemoteAddr().String()
+	if s.isBlockedLocked(username, blockedUser) {
+		msg    := "[Error] " + blockedUser + " is already blocked."
+		errMsg := "[Error] Writing 'already blocked' message to " + conn.RemoteAddr().String()
 		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
 
-	// Check for pending request
-	_, recipientHasPendingRequest := s.chatRequests[reqRecipient]
-	if recipientHasPendingRequest {
-		fmt.Printf("[Log] Chat request from %s to %s aborted. %s already has a pending request.\n", s.clientConns[conn].username, reqRecipient, reqRecipient)
-		msg := "[Error] Chat request aborted. " + reqRecipient + " already has a pending request."
-		errMsg := "[Error] Writing 'recipient has pending request' message to " + conn.RemoteAddr().String()
+	s.blocked[username] = append(s.blocked[username], blockedUser)
+	if !s.saveContactsLocked() {
+		s.blocked[username] = slices.DeleteFunc(s.blocked[username], func(user string) bool {
+			return user == blockedUser
+		})
+		if len(s.blocked[username]) == 0 {
+			delete(s.blocked, username)
+		}
+		msg    := "[Error] Something went wrong at the server. Please try again..."
+		errMsg := "[Error] Writing 'failed saving blocked users' message to " + conn.RemoteAddr().String()
 		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
+	log.Info("Blocked user", "blocked", blockedUser)
 
-	// Add request recipient to 'request-map'
-	s.chatRequests[reqRecipient] = s.clientConns[conn].username
+	if s.chatRequests[username] == blockedUser {
+		delete(s.chatRequests, username)
+	}
 
-	// Send request message to user
-	msg := "You have recieved a chat request from " + s.clientConns[conn].username + ". Use '/accept' to accept that request or '/decline' to deny it."
-	errMsg := "[Error] Sending chat request to " + s.clientConnsRev[reqRecipient].conn.RemoteAddr().String()
-	s.sendMessageToClientLocked(s.clientConnsRev[reqRecipient].conn, msg, errMsg)
+	msg    := blockedUser + " has been blocked. Chat requests and messages of " + blockedUser + " will no longer reach you."
+	errMsg := "[Error] Writing 'user blocked' message to " + conn.RemoteAddr().String()
+	s.sendMessageToClientLocked(conn, msg, errMsg)
 
 }
 
-// handleAccept checks if there is a pending chat request for the user
-// the client is logged in as. If there is one, that request is accepted.
-// Both request sender and acceptor are being notified that a new 
-// chat is created. 
-// Also checks for no duplicate chats and creates chat directory
-// if it does not exist yet.
+// handleUnblock removes the given user from the users blocked by the user.
 //
 // Parameters:
 // 	s - the server
 // 	conn - the clients connection
-// 	payload - the arguments of the command. Not used with this command.
-func handleAccept(s *Server, conn net.Conn, payload []byte) {
+// 	payload - the arguments of the command. In this case: <command> <username>
+func handleUnblock(s *Server, conn net.Conn, payload []byte) {
 
-	fmt.Printf("Handling '/accept' command from %s...\n", conn.RemoteAddr())
+	log := s.connLog(conn)
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	requestInitiator := s.chatRequests[s.clientConns[conn].username]
-	requestAcceptor  := s.clientConns[conn].username
-
-	// Check if pending request exists
-	_, reqIsPending := s.chatRequests[requestAcceptor]
-	if !reqIsPending {
-		fmt.Printf("[Log] Invalid '/accept' command. No request for %s pending.\n", conn.RemoteAddr())
-		msg := "[Error] '/accept' command aborted. There is no pending requst." 
-		errMsg := "[Error] Writing 'no pending request' message to " + conn.RemoteAddr().String()
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 2 {
+		msg    := "[Error] Invalid '/unblock' command. Please use '/unblock <username>'."
+		errMsg := "[Error] Writing 'invalid unblock' message to " + conn.RemoteAddr().String()
 		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
 
-	// Send acceptance message
-	fmt.Println("[Debugging] Request accepted.")
-	msg    := requestAcceptor + " accepted your request."
-	errMsg := "[Error] Writing 'request accepted' message to " + requestInitiator
-	s.sendMessageToClientLocked(s.clientConnsRev[requestInitiator].conn, msg, errMsg)
-
-	// Determine chat participants in alphabetical order
-	// chat file names are of the pattern '<user1>:<user2>' in alphabetical username order
-	firstUser        := min(requestInitiator, requestAcceptor)
-	secondUser       := max(requestInitiator, requestAcceptor)
-	chatPath         := serverChatDir + firstUser + ":" + secondUser
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	if !clientIsLoggedIn {
+		log.Info("'/unblock' aborted. Client is not logged in")
+		msg    := "[Error] Unblocking a user aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
 
-	// Create chat directory if it doesn't exist
-	if !fileExists(serverChatDir) {
+	s.muShadow.Lock()
+	blockedUser := s.resolveUsernameLocked(slicedPld[1])
+	s.muShadow.Unlock()
 
-		err := os.MkdirAll(serverChatDir, 0700)
-		if err != nil {
-			fmt.Println("[Error] Creating directory for chats:", err)
-			return
-		}
+	s.muContacts.Lock()
+	defer s.muContacts.Unlock()
 
+	blocked := s.blocked[username]
+	index := slices.Index(blocked, blockedUser)
+	if index == -1 {
+		msg    := "[Error] " + blockedUser + " is not blocked."
+		errMsg := "[Error] Writing 'not blocked' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
 	}
 
-	// Create new chat file
-	chatFile, err := os.Create(chatPath)
-	if err != nil {
-		fmt.Println("[Error] Creating new chat:", err)
-		msg    := "[Error] An error occured while creating the new chat file."
-		errMsg := "[Error] Writing 'error while creating chat file' message to " + requestInitiator + ", " + requestAcceptor
+	s.blocked[username] = slices.Delete(slices.Clone(blocked), index, index + 1)
+	if len(s.blocked[username]) == 0 {
+		delete(s.blocked, username)
+	}
+	if !s.saveContactsLocked() {
+		s.blocked[username] = blocked
+		msg    := "[Error] Something went wrong at the server. Please try again..."
+		errMsg := "[Error] Writing 'failed saving blocked users' message to " + conn.RemoteAddr().String()
 		s.sendMessageToClientLocked(conn, msg, errMsg)
-		s.sendMessageToClientLocked(s.clientConnsRev[requestInitiator].conn, msg, errMsg)
 		return
 	}
-	defer chatFile.Close()
+	log.Info("Unblocked user", "unblocked", blockedUser)
 
-	fmt.Println("[Log] Successfully created new chat file:", chatFile)
-	msg    = "Successfully created new chat."
-	errMsg = "[Error] Writing 'successfull chat creation' message to " + requestInitiator + ", " + requestAcceptor
+	msg    := blockedUser + " has been unblocked."
+	errMsg := "[Error] Writing 'user unblocked' message to " + conn.RemoteAddr().String()
 	s.sendMessageToClientLocked(conn, msg, errMsg)
-	s.sendMessageToClientLocked(s.clientConnsRev[requestInitiator].conn, msg, errMsg)
-
-	delete(s.chatRequests, s.clientConns[conn].username)
 
 }
 
-// handleDecline checks if there is a pending chat-request for the
-// user the client is logged in as. If so, that request is deleted
-// from the map of requests and thereby declined. A notifcation message
-// is sent to the sender of the request.
+// handleTimer sets the disappearing message timer of the chat of the
+// client with the given user. Messages sent afterwards expire once the
+// timer has run out and are purged by the sweeper. The change is recorded
+// in the chat file and every device of both users receives a "TIMER"
+// packet, devices which are offline once they log in again.
 //
 // Parameters:
 // 	s - the server
 // 	conn - the clients connection
-// 	payload - the arguments of the command. Not used with this command.
-func handleDecline(s *Server, conn net.Conn, payload []byte) {
+// 	payload - the arguments of the command. In this case: <command> <username> <duration|off>
+func handleTimer(s *Server, conn net.Conn, payload []byte) {
 
-	fmt.Printf("Handling '/decline' command from %s...\n", conn.RemoteAddr())
+	log := s.connLog(conn)
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Check if pending request exists
-	_, reqIsPending := s.chatRequests[s.clientConns[conn].username]
-	if !reqIsPending {
-		fmt.Printf("[Log] Invalid '/decline' command. No request for %s pending.\n", conn.RemoteAddr())
-		msg := "[Error] '/decline' command aborted. There is no pending requst." 
-		errMsg := "[Error] Writing 'no pending request' message to " + conn.RemoteAddr().String()
+	slicedPld := strings.Fields(string(payload))
+	if len(slicedPld) != 3 {
+		msg    := "[Error] Invalid '/timer' command. Please use '/timer <duration|off>' while in chat mode."
+		errMsg := "[Error] Writing 'invalid timer' message to " + conn.RemoteAddr().String()
 		s.sendMessageToClientLocked(conn, msg, errMsg)
 		return
 	}
 
-	fmt.Println("[Debugging] Request declined.")
-	msg    := s.clientConns[conn].username + " declined your request."
-	errMsg := "[Error] Writing 'request declined' message to " + s.chatRequests[s.clientConns[conn].username]
-	s.sendMessageToClientLocked(s.clientConnsRev[s.chatRequests[s.clientConns[conn].username]].conn, msg, errMsg)
+	username := s.clientConns[conn].username
+	_, clientIsLoggedIn := s.clientConnsRev[username]
+	if !clientIsLoggedIn {
+		log.Info("'/timer' aborted. Client is not logged in")
+		msg    := "[Error] Setting the timer aborted as you are not logged in as a user."
+		errMsg := "[Error] Writing 'not logged in as user' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
 
-	delete(s.chatRequests, s.clientConns[conn].username)
+	var timer time.Duration
+	if slicedPld[2] != "off" {
+		var err error
+		timer, err = time.ParseDuration(slicedPld[2])
+		if err != nil || timer < minChatTimer || timer > maxChatTimer {
+			msg    := fmt.Sprintf("[Error] Invalid timer '%s'. Please use a duration between %s and %s, e.g. '30s' or '12h', or 'off'.", slicedPld[2], minChatTimer, maxChatTimer)
+			errMsg := "[Error] Writing 'invalid timer' message to " + conn.RemoteAddr().String()
+			s.sendMessageToClientLocked(conn, msg, errMsg)
+			return
+		}
+	}
+
+	s.muShadow.Lock()
+	defer s.muShadow.Unlock()
+
+	partner  := s.resolveUsernameLocked(slicedPld[1])
+	chatPath := chatFilePath(username, partner)
+	if !fileExists(chatPath) {
+		log.Info("'/timer' aborted. There is no chat with the partner", "partner", partner)
+		msg    := "[Error] Setting the timer aborted. There is no chat with " + partner + "."
+		errMsg := "[Error] Writing 'chat does not exist' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+
+	err := appendChatRecord(chatPath, ChatRecord{Kind: CHAT_RECORD_TIMER, From: username, Time: time.Now(), Timer: timer})
+	if err != nil {
+		log.Error("Recording chat timer", "err", err)
+		msg    := "[Error] Something went wrong at the server. Please try again..."
+		errMsg := "[Error] Writing 'failed saving timer' message to " + conn.RemoteAddr().String()
+		s.sendMessageToClientLocked(conn, msg, errMsg)
+		return
+	}
+	s.chatTimers[chatPath] = timer
+	log.Info("Set chat timer", "partner", partner, "timer", timer.String())
+
+	jsonData, err := json.Marshal(ChatTimer{From: username, To: partner, Timer: timer})
+	if err != nil {
+		log.Error("Marshalling chat timer", "err", err)
+		return
+	}
+	packet := Packet{MsgType: "TIMER", Payload: string(jsonData)}
+
+	users := []string{username}
+	if partner != username {
+		users = append(users, partner)
+	}
+	for _, user := range users {
+		for deviceID := range s.devices[user] {
+			s.sendPacketToDeviceLocked(user, deviceID, packet)
+		}
+	}
 
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds of signals sent between chat partners.
+const (
+	SIGNAL_TYPING  = "typing"
+	SIGNAL_STOPPED = "stopped"
+)
+
+// typingSignalInterval is how often a "typing" signal is repeated while
+// the user keeps typing. Receivers may consider the partner to have
+// stopped if no signal arrived for longer than that.
+const typingSignalInterval = 3 * time.Second
+
+// sendTypingSignal tells the partner of the open chat that the user is
+// typing or stopped typing. While the user keeps typing, the "typing"
+// signal is only repeated every typingSignalInterval. Nothing is sent
+// outside of chat mode.
+//
+// Parameters:
+//	typing - whether the user is typing
+func (c *Client) sendTypingSignal(typing bool) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.activeChat == "" {
+		return
+	}
+
+	kind := SIGNAL_STOPPED
+	if typing {
+		if time.Since(c.typingSentAt) < typingSignalInterval {
+			return
+		}
+		kind = SIGNAL_TYPING
+		c.typingSentAt = time.Now()
+	} else {
+		if c.typingSentAt.IsZero() {
+			return
+		}
+		c.typingSentAt = time.Time{}
+	}
+
+	jsonData, err := json.Marshal(Signal{To: c.activeChat, Kind: kind})
+	if err != nil {
+		c.view.Println("[Error] Marshalling signal failed:", err)
+		return
+	}
+
+	err = c.sendPacket(Packet{MsgType: "SIGNAL", Payload: string(jsonData)})
+	if err != nil {
+		c.view.Println("[Error] Sending signal failed:", err)
+	}
+
+}
+
+// showSignal shows a signal of a chat partner sent by the server in a
+// "SIGNAL" packet.
+//
+// Parameters:
+//	payload - the json encoded Signal
+func (c *Client) showSignal(payload string) {
+
+	var signal Signal
+	err := json.Unmarshal([]byte(payload), &signal)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling signal failed:", err)
+		return
+	}
+
+	c.view.Signal(signal.From, signal.Kind)
+
+}
@@ -0,0 +1,41 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// isTerminal can not tell terminals apart on this system, so the client
+// always runs headless.
+func isTerminal(file *os.File) bool {
+
+	return false
+
+}
+
+// enableRawMode is not supported on this system.
+func enableRawMode() (func(), error) {
+
+	return nil, errors.New("raw terminal mode is not supported on this system")
+
+}
+
+// terminalSize is not supported on this system.
+func terminalSize() (int, int, error) {
+
+	return 0, 0, errors.New("reading the terminal size is not supported on this system")
+
+}
+
+// notifyResize is not supported on this system, nothing is ever sent.
+func notifyResize(ch chan os.Signal) {}
+
+// disableEcho is not supported on this system, the password stays
+// visible while it is typed.
+func disableEcho() (func(), error) {
+
+	return nil, errors.New("hiding input is not supported on this system")
+
+}
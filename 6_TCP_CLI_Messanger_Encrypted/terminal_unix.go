@@ -0,0 +1,114 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+// isTerminal reports whether the given file is a terminal.
+func isTerminal(file *os.File) bool {
+
+	var termios syscall.Termios
+	return ioctlTermios(file.Fd(), ioctlGetTermios, &termios) == nil
+
+}
+
+// disableEcho turns off the echo of the terminal stdin is connected to.
+// If stdin is no terminal, e.g. because the input is piped into the
+// client, there is nothing to hide and nothing is changed.
+// Returns a function which restores the previous settings of the terminal.
+func disableEcho() (func(), error) {
+
+	fd := os.Stdin.Fd()
+
+	var termios syscall.Termios
+	err := ioctlTermios(fd, ioctlGetTermios, &termios)
+	if err == syscall.ENOTTY {
+		return func() {}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	original := termios
+	termios.Lflag &^= syscall.ECHO
+	err = ioctlTermios(fd, ioctlSetTermios, &termios)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		ioctlTermios(fd, ioctlSetTermios, &original)
+	}, nil
+
+}
+
+// enableRawMode switches the terminal stdin is connected to into raw
+// mode: every key is read as soon as it is pressed, nothing is echoed and
+// keys like Ctrl-C are read instead of sending a signal.
+// Returns a function which restores the previous settings of the terminal.
+func enableRawMode() (func(), error) {
+
+	fd := os.Stdin.Fd()
+
+	var termios syscall.Termios
+	err := ioctlTermios(fd, ioctlGetTermios, &termios)
+	if err != nil {
+		return nil, err
+	}
+
+	original := termios
+	termios.Iflag &^= syscall.ICRNL | syscall.IXON
+	termios.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cc[syscall.VMIN]  = 1
+	termios.Cc[syscall.VTIME] = 0
+	err = ioctlTermios(fd, ioctlSetTermios, &termios)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		ioctlTermios(fd, ioctlSetTermios, &original)
+	}, nil
+
+}
+
+// terminalSize returns the number of columns and rows of the terminal
+// stdout is connected to.
+func terminalSize() (int, int, error) {
+
+	var size struct {
+		rows 	uint16
+		cols 	uint16
+		xPixels uint16
+		yPixels uint16
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+	return int(size.cols), int(size.rows), nil
+
+}
+
+// notifyResize sends a value into the given channel whenever the
+// terminal is resized.
+func notifyResize(ch chan os.Signal) {
+
+	signal.Notify(ch, syscall.SIGWINCH)
+
+}
+
+func ioctlTermios(fd uintptr, request uintptr, termios *syscall.Termios) error {
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// applyChatTimer remembers the disappearing message timer of a chat sent
+// by the server in a "TIMER" packet and tells the user about it.
+//
+// Parameters:
+//	payload - the json encoded ChatTimer
+func (c *Client) applyChatTimer(payload string) {
+
+	var chatTimer ChatTimer
+	err := json.Unmarshal([]byte(payload), &chatTimer)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling chat timer failed:", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	partner := chatTimer.From
+	if partner == c.username {
+		partner = chatTimer.To
+	}
+
+	if chatTimer.Timer == 0 {
+		delete(c.timers, partner)
+		c.view.ChatLine(partner, "%s turned off disappearing messages.", chatTimer.From)
+		return
+	}
+
+	c.timers[partner] = chatTimer.Timer
+	c.view.ChatLine(partner, "%s set messages to disappear after %s.", chatTimer.From, chatTimer.Timer)
+
+}
+
+// scheduleDisappearLocked removes the chat message with the given ID from
+// the view, the chat history and the sent messages once its timer has run
+// out. Messages without a timer are kept.
+// The function assumes that the c.mu Mutex is locked.
+//
+// Parameters:
+//	id - the ID of the message
+//	expires - when the message disappears, zero if it does not
+func (c *Client) scheduleDisappearLocked(id string, expires time.Time) {
+
+	if expires.IsZero() || id == "" {
+		return
+	}
+
+	time.AfterFunc(time.Until(expires), func() {
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		// The message may have been deleted in the meantime
+		message, ok := c.messages[id]
+		if !ok {
+			return
+		}
+		delete(c.messages, id)
+		delete(c.sent, id)
+
+		if c.history != nil {
+			err := c.history.purgeExpired(time.Now())
+			if err != nil {
+				c.view.Println("[Error] Removing disappeared messages from the chat history failed:", err)
+			}
+		}
+		c.view.ReplaceMessage(message.partner, id, message.from, message.text, "A message of " + message.from + " has disappeared.")
+
+	})
+
+}
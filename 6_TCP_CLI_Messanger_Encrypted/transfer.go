@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// fileChunkSize is the number of bytes of a file sent in one "FILE" packet.
+const fileChunkSize = 32 * 1024
+
+var transferIDPattern = regexp.MustCompile(`^[0-9a-f]{16}$`)
+
+// FileChunk is the plaintext of a "FILE" packet. Every chunk carries the
+// metadata of the whole file, so chunks can be written no matter in which
+// order they arrive and a transfer can be resumed at any offset.
+type FileChunk struct {
+	Transfer string `json:"transfer"` // ID of the transfer, derived from the file content and recipient
+	Name 	 string `json:"name"`
+	Size 	 int64  `json:"size"`
+	Hash 	 string `json:"hash"` // SHA-256 of the whole file
+	Offset 	 int64  `json:"offset"`
+	Data 	 []byte `json:"data"`
+}
+
+// sendFile sends the file at the given path to the given chat partner in
+// chunks of fileChunkSize bytes. Every chunk is encrypted like a chat
+// message. The offset of the last chunk sent is stored in the clients data
+// directory, so sending the same file to the same user again resumes the
+// transfer where it stopped.
+//
+// Parameters:
+//	path - the path of the file to send
+//	partner - the user to send the file to
+func (c *Client) sendFile(path string, partner string) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		c.view.Println("[Error] Opening file to send:", err)
+		return
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		c.view.Println("[Error] Reading file size:", err)
+		return
+	}
+	size := fileInfo.Size()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		c.view.Println("[Error] Hashing file to send:", err)
+		return
+	}
+	fileHash := hex.EncodeToString(hash.Sum(nil))
+
+	c.mu.Lock()
+	transfersDir := clientDataDir + c.username + "/transfers/"
+	c.mu.Unlock()
+
+	transferHash := sha256.Sum256([]byte(fileHash + ":" + partner))
+	transferID   := hex.EncodeToString(transferHash[:8])
+	statePath    := transfersDir + transferID
+
+	err = os.MkdirAll(transfersDir, 0700)
+	if err != nil {
+		c.view.Println("[Error] Creating directory for transfers:", err)
+		return
+	}
+
+	var offset int64
+	if content, err := os.ReadFile(statePath); err == nil {
+		offset, _ = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	}
+	if offset <= 0 || offset >= size {
+		offset = 0
+	} else {
+		c.view.Printf("Resuming transfer of '%s' to %s at %d%%.\n", filepath.Base(path), partner, offset * 100 / size)
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		c.view.Println("[Error] Seeking in file to send:", err)
+		return
+	}
+
+	buffer 		 := make([]byte, fileChunkSize)
+	lastProgress := offset * 10 / max(size, 1)
+	for {
+
+		n, err := io.ReadFull(file, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			c.view.Println("[Error] Reading file to send:", err)
+			return
+		}
+
+		chunk := FileChunk{
+			Transfer: transferID,
+			Name: 	  filepath.Base(path),
+			Size: 	  size,
+			Hash: 	  fileHash,
+			Offset:   offset,
+			Data: 	  buffer[:n],
+		}
+		jsonData, err := json.Marshal(chunk)
+		if err != nil {
+			c.view.Println("[Error] Marshalling file chunk:", err)
+			return
+		}
+
+		c.mu.Lock()
+		envelope, err := c.encryptForChatLocked(ChatEnvelope{To: partner}, jsonData)
+		c.mu.Unlock()
+		if err != nil {
+			c.view.Println("[Error] Encrypting file chunk:", err)
+			return
+		}
+
+		err = c.sendPacket(Packet{MsgType: "FILE", Payload: envelope})
+		if err != nil {
+			c.view.Println("[Error] Sending file chunk:", err)
+			return
+		}
+
+		offset += int64(n)
+		err = os.WriteFile(statePath, []byte(strconv.FormatInt(offset, 10)), 0600)
+		if err != nil {
+			c.view.Println("[Error] Saving offset of transfer:", err)
+		}
+
+		if progress := offset * 10 / max(size, 1); progress > lastProgress {
+			c.view.Printf("Sending '%s' to %s: %d%% (%d / %d bytes)\n", chunk.Name, partner, offset * 100 / max(size, 1), offset, size)
+			lastProgress = progress
+		}
+
+		if offset >= size {
+			break
+		}
+
+	}
+
+	os.Remove(statePath)
+	c.view.Printf("Sent '%s' to %s.\n", filepath.Base(path), partner)
+
+}
+
+// receiveFileChunk decrypts a chunk of a file sent by the server in a
+// "FILE" packet and writes it at its offset into a partial file in the
+// downloads directory. Once the last chunk is written, the content is
+// verified against the hash of the file and the file is moved to its
+// final name in the downloads directory.
+//
+// Parameters:
+//	payload - the json encoded ChatDelivery holding the chunk
+func (c *Client) receiveFileChunk(payload string) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delivery, plaintext, err := c.openDeliveryLocked(payload)
+	if err != nil {
+		c.view.Println("[Error] Reading file chunk failed:", err)
+		return
+	}
+
+	var chunk FileChunk
+	err = json.Unmarshal(plaintext, &chunk)
+	if err != nil {
+		c.view.Println("[Error] Unmarshalling file chunk failed:", err)
+		return
+	}
+	if !transferIDPattern.MatchString(chunk.Transfer) || chunk.Offset < 0 || chunk.Offset + int64(len(chunk.Data)) > chunk.Size {
+		c.view.Printf("[Error] Received invalid file chunk from %s.\n", delivery.From)
+		return
+	}
+
+	downloadsDir := clientDataDir + c.username + "/downloads/"
+	err = os.MkdirAll(downloadsDir, 0700)
+	if err != nil {
+		c.view.Println("[Error] Creating downloads directory:", err)
+		return
+	}
+
+	partPath := downloadsDir + chunk.Transfer + ".part"
+	partFile, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		c.view.Println("[Error] Opening partial download:", err)
+		return
+	}
+	_, err = partFile.WriteAt(chunk.Data, chunk.Offset)
+	partFile.Close()
+	if err != nil {
+		c.view.Println("[Error] Writing partial download:", err)
+		return
+	}
+
+	received := chunk.Offset + int64(len(chunk.Data))
+	if received < chunk.Size {
+		if received * 10 / chunk.Size > chunk.Offset * 10 / chunk.Size {
+			c.view.Printf("Receiving '%s' from %s: %d%% (%d / %d bytes)\n", chunk.Name, delivery.From, received * 100 / chunk.Size, received, chunk.Size)
+		}
+		return
+	}
+
+	// The last chunk arrived, verify the whole file
+	fileHash, err := hashFile(partPath)
+	if err != nil {
+		c.view.Println("[Error] Hashing received file:", err)
+		return
+	}
+	if fileHash != chunk.Hash {
+		c.view.Printf("[Error] '%s' from %s is incomplete or corrupted. Ask %s to send it again.\n", chunk.Name, delivery.From, delivery.From)
+		os.Remove(partPath)
+		return
+	}
+
+	downloadPath, err := freeDownloadPath(downloadsDir, chunk.Name, chunk.Transfer)
+	if err != nil {
+		c.view.Println("[Error] Finding a name for the received file:", err)
+		return
+	}
+	err = os.Rename(partPath, downloadPath)
+	if err != nil {
+		c.view.Println("[Error] Moving received file to downloads:", err)
+		return
+	}
+
+	c.view.ChatLine(c.chatPartnerOf(delivery), "%s sent '%s'. Saved to '%s'.", delivery.From, chunk.Name, downloadPath)
+
+}
+
+// hashFile returns the hex encoded SHA-256 hash of the file at the given
+// path.
+func hashFile(path string) (string, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+
+}
+
+// freeDownloadPath returns a path in the downloads directory for a file
+// with the given name which does not exist yet. Only the base name of the
+// given name is used, so a sender can not write outside the downloads
+// directory.
+//
+// Parameters:
+//	downloadsDir - the downloads directory
+//	name - the name of the file as given by the sender
+//	transferID - the ID of the transfer, used if the name is unusable
+func freeDownloadPath(downloadsDir string, name string, transferID string) (string, error) {
+
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == string(filepath.Separator) || strings.HasSuffix(name, ".part") {
+		name = transferID
+	}
+
+	extension := filepath.Ext(name)
+	baseName  := strings.TrimSuffix(name, extension)
+
+	path := downloadsDir + name
+	for i := 1; fileExists(path); i++ {
+		if i > 1000 {
+			return "", errors.New("too many files named '" + name + "'")
+		}
+		path = downloadsDir + baseName + " (" + strconv.Itoa(i) + ")" + extension
+	}
+	return path, nil
+
+}
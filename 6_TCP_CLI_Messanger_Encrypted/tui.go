@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The full-screen terminal interface is drawn with ANSI escape sequences.
+// The screen is split into the chat list on the left, the message pane of
+// the chat which is open on the right, a status bar and the input line at
+// the bottom. Output which does not belong to a chat is shown in the
+// "server" pane, or in the open chat while in chat mode.
+const (
+	ansiAltScreenOn  = "\x1b[?1049h"
+	ansiAltScreenOff = "\x1b[?1049l"
+	ansiHideCursor 	 = "\x1b[?25l"
+	ansiShowCursor 	 = "\x1b[?25h"
+	ansiReverse 	 = "\x1b[7m"
+	ansiReset 		 = "\x1b[0m"
+)
+
+const (
+	chatListWidth 	  = 20 // Columns of the chat list including the separator
+	minWidthForList   = 50 // The chat list is hidden on narrower terminals
+	linesKeptOnClose  = 10 // Lines of the shown pane printed after the interface is closed
+)
+
+// serverPane is the key of the pane showing the output which does not
+// belong to a chat. Usernames can not be empty, so it can not collide
+// with a chat.
+const serverPane = ""
+
+// tuiView is the full-screen terminal interface of the client.
+type tuiView struct {
+	client 	   *Client
+	mu 		   sync.Mutex
+	width 	   int
+	height 	   int
+	username   string
+	activeChat string
+	panes 	   map[string][]string 	// Maps from chat partner to the lines shown in the chat
+	order 	   []string 			// The chats in the order they are listed
+	unread 	   map[string]int 		// Maps from chat partner to the number of lines added while the chat was not shown
+	typing 	   map[string]time.Time // Maps from chat partner to when the last "typing" signal arrived
+	scroll 	   int 					// Number of lines the message pane is scrolled up
+	input 	   []rune
+	secret 	   bool 				// Whether the input is hidden, e.g. while a password is typed
+	prompt 	   string
+	restore    func()
+	stop 	   chan struct{}
+	closeOnce  sync.Once
+}
+
+// newTUIView switches the terminal into raw mode and the alternate screen
+// and draws the interface.
+//
+// Parameters:
+//	c - the client whose output is shown. It is only used to send typing signals
+func newTUIView(c *Client) (*tuiView, error) {
+
+	width, height, err := terminalSize()
+	if err != nil {
+		return nil, err
+	}
+
+	restore, err := enableRawMode()
+	if err != nil {
+		return nil, err
+	}
+
+	v := &tuiView{
+		client:  c,
+		width: 	 width,
+		height:  height,
+		panes: 	 map[string][]string{serverPane: nil},
+		order: 	 []string{serverPane},
+		unread:  make(map[string]int),
+		typing:  make(map[string]time.Time),
+		restore: restore,
+		stop: 	 make(chan struct{}),
+	}
+
+	os.Stdout.WriteString(ansiAltScreenOn)
+	v.mu.Lock()
+	v.redrawLocked()
+	v.mu.Unlock()
+
+	go v.watchTerminal()
+
+	return v, nil
+
+}
+
+// watchTerminal redraws the interface whenever the terminal is resized
+// and once a second, so typing indicators expire.
+func (v *tuiView) watchTerminal() {
+
+	resizeCh := make(chan os.Signal, 1)
+	notifyResize(resizeCh)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+
+		select {
+		case <-v.stop:
+			return
+		case <-resizeCh:
+			width, height, err := terminalSize()
+			if err != nil {
+				continue
+			}
+			v.mu.Lock()
+			v.width, v.height = width, height
+			v.redrawLocked()
+			v.mu.Unlock()
+		case <-ticker.C:
+			v.mu.Lock()
+			if len(v.typing) > 0 {
+				v.redrawLocked()
+			}
+			v.mu.Unlock()
+		}
+
+	}
+
+}
+
+// ReadInput reads the keys pressed by the user, edits the input line and
+// sends the line into the given channel once Enter is pressed.
+// Tab opens the next chat of the chat list, Page Up and Page Down scroll
+// the message pane and Ctrl-C quits.
+func (v *tuiView) ReadInput(inputCh chan<- string) error {
+
+	reader := bufio.NewReader(os.Stdin)
+	for {
+
+		r, _, err := reader.ReadRune()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch r {
+		case '\r', '\n':
+			v.mu.Lock()
+			line, secret := string(v.input), v.secret
+			v.input = nil
+			v.scroll = 0
+			if !secret && line != "" {
+				v.echoLocked(line)
+			}
+			v.redrawLocked()
+			v.mu.Unlock()
+			if !secret && line == "" {
+				continue
+			}
+			v.client.sendTypingSignal(false)
+			inputCh <- line
+		case 0x03, 0x04:
+			// Ctrl-C and Ctrl-D, a pending password prompt is answered
+			// with an empty password first
+			v.mu.Lock()
+			secret := v.secret
+			v.input = nil
+			v.redrawLocked()
+			v.mu.Unlock()
+			if secret {
+				inputCh <- ""
+			}
+			inputCh <- "/quit"
+		case 0x7f, 0x08:
+			v.mu.Lock()
+			if len(v.input) > 0 {
+				v.input = v.input[:len(v.input) - 1]
+			}
+			isEmpty := len(v.input) == 0
+			v.redrawLocked()
+			v.mu.Unlock()
+			if isEmpty {
+				v.client.sendTypingSignal(false)
+			}
+		case 0x15:
+			// Ctrl-U clears the input line
+			v.mu.Lock()
+			v.input = nil
+			v.redrawLocked()
+			v.mu.Unlock()
+			v.client.sendTypingSignal(false)
+		case '\t':
+			v.mu.Lock()
+			command := v.nextChatCommandLocked()
+			v.mu.Unlock()
+			if command != "" {
+				inputCh <- command
+			}
+		case 0x1b:
+			v.handleEscapeSequence(reader)
+		default:
+			if r < 0x20 {
+				continue
+			}
+			v.mu.Lock()
+			v.input = append(v.input, r)
+			isChatMessage := !v.secret && v.input[0] != '/'
+			v.redrawLocked()
+			v.mu.Unlock()
+			if isChatMessage {
+				v.client.sendTypingSignal(true)
+			}
+		}
+
+	}
+
+}
+
+// handleEscapeSequence reads the rest of an escape sequence sent by a
+// special key. Page Up, Page Down and the arrow keys scroll the message
+// pane, every other key is ignored.
+//
+// Parameters:
+//	reader - the reader of stdin, positioned after the escape character
+func (v *tuiView) handleEscapeSequence(reader *bufio.Reader) {
+
+	r, _, err := reader.ReadRune()
+	if err != nil || r != '[' {
+		return
+	}
+
+	// Control sequences end with a character between '@' and '~'
+	var sequence strings.Builder
+	for {
+		r, _, err := reader.ReadRune()
+		if err != nil {
+			return
+		}
+		sequence.WriteRune(r)
+		if r >= '@' && r <= '~' {
+			break
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	page := max(v.height - 3, 1)
+	switch sequence.String() {
+	case "5~":
+		v.scroll += page
+	case "6~":
+		v.scroll -= page
+	case "A":
+		v.scroll++
+	case "B":
+		v.scroll--
+	default:
+		return
+	}
+	v.scroll = max(v.scroll, 0)
+	v.redrawLocked()
+
+}
+
+// nextChatCommandLocked returns the command which opens the chat after
+// the one shown in the chat list, or leaves chat mode if the server pane
+// is next. Nothing is switched while a password is typed.
+// The function assumes that the v.mu Mutex is locked.
+func (v *tuiView) nextChatCommandLocked() string {
+
+	if v.secret || len(v.order) < 2 {
+		return ""
+	}
+
+	next := v.order[0]
+	for i, partner := range v.order {
+		if partner == v.activeChat {
+			next = v.order[(i + 1) % len(v.order)]
+			break
+		}
+	}
+
+	if next == serverPane {
+		return "/exit"
+	}
+	return "/chat " + next
+
+}
+
+func (v *tuiView) Printf(format string, args ...any) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.addLinesLocked(v.activeChat, fmt.Sprintf(format, args...))
+	v.redrawLocked()
+
+}
+
+func (v *tuiView) Println(args ...any) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.addLinesLocked(v.activeChat, fmt.Sprintln(args...))
+	v.redrawLocked()
+
+}
+
+// ServerMessage shows the text of a message of the server without the
+// '(<username>) ' prefix, as the user is shown in the status bar.
+func (v *tuiView) ServerMessage(msgType string, payload string) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	text := payload
+	if msgType != "MESSAGE" {
+		text = msgType + ": " + payload
+	} else if strings.HasPrefix(payload, "(") {
+		if end := strings.Index(payload, ") "); end != -1 {
+			text = payload[end + 2:]
+		}
+	}
+
+	v.addLinesLocked(v.activeChat, text)
+	v.redrawLocked()
+
+}
+
+func (v *tuiView) ChatLine(partner string, format string, args ...any) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// A message ends the typing indicator of its sender
+	delete(v.typing, partner)
+
+	v.addLinesLocked(partner, fmt.Sprintf(format, args...))
+	v.redrawLocked()
+
+}
+
+func (v *tuiView) Signal(partner string, kind string) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if kind == SIGNAL_TYPING {
+		v.typing[partner] = time.Now()
+	} else {
+		delete(v.typing, partner)
+	}
+	v.redrawLocked()
+
+}
+
+// ReplaceMessage shows the replacement in place of the first line of the
+// message and removes its other lines, e.g. the lines showing the receipts
+// of a sent message. The lines of a message start with its shown ID, only
+// the line echoed when sending it does not.
+func (v *tuiView) ReplaceMessage(partner string, id string, from string, text string, replacement string) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	prefix := sanitizeLine(shortID(id) + " ")
+	echoed := sanitizeLine(from + ": " + text)
+
+	var lines []string
+	replaced := false
+	for _, shown := range v.panes[partner] {
+
+		if !strings.HasPrefix(shown, prefix) && (text == "" || shown != echoed) {
+			lines = append(lines, shown)
+			continue
+		}
+		if !replaced {
+			lines 	 = append(lines, sanitizeLine(replacement))
+			replaced = true
+		}
+
+	}
+
+	if replaced {
+		v.panes[partner] = lines
+	} else {
+		v.addLinesLocked(partner, replacement)
+	}
+	v.redrawLocked()
+
+}
+
+func (v *tuiView) SetStatus(username string, activeChat string) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.username = username
+	if v.activeChat != activeChat {
+		v.activeChat = activeChat
+		v.scroll = 0
+		v.addChatLocked(activeChat)
+		delete(v.unread, activeChat)
+	}
+	v.redrawLocked()
+
+}
+
+// BeginSecret shows the prompt in front of the input line and hides the
+// typed characters until the returned function is called.
+func (v *tuiView) BeginSecret(prompt string) func() {
+
+	v.mu.Lock()
+	v.secret = true
+	v.prompt = prompt
+	v.input  = nil
+	v.redrawLocked()
+	v.mu.Unlock()
+
+	return func() {
+		v.mu.Lock()
+		v.secret = false
+		v.prompt = ""
+		v.redrawLocked()
+		v.mu.Unlock()
+	}
+
+}
+
+// Close restores the terminal and prints the last lines of the pane which
+// was shown, so the reason the client stopped stays visible.
+func (v *tuiView) Close() {
+
+	v.closeOnce.Do(func() {
+
+		close(v.stop)
+
+		v.mu.Lock()
+		defer v.mu.Unlock()
+
+		os.Stdout.WriteString(ansiShowCursor + ansiAltScreenOff)
+		v.restore()
+
+		lines := v.panes[v.activeChat]
+		for _, line := range lines[max(len(lines) - linesKeptOnClose, 0):] {
+			fmt.Println(line)
+		}
+
+	})
+
+}
+
+// addChatLocked adds the given chat to the chat list if it is not listed
+// yet.
+// The function assumes that the v.mu Mutex is locked.
+func (v *tuiView) addChatLocked(partner string) {
+
+	if _, ok := v.panes[partner]; ok {
+		return
+	}
+	v.panes[partner] = nil
+	v.order = append(v.order, partner)
+
+}
+
+// echoLocked shows a line entered by the user in the pane which is shown.
+// The function assumes that the v.mu Mutex is locked.
+func (v *tuiView) echoLocked(line string) {
+
+	if strings.HasPrefix(line, "/") || v.activeChat == "" {
+		v.addLinesLocked(v.activeChat, "> " + line)
+		return
+	}
+	v.addLinesLocked(v.activeChat, v.username + ": " + line)
+
+}
+
+// addLinesLocked appends the given text to the pane of the given chat.
+// Lines added to a chat which is not shown are counted as unread. Control
+// characters are replaced, so a chat message can not contain escape
+// sequences which change the terminal.
+// The function assumes that the v.mu Mutex is locked.
+func (v *tuiView) addLinesLocked(partner string, text string) {
+
+	v.addChatLocked(partner)
+
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+
+		v.panes[partner] = append(v.panes[partner], sanitizeLine(line))
+		if partner != v.activeChat {
+			v.unread[partner]++
+		}
+
+	}
+
+}
+
+// redrawLocked draws the whole interface.
+// The function assumes that the v.mu Mutex is locked.
+func (v *tuiView) redrawLocked() {
+
+	if v.width < 10 || v.height < 4 {
+		return
+	}
+
+	listWidth := chatListWidth
+	if v.width < minWidthForList {
+		listWidth = 0
+	}
+	paneWidth := v.width - listWidth
+	paneRows  := v.height - 2
+
+	// The lines of the open chat wrapped to the width of the message pane
+	var wrapped []string
+	for _, line := range v.panes[v.activeChat] {
+		wrapped = append(wrapped, wrapLine(line, paneWidth)...)
+	}
+	v.scroll = min(v.scroll, max(len(wrapped) - paneRows, 0))
+	end   := len(wrapped) - v.scroll
+	start := max(end - paneRows, 0)
+	visible := wrapped[start:end]
+
+	var screen strings.Builder
+	screen.WriteString(ansiHideCursor)
+
+	for row := 0; row < paneRows; row++ {
+
+		fmt.Fprintf(&screen, "\x1b[%d;1H", row + 1)
+
+		if listWidth > 0 {
+			entry := ""
+			if row < len(v.order) {
+				entry = v.chatListEntryLocked(v.order[row])
+			}
+			screen.WriteString(fitLine(entry, listWidth - 1) + "│")
+		}
+
+		line := ""
+		if row < len(visible) {
+			line = visible[row]
+		}
+		screen.WriteString(fitLine(line, paneWidth))
+
+	}
+
+	fmt.Fprintf(&screen, "\x1b[%d;1H", v.height - 1)
+	screen.WriteString(ansiReverse + fitLine(v.statusLocked(), v.width) + ansiReset)
+
+	prompt := "> "
+	if v.secret {
+		prompt = v.prompt
+	}
+	inputText := string(v.input)
+	if v.secret {
+		inputText = strings.Repeat("*", len(v.input))
+	}
+	inputLine := prompt + inputText
+
+	// Long input scrolls horizontally, so the cursor stays visible
+	if overflow := utf8.RuneCountInString(inputLine) - (v.width - 1); overflow > 0 {
+		inputLine = string([]rune(inputLine)[overflow:])
+	}
+	fmt.Fprintf(&screen, "\x1b[%d;1H", v.height)
+	screen.WriteString(fitLine(inputLine, v.width))
+	fmt.Fprintf(&screen, "\x1b[%d;%dH", v.height, utf8.RuneCountInString(inputLine) + 1)
+	screen.WriteString(ansiShowCursor)
+
+	os.Stdout.WriteString(screen.String())
+
+}
+
+// chatListEntryLocked returns the line of the given chat in the chat list.
+// The function assumes that the v.mu Mutex is locked.
+func (v *tuiView) chatListEntryLocked(partner string) string {
+
+	entry := " "
+	if partner == v.activeChat {
+		entry = ">"
+	}
+
+	if partner == serverPane {
+		entry += "server"
+	} else {
+		entry += partner
+	}
+
+	if unread := v.unread[partner]; unread > 0 {
+		entry += fmt.Sprintf(" (%d)", unread)
+	}
+	return entry
+
+}
+
+// statusLocked returns the text of the status bar: the server, the user,
+// the open chat and whether the chat partner is typing.
+// The function assumes that the v.mu Mutex is locked.
+func (v *tuiView) statusLocked() string {
+
+	username := v.username
+	if username == "" {
+		username = "not logged in"
+	}
+	status := " " + username + " @ " + v.client.serverAddr
+
+	if v.activeChat != "" {
+		status += " | chat: " + v.activeChat
+	}
+
+	for partner, since := range v.typing {
+		if time.Since(since) > 2 * typingSignalInterval {
+			delete(v.typing, partner)
+			continue
+		}
+		if partner == v.activeChat {
+			status += " | " + partner + " is typing..."
+		}
+	}
+
+	if v.scroll > 0 {
+		status += fmt.Sprintf(" | scrolled up %d lines", v.scroll)
+	}
+	return status + " | Tab: next chat, PgUp/PgDn: scroll, Ctrl-C: quit"
+
+}
+
+// sanitizeLine replaces control characters, so a chat message can not
+// contain escape sequences which change the terminal.
+func sanitizeLine(line string) string {
+
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if r < 0x20 || r == 0x7f {
+			return '?'
+		}
+		return r
+	}, line)
+
+}
+
+// wrapLine splits the given line into lines of at most the given width.
+//
+// Parameters:
+//	line - the line to split
+//	width - the maximum number of characters per line
+func wrapLine(line string, width int) []string {
+
+	runes := []rune(line)
+	if len(runes) <= width || width < 1 {
+		return []string{line}
+	}
+
+	var lines []string
+	for len(runes) > width {
+		lines = append(lines, string(runes[:width]))
+		runes = runes[width:]
+	}
+	return append(lines, string(runes))
+
+}
+
+// fitLine cuts the given line or pads it with spaces, so it is exactly
+// as wide as given.
+//
+// Parameters:
+//	line - the line to fit
+//	width - the number of characters of the result
+func fitLine(line string, width int) string {
+
+	runes := []rune(line)
+	if len(runes) >= width {
+		return string(runes[:width])
+	}
+	return line + strings.Repeat(" ", width - len(runes))
+
+}
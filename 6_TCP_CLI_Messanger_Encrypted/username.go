@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	minUsernameLength = 3
+	maxUsernameLength = 20
+)
+
+// Error codes of the username policy. They are sent to the client along
+// with the reason, so a client can react to them without parsing the text.
+const (
+	USERNAME_LENGTH 	= "E_USERNAME_LENGTH"
+	USERNAME_CHARSET 	= "E_USERNAME_CHARSET"
+	USERNAME_START 		= "E_USERNAME_START"
+	USERNAME_RESERVED 	= "E_USERNAME_RESERVED"
+	USERNAME_TAKEN 		= "E_USERNAME_TAKEN"
+)
+
+// reservedUsernames can not be registered. "anonymous" is the name of
+// every connection which is not logged in.
+var reservedUsernames = []string{"anonymous"}
+
+// UsernameError is returned if a username does not meet the username
+// policy.
+type UsernameError struct {
+	Code   string
+	Reason string
+}
+
+func (e *UsernameError) Error() string {
+
+	return e.Reason + " (" + e.Code + ")"
+
+}
+
+// normalizeUsername converts the given username into its canonical form
+// and checks it against the username policy.
+// Fullwidth forms of ASCII characters are replaced by the ASCII characters
+// and upper case letters by lower case ones, so 'Alice' and 'ａｌｉｃｅ' both
+// become 'alice'. The canonical form may only consist of the letters
+// 'a'-'z', the digits '0'-'9', '_' and '-', has to start with a letter and
+// has to be between minUsernameLength and maxUsernameLength characters
+// long. As every other character is refused, two different canonical
+// names can not look alike, e.g. a cyrillic 'а' can not pass as a latin 'a'.
+// Returns the canonical username or a *UsernameError.
+//
+// Parameters:
+//	username - the username as given by the user
+func normalizeUsername(username string) (string, error) {
+
+	var builder strings.Builder
+	for _, r := range username {
+
+		// Fold the fullwidth forms U+FF01 to U+FF5E onto ASCII
+		if r >= 0xFF01 && r <= 0xFF5E {
+			r -= 0xFEE0
+		}
+		if r >= 'A' && r <= 'Z' {
+			r += 'a' - 'A'
+		}
+
+		isAllowed := (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' || r == '-'
+		if !isAllowed {
+			return "", &UsernameError{
+				Code: 	USERNAME_CHARSET,
+				Reason: fmt.Sprintf("usernames may only contain the letters a-z, digits, '_' and '-', but %q was given", r),
+			}
+		}
+		builder.WriteRune(r)
+
+	}
+	canonical := builder.String()
+
+	length := utf8.RuneCountInString(canonical)
+	if length < minUsernameLength || length > maxUsernameLength {
+		return "", &UsernameError{
+			Code: 	USERNAME_LENGTH,
+			Reason: fmt.Sprintf("usernames have to be between %d and %d characters long", minUsernameLength, maxUsernameLength),
+		}
+	}
+
+	if canonical[0] < 'a' || canonical[0] > 'z' {
+		return "", &UsernameError{
+			Code: 	USERNAME_START,
+			Reason: "usernames have to start with a letter",
+		}
+	}
+
+	for _, reserved := range reservedUsernames {
+		if canonical == reserved {
+			return "", &UsernameError{
+				Code: 	USERNAME_RESERVED,
+				Reason: "the username '" + canonical + "' is reserved",
+			}
+		}
+	}
+
+	return canonical, nil
+
+}
+
+// canonicalUsername returns the canonical form of the given username or
+// the username itself if it does not meet the username policy.
+func canonicalUsername(username string) string {
+
+	canonical, err := normalizeUsername(username)
+	if err != nil {
+		return username
+	}
+	return canonical
+
+}
+
+// resolveUsernameLocked returns the name under which the given user is
+// registered. Users are looked up by their exact name first, so accounts
+// which were registered before the username policy existed can still be
+// used, and by their canonical name otherwise. If neither is registered,
+// the canonical name, or the given name if it has none, is returned.
+// The function assumes that the s.muShadow Mutex is locked.
+//
+// Parameters:
+//	username - the username as given by a client
+func (s *Server) resolveUsernameLocked(username string) string {
+
+	if _, ok := s.usrPwdMap[username]; ok {
+		return username
+	}
+
+	canonical := canonicalUsername(username)
+	if registered, ok := s.findUsernameLocked(canonical, ""); ok {
+		return registered
+	}
+	return canonical
+
+}
+
+// findUsernameLocked returns the registered username which has the given
+// canonical name. Registered names which do not meet the username policy
+// are compared by their case folded form, so 'alice' is found as an old
+// account called 'Alice'.
+// The function assumes that the s.muShadow Mutex is locked.
+//
+// Parameters:
+//	canonical - the canonical form of the username to find
+//	except - a registered username which is skipped, e.g. the one of a user who renames
+func (s *Server) findUsernameLocked(canonical string, except string) (string, bool) {
+
+	if _, ok := s.usrPwdMap[canonical]; ok && canonical != except {
+		return canonical, true
+	}
+
+	for registered := range s.usrPwdMap {
+		if registered == except {
+			continue
+		}
+		if strings.EqualFold(registered, canonical) || canonicalUsername(registered) == canonical {
+			return registered, true
+		}
+	}
+	return "", false
+
+}
+
+// reportInvalidUsernames checks every registered username against the
+// username policy. Usernames which do not meet it and usernames which
+// look alike once normalized are written to the username report in the
+// servers data directory, along with what the users have to do about it.
+// Those accounts keep working, but their users are asked to choose a
+// valid name with '/rename' whenever they log in.
+// If every username is valid, an existing report is removed.
+func (s *Server) reportInvalidUsernames() {
+
+	usernames := make([]string, 0, len(s.usrPwdMap))
+	for username := range s.usrPwdMap {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var lines []string
+	canonicalOwners := make(map[string][]string)
+	for _, username := range usernames {
+
+		canonical, err := normalizeUsername(username)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("%q: %s. The user has to choose a new name with '/rename'.", username, err))
+			continue
+		}
+		canonicalOwners[canonical] = append(canonicalOwners[canonical], username)
+		if canonical != username {
+			lines = append(lines, fmt.Sprintf("%q: is not in canonical form, which is %q. The user has to choose a new name with '/rename'.", username, canonical))
+		}
+
+	}
+
+	for canonical, owners := range canonicalOwners {
+		if len(owners) > 1 {
+			quoted := make([]string, len(owners))
+			for i, owner := range owners {
+				quoted[i] = fmt.Sprintf("%q", owner)
+			}
+			lines = append(lines, fmt.Sprintf("%s: look alike once normalized to %q. All but one of them have to choose a new name with '/rename'.", strings.Join(quoted, ", "), canonical))
+		}
+	}
+
+	if len(lines) == 0 {
+		if fileExists(usernameReportPath) {
+			err := os.Remove(usernameReportPath)
+			if err != nil {
+				slog.Error("Removing outdated username report", "err", err)
+			}
+		}
+		return
+	}
+	sort.Strings(lines)
+
+	report := "Registered usernames which do not meet the username policy:\n" + strings.Join(lines, "\n") + "\n"
+	err := writeFileAtomic(usernameReportPath, []byte(report))
+	if err != nil {
+		slog.Error("Writing username report", "err", err)
+	}
+
+	slog.Warn("Found problems with registered usernames", "count", len(lines), "report", usernameReportPath)
+
+}
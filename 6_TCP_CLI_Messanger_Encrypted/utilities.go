@@ -1,9 +1,18 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sync"
+	"time"
 	"unicode"
 )
 
@@ -12,6 +21,230 @@ type Packet struct {
 	Payload	string `json:"payload"`
 }
 
+// DeviceInfo is the public part of a device as it is distributed
+// by the server.
+type DeviceInfo struct {
+	ID  string `json:"id"`
+	Key string `json:"key"`
+}
+
+// DeviceList is the payload of a "DEVICES" packet. It holds every
+// device registered for the given user.
+type DeviceList struct {
+	Username string 	  `json:"username"`
+	Devices  []DeviceInfo `json:"devices"`
+}
+
+// ChatEnvelope is the payload of a "MESSAGE" packet sent by a client.
+// The message is encrypted once for every device of the recipient and
+// every other device of the sender. Ciphertexts maps from the device ID
+// to the ciphertext for that device. Messages addressed to a chat are
+// routed to its other member, To is only used if no chat is given.
+type ChatEnvelope struct {
+	ID 			string 			  `json:"id,omitempty"` // Chosen by the sender to match receipts with the message
+	Chat 		string 			  `json:"chat,omitempty"` // The ID of the chat the message is sent to
+	To 			string 			  `json:"to"`
+	Action 		string 			  `json:"action,omitempty"` // CHAT_ACTION_EDIT or CHAT_ACTION_DELETE, empty for new messages
+	Ref 		string 			  `json:"ref,omitempty"`    // The message which is edited, deleted or replied to
+	Ciphertexts map[string]string `json:"ciphertexts"`
+}
+
+// Actions of chat messages which change an earlier message of the sender
+// instead of adding a new one.
+const (
+	CHAT_ACTION_EDIT 	= "edit"
+	CHAT_ACTION_DELETE 	= "delete"
+)
+
+// ChatDelivery is the payload of a "CHAT" packet sent by the server.
+// It holds the ciphertext of a chat message for exactly one device.
+type ChatDelivery struct {
+	ID 			string `json:"id,omitempty"`
+	Chat 		string `json:"chat"`
+	From 		string `json:"from"`
+	FromDevice 	string `json:"fromDevice"`
+	FromKey 	string `json:"fromKey"`
+	To 			string `json:"to"`
+	Action 		string `json:"action,omitempty"`
+	Ref 		string `json:"ref,omitempty"`
+	Ciphertext 	string `json:"ciphertext"`
+	Expires 	time.Time `json:"expires,omitzero"` // When the message disappears, zero if no timer is set for the chat
+}
+
+// ChatError is the payload of an "ERROR" packet, which the server sends
+// back instead of routing a chat message.
+type ChatError struct {
+	ID 		string `json:"id,omitempty"` // The message which was not routed
+	Chat 	string `json:"chat,omitempty"`
+	Code 	string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes of chat messages which were not routed.
+const (
+	CHAT_NOT_MEMBER 	= "E_CHAT_NOT_MEMBER" 	// The chat does not exist or the sender is no member of it
+	CHAT_DUPLICATE_ID 	= "E_DUPLICATE_ID" 		// Another message of the chat has the same ID
+)
+
+// chatID returns the ID of the chat of the two given users. Both the
+// server and the clients derive it from the usernames, so it changes
+// when one of them is renamed.
+//
+// Parameters:
+//	userA - one member of the chat
+//	userB - the other member of the chat
+func chatID(userA string, userB string) string {
+
+	sum := sha256.Sum256([]byte(min(userA, userB) + ":" + max(userA, userB)))
+	return hex.EncodeToString(sum[:8])
+
+}
+
+// AccountRename is the payload of a "RENAMED" packet sent by the server
+// to every device of a renamed user and of the users chat partners.
+type AccountRename struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// Presence is the payload of a "PRESENCE" packet sent by the server to
+// every user who has the given user in their contact list once the user
+// logs in or out.
+type Presence struct {
+	Username string `json:"username"`
+	Online 	 bool 	`json:"online"`
+}
+
+// Receipt is the payload of a "RECEIPT" packet. The server sends one with
+// the status "delivered" to the sender of a chat message once the message
+// has been written to the connection or the queue of a device of the
+// recipient. Clients send one with the status "read" once the chat is
+// open in chat mode, which the server forwards to every device of the
+// sender.
+type Receipt struct {
+	From 	string 	 `json:"from"` // The recipient of the messages, set by the server
+	To 		string 	 `json:"to"`   // The sender of the messages
+	IDs 	[]string `json:"ids"`
+	Status 	string 	 `json:"status"`
+}
+
+// Signal is the payload of a "SIGNAL" packet, e.g. that a user started
+// or stopped typing. Signals are only relayed to chat partners who are
+// online and are never stored or queued by the server.
+type Signal struct {
+	From string `json:"from"` // Set by the server
+	To 	 string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// ChatTimer is the payload of a "TIMER" packet sent by the server to
+// every device of both users of a chat once one of them changed the
+// disappearing message timer of the chat.
+type ChatTimer struct {
+	From  string 		`json:"from"` // The user who changed the timer
+	To 	  string 		`json:"to"`
+	Timer time.Duration `json:"timer"` // Zero if messages no longer disappear
+}
+
+// writePacket marshals the given packet and writes it to the given
+// connection, prefixed by its length. Length and packet are written with
+// a single Write, so packets written by several goroutines to a syncConn
+// or a WebSocket never interleave.
+func writePacket(conn net.Conn, packet Packet) error {
+
+	jsonData, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 0, 4 + len(jsonData))
+	frame  = binary.BigEndian.AppendUint32(frame, uint32(len(jsonData)))
+	frame  = append(frame, jsonData...)
+
+	_, err = conn.Write(frame)
+	return err
+
+}
+
+// syncConn is a connection of the server whose writes are serialized by
+// a lock. Every packet is written with a single Write, so the lock is held
+// for the whole packet, no matter which goroutine writes it.
+type syncConn struct {
+	net.Conn
+	muWrite sync.Mutex
+}
+
+func (sc *syncConn) Write(b []byte) (int, error) {
+
+	sc.muWrite.Lock()
+	defer sc.muWrite.Unlock()
+	return sc.Conn.Write(b)
+
+}
+
+// readPacket reads the next length prefixed packet from the given
+// connection.
+func readPacket(conn net.Conn) (Packet, error) {
+
+	var length uint32
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return Packet{}, err
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return Packet{}, err
+	}
+
+	var packet Packet
+	err := json.Unmarshal(data, &packet)
+	return packet, err
+
+}
+
+// writeFileAtomic writes the given data to a temporary file next to the
+// given path, flushes it to disk and moves it over the file at the given
+// path afterwards. After a crash the file therefore either holds its old
+// or its new content, but never only a part of it.
+//
+// Parameters:
+//	path - the file to write
+//	data - the new content of the file
+func writeFileAtomic(path string, data []byte) error {
+
+	tempPath := path + ".tmp"
+	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	err = os.Rename(tempPath, path)
+	if err != nil {
+		return err
+	}
+
+	// Flush the rename itself
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+
+}
+
 func isNumeric(s string) bool {
 
 	for _, r := range s {
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+)
+
+// ClientView shows the output of the client and reads the input of the
+// user. The networking code of the client only talks to its view, so the
+// same client can run in the full-screen terminal interface or headless
+// for scripting.
+type ClientView interface {
+	// ReadInput sends every line the user enters into the given channel
+	// until the input ends.
+	ReadInput(inputCh chan<- string) error
+	// Printf shows output which does not belong to a chat, e.g. results
+	// of commands and errors.
+	Printf(format string, args ...any)
+	Println(args ...any)
+	// ServerMessage shows a packet of the server the client has no
+	// special handling for, e.g. the text responses to commands.
+	ServerMessage(msgType string, payload string)
+	// ChatLine shows a line in the chat with the given partner.
+	ChatLine(partner string, format string, args ...any)
+	// Signal shows an ephemeral signal of a chat partner.
+	Signal(partner string, kind string)
+	// ReplaceMessage shows the replacement in place of a chat message,
+	// e.g. once it was edited, deleted or has disappeared, as far as the
+	// output allows it. The text is empty if the message is not known.
+	ReplaceMessage(partner string, id string, from string, text string, replacement string)
+	// SetStatus updates the user the client is logged in as and the
+	// chat which is open in chat mode.
+	SetStatus(username string, activeChat string)
+	// BeginSecret asks for input which must not be shown, e.g. a
+	// password. The returned function ends the secret input.
+	BeginSecret(prompt string) func()
+	// Close restores the terminal.
+	Close()
+}
+
+// newClientView returns the full-screen terminal interface if both stdin
+// and stdout are terminals and the headless view otherwise, e.g. if the
+// input is piped into the client by a script.
+//
+// Parameters:
+//	c - the client the view belongs to
+//	headless - use the headless view even in a terminal
+func newClientView(c *Client, headless bool) ClientView {
+
+	if !headless && isTerminal(os.Stdin) && isTerminal(os.Stdout) {
+		view, err := newTUIView(c)
+		if err == nil {
+			return view
+		}
+		fmt.Println("[Warning] Starting the full-screen interface failed, falling back to plain output:", err)
+	}
+	return &headlessView{}
+
+}
+
+// headlessView prints every output line by line and reads the input line
+// by line from stdin.
+type headlessView struct{}
+
+func (v *headlessView) ReadInput(inputCh chan<- string) error {
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		inputCh <- scanner.Text()
+	}
+	return scanner.Err()
+
+}
+
+func (v *headlessView) Printf(format string, args ...any) {
+
+	fmt.Printf(format, args...)
+
+}
+
+func (v *headlessView) Println(args ...any) {
+
+	fmt.Println(args...)
+
+}
+
+func (v *headlessView) ServerMessage(msgType string, payload string) {
+
+	fmt.Printf("Received data from server.\nType: %s\nPayload:%s\n", msgType, payload)
+
+}
+
+func (v *headlessView) ChatLine(partner string, format string, args ...any) {
+
+	fmt.Printf("[" + partner + "] " + format + "\n", args...)
+
+}
+
+func (v *headlessView) Signal(partner string, kind string) {
+
+	switch kind {
+	case SIGNAL_TYPING:
+		fmt.Printf("[%s] %s is typing...\n", partner, partner)
+	case SIGNAL_STOPPED:
+		fmt.Printf("[%s] %s stopped typing.\n", partner, partner)
+	}
+
+}
+
+// ReplaceMessage can not take back printed lines, so the replacement is
+// printed as a new line.
+func (v *headlessView) ReplaceMessage(partner string, id string, from string, text string, replacement string) {
+
+	fmt.Printf("[%s] %s\n", partner, replacement)
+
+}
+
+func (v *headlessView) SetStatus(username string, activeChat string) {}
+
+// BeginSecret prints the prompt and turns off the echo of the terminal,
+// if stdin is one, so the secret does not show up on the screen or in
+// the scrollback.
+func (v *headlessView) BeginSecret(prompt string) func() {
+
+	fmt.Print(prompt)
+
+	restoreEcho, err := disableEcho()
+	if err != nil {
+		fmt.Println("\n[Warning] Hiding the password failed, it will be visible while typing:", err)
+		return func() {}
+	}
+
+	return func() {
+		restoreEcho()
+		// The newline was not echoed either
+		fmt.Println()
+	}
+
+}
+
+func (v *headlessView) Close() {}
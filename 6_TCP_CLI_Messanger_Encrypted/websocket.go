@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	_ "embed"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// If a WebSocket address is given, the server serves a small browser
+// client on '/' and accepts WebSocket connections on '/ws'. Every
+// WebSocket connection carries the same length prefixed Packet frames as
+// a TCP connection, split into binary WebSocket messages at arbitrary
+// points, and is handled by handleClientConnection like any other
+// connection. Browser clients therefore share all handlers and state
+// with the TCP clients. Like the TCP clients, the browser client keeps
+// its device key and ratchet sessions to itself and encrypts every chat
+// message end to end. The WebSocket listener uses the TLS certificate of
+// the server if there is one.
+
+// websocketGUID is appended to the key of the opening handshake by the
+// WebSocket protocol (RFC 6455).
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketFrame is the largest payload of a single WebSocket frame a
+// client may send, which leaves room for a file chunk encrypted for a
+// lot of devices.
+const maxWebSocketFrame = 4 * 1024 * 1024
+
+// Opcodes of WebSocket frames.
+const (
+	WS_CONTINUATION = 0x0
+	WS_TEXT 		= 0x1
+	WS_BINARY 		= 0x2
+	WS_CLOSE 		= 0x8
+	WS_PING 		= 0x9
+	WS_PONG 		= 0xA
+)
+
+//go:embed web/index.html
+var webClientPage []byte
+
+// wsConn is a server side WebSocket connection which reads and writes
+// the payload of WebSocket messages as a stream of bytes. The frame
+// being read is kept between calls to Read, so a read deadline running
+// out in the middle of a frame loses nothing.
+type wsConn struct {
+	net.Conn
+	reader 	  *bufio.Reader // Holds what the client sent along with the opening handshake
+	header 	  []byte 		// The header of the next frame, as far as it has been read
+	opcode 	  byte 			// The opcode of the frame being read
+	remaining int64 		// Bytes of the payload of the frame being read which are left
+	mask 	  [4]byte
+	maskPos   int
+	control   []byte 		// The payload of the control frame being read
+	muWrite   sync.Mutex 	// Keeps frames written by several goroutines apart
+	closeOnce sync.Once
+}
+
+// Read reads the payload of data frames. Pings are answered and a close
+// frame ends the stream with io.EOF.
+func (ws *wsConn) Read(b []byte) (int, error) {
+
+	for {
+
+		// Stream the payload of data frames
+		if ws.remaining > 0 && ws.opcode < WS_CLOSE {
+			n, err := ws.reader.Read(b[:min(int64(len(b)), ws.remaining)])
+			ws.unmask(b[:n])
+			ws.remaining -= int64(n)
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+
+		// Control frames are collected and handled once complete
+		if ws.remaining > 0 {
+			buffer := make([]byte, ws.remaining)
+			n, err := ws.reader.Read(buffer)
+			ws.unmask(buffer[:n])
+			ws.control   = append(ws.control, buffer[:n]...)
+			ws.remaining -= int64(n)
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if ws.opcode >= WS_CLOSE {
+			if err := ws.handleControlFrame(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if err := ws.readHeader(); err != nil {
+			return 0, err
+		}
+
+	}
+
+}
+
+// readHeader reads the header of the next frame. The header is read byte
+// by byte, so it can be continued after a read deadline ran out.
+func (ws *wsConn) readHeader() error {
+
+	needed := 2
+	for len(ws.header) < needed {
+
+		c, err := ws.reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		ws.header = append(ws.header, c)
+
+		// The second byte tells how long the rest of the header is
+		if len(ws.header) >= 2 {
+			needed = 2 + 4
+			switch ws.header[1] & 0x7F {
+			case 126:
+				needed += 2
+			case 127:
+				needed += 8
+			}
+		}
+
+	}
+
+	header := ws.header
+	ws.header = nil
+
+	if header[1] & 0x80 == 0 {
+		return errors.New("client sent an unmasked WebSocket frame")
+	}
+
+	length := int64(header[1] & 0x7F)
+	rest   := header[2:]
+	switch length {
+	case 126:
+		length = int64(binary.BigEndian.Uint16(rest))
+		rest   = rest[2:]
+	case 127:
+		length = int64(binary.BigEndian.Uint64(rest) & (1<<63 - 1))
+		rest   = rest[8:]
+	}
+	if length > maxWebSocketFrame {
+		return fmt.Errorf("client sent a WebSocket frame of %d bytes", length)
+	}
+
+	opcode := header[0] & 0x0F
+	switch opcode {
+	case WS_CONTINUATION, WS_TEXT, WS_BINARY:
+	case WS_CLOSE, WS_PING, WS_PONG:
+		if length > 125 || header[0] & 0x80 == 0 {
+			return errors.New("client sent an invalid WebSocket control frame")
+		}
+	default:
+		return fmt.Errorf("client sent a WebSocket frame with the unknown opcode %d", opcode)
+	}
+
+	// Data frames continue the stream no matter how messages are fragmented
+	ws.opcode 	 = opcode
+	ws.remaining = length
+	ws.maskPos 	 = 0
+	ws.control 	 = nil
+	copy(ws.mask[:], rest)
+	return nil
+
+}
+
+// handleControlFrame answers the control frame which has just been read
+// completely. Returns io.EOF if the client closed the connection.
+func (ws *wsConn) handleControlFrame() error {
+
+	opcode := ws.opcode
+	ws.opcode = WS_CONTINUATION
+
+	switch opcode {
+	case WS_PING:
+		return ws.writeFrame(WS_PONG, ws.control)
+	case WS_CLOSE:
+		ws.closeOnce.Do(func() {
+			ws.writeFrame(WS_CLOSE, nil)
+		})
+		return io.EOF
+	}
+	return nil
+
+}
+
+// unmask reverts the masking of payload bytes sent by the client.
+func (ws *wsConn) unmask(b []byte) {
+
+	for i := range b {
+		b[i] ^= ws.mask[ws.maskPos % 4]
+		ws.maskPos++
+	}
+
+}
+
+// Write sends the given bytes as one binary message.
+func (ws *wsConn) Write(b []byte) (int, error) {
+
+	if err := ws.writeFrame(WS_BINARY, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+
+}
+
+// writeFrame writes a single unmasked frame, as servers send them.
+//
+// Parameters:
+//	opcode - the kind of frame
+//	payload - the payload of the frame
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+
+	frame := make([]byte, 0, len(payload) + 10)
+	frame  = append(frame, 0x80 | opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	ws.muWrite.Lock()
+	defer ws.muWrite.Unlock()
+
+	_, err := ws.Conn.Write(frame)
+	return err
+
+}
+
+// Close sends a close frame, unless the client closed the connection,
+// and closes the underlying connection.
+func (ws *wsConn) Close() error {
+
+	ws.closeOnce.Do(func() {
+		ws.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+		ws.writeFrame(WS_CLOSE, nil)
+	})
+	return ws.Conn.Close()
+
+}
+
+// websocketAccept returns the value of the Sec-WebSocket-Accept header
+// answering the given Sec-WebSocket-Key.
+func websocketAccept(key string) string {
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+
+}
+
+// headerHasToken reports whether the comma separated header of the
+// request holds the given token, ignoring case.
+func headerHasToken(r *http.Request, name string, token string) bool {
+
+	for _, value := range r.Header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+
+}
+
+// upgradeWebSocket performs the opening handshake of a WebSocket
+// connection. Only pages of this server may open a connection from a
+// browser.
+// Returns the WebSocket connection, or an error if the request is no
+// valid WebSocket handshake, in which case an error response has been
+// written.
+//
+// Parameters:
+//	w - the response to the handshake request
+//	r - the handshake request
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerHasToken(r, "Connection", "upgrade") || !headerHasToken(r, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "This endpoint only accepts WebSocket connections.", http.StatusBadRequest)
+		return nil, errors.New("request is no WebSocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version.", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported WebSocket version " + r.Header.Get("Sec-WebSocket-Version"))
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		originURL, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(originURL.Host, r.Host) {
+			http.Error(w, "Cross origin WebSocket connections are not allowed.", http.StatusForbidden)
+			return nil, errors.New("cross origin request from " + origin)
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket connections are not supported.", http.StatusInternalServerError)
+		return nil, errors.New("response can not be hijacked")
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Deadlines of the HTTP server do not apply to the client connection
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{Conn: conn, reader: buffered.Reader}, nil
+
+}
+
+// serveWebSocket serves the browser client on '/' and accepts WebSocket
+// connections on '/ws' of s.wsAddr until the context is cancelled. Once
+// it is, the WebSocket clients are shut down like the TCP clients.
+//
+// Parameters:
+// 	ctx - Context for cancellation of function
+// 	mainWG - Waitgroup for syncing
+func (s *Server) serveWebSocket(ctx context.Context, mainWG *sync.WaitGroup) {
+
+	defer mainWG.Done()
+
+	var wg sync.WaitGroup
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src ws://" + r.Host + " wss://" + r.Host)
+		w.Write(webClientPage)
+	})
+	mux.HandleFunc("GET /ws", func(w http.ResponseWriter, r *http.Request) {
+
+		// Added before the handshake, so shutting down can not miss this client
+		wg.Add(1)
+
+		ws, err := upgradeWebSocket(w, r)
+		if err != nil {
+			slog.Info("Refused WebSocket connection", "remote", r.RemoteAddr, "err", err)
+			wg.Done()
+			return
+		}
+
+		s.handleClientConnection(ctx, &wg, &syncConn{Conn: &countingConn{Conn: ws, stats: s.stats}})
+
+	})
+
+	ln, err := net.Listen("tcp", s.wsAddr)
+	if err != nil {
+		slog.Error("Starting to listen for WebSocket connections", "err", err)
+		return
+	}
+	if s.tlsConfig != nil {
+		ln = tls.NewListener(ln, s.tlsConfig)
+	}
+
+	httpServer := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	stop := context.AfterFunc(ctx, func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	})
+	defer stop()
+
+	slog.Info("Serving browser client and WebSocket connections", "addr", ln.Addr().String(), "tls", s.tlsConfig != nil)
+	err = httpServer.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Serving WebSocket connections", "err", err)
+	}
+
+	slog.Info("Shutting down: Serving WebSocket connections")
+	slog.Info("Waiting for WebSocket client handlers to terminate")
+	wg.Wait()
+	slog.Info("All WebSocket client handlers terminated")
+
+}
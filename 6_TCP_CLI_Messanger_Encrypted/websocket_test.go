@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestConn is the client side of a WebSocket connection. It masks what
+// it writes and splits every write into two frames of one message, so
+// the server has to join fragments.
+type wsTestConn struct {
+	net.Conn
+	reader 	  *bufio.Reader
+	remaining int64 // Bytes of the payload of the frame being read which are left
+}
+
+func (c *wsTestConn) Read(b []byte) (int, error) {
+
+	for c.remaining == 0 {
+
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return 0, err
+		}
+		if header[1] & 0x80 != 0 {
+			return 0, errors.New("server sent a masked frame")
+		}
+
+		length := int64(header[1] & 0x7F)
+		switch length {
+		case 126:
+			var extended uint16
+			if err := binary.Read(c.reader, binary.BigEndian, &extended); err != nil {
+				return 0, err
+			}
+			length = int64(extended)
+		case 127:
+			if err := binary.Read(c.reader, binary.BigEndian, &length); err != nil {
+				return 0, err
+			}
+		}
+
+		switch header[0] & 0x0F {
+		case WS_CLOSE:
+			return 0, io.EOF
+		case WS_PING, WS_PONG:
+			if _, err := c.reader.Discard(int(length)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		c.remaining = length
+
+	}
+
+	n, err := c.reader.Read(b[:min(int64(len(b)), c.remaining)])
+	c.remaining -= int64(n)
+	return n, err
+
+}
+
+func (c *wsTestConn) Write(b []byte) (int, error) {
+
+	half := len(b) / 2
+	if err := c.writeFrame(WS_BINARY, false, b[:half]); err != nil {
+		return 0, err
+	}
+	if err := c.writeFrame(WS_CONTINUATION, true, b[half:]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+
+}
+
+// writeFrame writes a masked frame, as clients send them.
+//
+// Parameters:
+//	opcode - the kind of frame
+//	fin - whether the frame is the last one of its message
+//	payload - the payload of the frame
+func (c *wsTestConn) writeFrame(opcode byte, fin bool, payload []byte) error {
+
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80 | byte(len(payload)))
+	default:
+		frame = append(frame, 0x80 | 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+
+	mask  := [4]byte{0x12, 0x34, 0x56, 0x78}
+	frame  = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b ^ mask[i % 4])
+	}
+
+	_, err := c.Conn.Write(frame)
+	return err
+
+}
+
+// dialWebSocket opens a WebSocket connection to '/ws' of the given
+// address.
+// Returns the connection and the response to the handshake. The
+// connection is nil if the server refused it.
+//
+// Parameters:
+//	addr - the address of the WebSocket listener
+//	origin - the Origin header of the handshake, none if empty
+func dialWebSocket(addr string, origin string) (net.Conn, *http.Response, error) {
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request, err := http.NewRequest("GET", "http://" + addr + "/ws", nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if origin != "" {
+		request.Header.Set("Origin", origin)
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, response, nil
+	}
+	return &wsTestConn{Conn: conn, reader: reader}, response, nil
+
+}
+
+// startWebSocketServer starts a test server which accepts WebSocket
+// connections as well.
+// Returns the address of the TCP listener and of the WebSocket listener.
+func startWebSocketServer(t *testing.T) (string, string) {
+
+	t.Helper()
+
+	// The listener is opened by the server, so a free port is looked for first
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsAddr := ln.Addr().String()
+	ln.Close()
+
+	_, addr, _ := startTestServer(t, func(s *Server) {
+		unlimitedRates(s)
+		s.wsAddr = wsAddr
+	})
+
+	// Wait until the WebSocket listener is up
+	for range 100 {
+		if response, err := http.Get("http://" + wsAddr + "/"); err == nil {
+			response.Body.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return addr, wsAddr
+
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+
+	_, wsAddr := startWebSocketServer(t)
+
+	// The example handshake of RFC 6455
+	conn, response, err := dialWebSocket(wsAddr, "http://" + wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn == nil {
+		t.Fatalf("handshake was refused with %s", response.Status)
+	}
+	conn.Close()
+	if accept := response.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept is %q", accept)
+	}
+
+	conn, response, err = dialWebSocket(wsAddr, "https://evil.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn != nil || response.StatusCode != http.StatusForbidden {
+		t.Errorf("cross origin handshake was answered with %s, want 403", response.Status)
+	}
+
+	response, err = http.Get("http://" + wsAddr + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain request to '/ws' was answered with %s, want 400", response.Status)
+	}
+
+	response, err = http.Get("http://" + wsAddr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(page), "<title>Messanger</title>") {
+		t.Errorf("'/' does not serve the browser client, got %s %q", response.Header.Get("Content-Type"), page[:min(len(page), 100)])
+	}
+
+}
+
+func TestWebSocketSharesStateWithTCP(t *testing.T) {
+
+	addr, wsAddr := startWebSocketServer(t)
+
+	alice, err := newLoadClient(t, addr, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, response, err := dialWebSocket(wsAddr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn == nil {
+		t.Fatalf("handshake was refused with %s", response.Status)
+	}
+	bob, err := startLoadClient(t, conn, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, client := range []*loadClient{alice, bob} {
+		if err := client.registerAndLogin(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bob.command("/online"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.expect("Users online: alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Chat requests and messages cross between both kinds of connections
+	if err := alice.openChat(bob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.sendMessages(bob, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.sendMessages(alice, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bob.command("/quit"); err != nil {
+		t.Fatal(err)
+	}
+	<-bob.closed
+
+}
+
+func TestWebSocketOnePacketPerFrame(t *testing.T) {
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &syncConn{Conn: &wsConn{Conn: server, reader: bufio.NewReader(server)}}
+	defer conn.Close()
+
+	// Several goroutines write to the same connection, like the dispatch
+	// goroutine and the goroutine answering a client do
+	const writers, packets = 4, 25
+	for w := range writers {
+		go func() {
+			for i := range packets {
+				writePacket(conn, Packet{MsgType: "MESSAGE", Payload: strings.Repeat(string(rune('a' + w)), 100 + i)})
+			}
+		}()
+	}
+
+	reader := bufio.NewReader(client)
+	for range writers * packets {
+
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			t.Fatal(err)
+		}
+		length := int(header[1] & 0x7F)
+		if length == 126 {
+			var extended uint16
+			if err := binary.Read(reader, binary.BigEndian, &extended); err != nil {
+				t.Fatal(err)
+			}
+			length = int(extended)
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			t.Fatal(err)
+		}
+
+		// Every frame holds one whole packet along with its length
+		if len(payload) < 4 || int(binary.BigEndian.Uint32(payload)) != len(payload) - 4 {
+			t.Fatalf("frame of %d bytes does not hold one packet: %q", len(payload), payload[:min(len(payload), 20)])
+		}
+		text := string(payload[4:])
+		if !strings.HasPrefix(text, `{"msgType":"MESSAGE","payload":"`) || !strings.HasSuffix(text, `"}`) {
+			t.Fatalf("frame holds %q, want one packet", text)
+		}
+
+	}
+
+}